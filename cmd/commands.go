@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"Bank-Management-System/config"
+	"Bank-Management-System/handlers"
+	"Bank-Management-System/notify"
+)
+
+// Run an administrative command instead of the web server
+func runCommand(args []string) {
+	switch args[0] {
+	case "reconcile":
+		reconcile(args[1:])
+	case "promote-admin":
+		promoteAdmin(args[1:])
+	case "import-rates":
+		importRates(args[1:])
+	case "run-job":
+		runJob(args[1:])
+	case "dispatch-events":
+		dispatchEvents(args[1:])
+	case "deliver-webhooks":
+		deliverWebhooks(args[1:])
+	case "send-notifications":
+		sendNotifications(args[1:])
+	case "fake-smtp":
+		fakeSMTP(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		fmt.Fprintln(os.Stderr, "commands: reconcile, promote-admin, import-rates, run-job, dispatch-events, deliver-webhooks, send-notifications, fake-smtp")
+		os.Exit(2)
+	}
+}
+
+// promoteAdmin gives a user access to the admin pages
+func promoteAdmin(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: promote-admin <username>")
+		os.Exit(2)
+	}
+
+	if err := handlers.PromoteAdmin(args[0]); err != nil {
+		fmt.Fprintln(os.Stderr, "promote-admin failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s is now an admin.\n", args[0])
+}
+
+// importRates loads exchange rates from a CSV file of base,quote,rate lines
+func importRates(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: import-rates <file.csv>")
+		os.Exit(2)
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import-rates failed:", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	n, err := handlers.ImportExchangeRates(file, "import:"+args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import-rates failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported %d rate(s).\n", n)
+}
+
+// reconcile compares materialized balances with the ledger
+func reconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "correct drifted balances from the ledger")
+	flags.Parse(args)
+
+	drifts, err := handlers.ReconcileBalances(*fix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reconciliation failed:", err)
+		os.Exit(1)
+	}
+
+	if len(drifts) == 0 {
+		fmt.Println("All balances match the ledger.")
+		return
+	}
+
+	for _, d := range drifts {
+		fmt.Printf("%s: stored %d, ledger %d, drift %d\n", d.AccountNumber, d.Stored, d.Ledger, d.Stored-d.Ledger)
+	}
+	if *fix {
+		fmt.Printf("Corrected %d account(s).\n", len(drifts))
+		return
+	}
+	fmt.Printf("%d account(s) drifted; run with -fix to correct them.\n", len(drifts))
+	os.Exit(1)
+}
+
+// runJob runs one background job now, or as of the given date
+func runJob(args []string) {
+	flags := flag.NewFlagSet("run-job", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what the job would do without saving it")
+	date := flags.String("date", "", "run as of this date (YYYY-MM-DD) instead of today")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: run-job [-dry-run] [-date YYYY-MM-DD] <%s>\n", strings.Join(handlers.JobNames(), "|"))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	now := time.Now().UTC()
+	if *date != "" {
+		var err error
+		now, err = time.Parse("2006-01-02", *date)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid -date:", err)
+			os.Exit(2)
+		}
+	}
+
+	summary, err := handlers.RunJob(flags.Arg(0), now, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "job failed:", err)
+		os.Exit(1)
+	}
+	if *dryRun {
+		summary += " (dry run, nothing saved)"
+	}
+	fmt.Println(summary)
+}
+
+// dispatchEvents hands outbox events to their subscribers, for when the
+// server's dispatcher is turned off
+func dispatchEvents(args []string) {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: dispatch-events")
+		os.Exit(2)
+	}
+
+	summary, err := handlers.DispatchEvents()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dispatch-events failed:", err)
+		os.Exit(1)
+	}
+	if summary == "" {
+		summary = "No events to dispatch."
+	}
+	fmt.Println(summary)
+}
+
+// deliverWebhooks sends the webhook deliveries that are due now, for when
+// the server's worker is turned off
+func deliverWebhooks(args []string) {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: deliver-webhooks")
+		os.Exit(2)
+	}
+
+	summary, err := handlers.DeliverWebhooks(time.Now().UTC())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "deliver-webhooks failed:", err)
+		os.Exit(1)
+	}
+	if summary == "" {
+		summary = "No webhooks due."
+	}
+	fmt.Println(summary)
+}
+
+// sendNotifications sends the queued email and SMS messages that are due
+// now, for when the server's sender is turned off
+func sendNotifications(args []string) {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: send-notifications")
+		os.Exit(2)
+	}
+
+	summary, err := handlers.SendNotifications(time.Now().UTC())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "send-notifications failed:", err)
+		os.Exit(1)
+	}
+	if summary == "" {
+		summary = "No messages due."
+	}
+	fmt.Println(summary)
+}
+
+// fakeSMTP runs a local mail server that writes what it receives to a
+// file, to try out BANK_EMAIL_SENDER=smtp without a real one
+func fakeSMTP(args []string) {
+	flags := flag.NewFlagSet("fake-smtp", flag.ExitOnError)
+	addr := flags.String("addr", config.SMTPAddr, "address to listen on")
+	out := flags.String("out", "mail.log", "file to append received mail to")
+	flags.Parse(args)
+
+	server := &notify.FakeSMTPServer{Addr: *addr, Path: *out}
+	fmt.Printf("Fake SMTP server listening on %s, writing mail to %s\n", *addr, *out)
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Fprintln(os.Stderr, "fake-smtp failed:", err)
+		os.Exit(1)
+	}
+}
@@ -4,14 +4,28 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
 	"Bank-Management-System/config"
+	"Bank-Management-System/handlers"
 	"Bank-Management-System/routes"
 )
 
 func main() {
 	config.InitDB()
+	if err := handlers.LoadNotificationTemplates("templates/notifications"); err != nil {
+		log.Fatal("Error loading notification templates: ", err)
+	}
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
 	router := routes.Routes()
+	handlers.StartScheduler()
+	handlers.StartEventDispatcher()
+	handlers.StartWebhookWorker()
+	handlers.StartNotificationSender()
 
 	fmt.Println("Server running on http://localhost:8080")
 	log.Fatal(http.ListenAndServe(":8080", router))
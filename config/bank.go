@@ -0,0 +1,211 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BranchCode is the 3 digit prefix of every account number issued here
+var BranchCode = getEnv("BANK_BRANCH_CODE", "001")
+
+// ProductCodes are the 2 digit account number segments for each account type
+var ProductCodes = map[string]string{
+	"current": getEnv("BANK_PRODUCT_CODE_CURRENT", "10"),
+	"savings": getEnv("BANK_PRODUCT_CODE_SAVINGS", "20"),
+	"loan":    getEnv("BANK_PRODUCT_CODE_LOAN", "30"),
+}
+
+// IdempotencyRetention is how long a stored response is replayed for
+// retries carrying the same idempotency key
+var IdempotencyRetention = getDuration("BANK_IDEMPOTENCY_RETENTION", 24*time.Hour)
+
+// IdempotencyLease is how long a request holds its idempotency key before
+// it finishes. A key still unfinished after that is taken to belong to a
+// request whose process stopped, and the next retry takes it over.
+var IdempotencyLease = getDuration("BANK_IDEMPOTENCY_LEASE", time.Minute)
+
+// FXSpreadBps is the margin, in basis points, taken off cross-currency transfers
+var FXSpreadBps = getInt("BANK_FX_SPREAD_BPS", 150)
+
+// SchedulerInterval is how often background jobs are run; 0 disables them
+var SchedulerInterval = getDuration("BANK_SCHEDULER_INTERVAL", time.Hour)
+
+// TermDepositRates are the annual rates, in basis points, paid on term
+// deposits for each term length in days
+var TermDepositRates = map[int]int64{
+	90:  getInt("BANK_TERM_RATE_90", 800),
+	180: getInt("BANK_TERM_RATE_180", 900),
+	365: getInt("BANK_TERM_RATE_365", 1000),
+}
+
+// TermDepositPenaltyBps is taken off the rate of a term deposit broken early
+var TermDepositPenaltyBps = getInt("BANK_TERM_PENALTY_BPS", 200)
+
+// StandingOrderMaxAttempts is how many times a due standing order is tried
+// before that payment is given up on
+var StandingOrderMaxAttempts = getInt("BANK_STANDING_ORDER_ATTEMPTS", 3)
+
+// CollectionAccountTypes are the account types loan arrears are collected
+// from, in the order they are drawn on
+var CollectionAccountTypes = strings.Split(getEnv("BANK_COLLECTION_ACCOUNTS", "current,savings"), ",")
+
+// CollectionPriority decides which arrears are collected first when there
+// is not enough to cover them all: "oldest" for the installment that fell
+// due first, or "highest-rate" for the most expensive loan first
+var CollectionPriority = getEnv("BANK_COLLECTION_PRIORITY", "oldest")
+
+// FraudAmountMultiplier flags payments more than this many times an
+// account's average payment
+var FraudAmountMultiplier = getInt("BANK_FRAUD_AMOUNT_MULTIPLIER", 5)
+
+// FraudRapidWindow is how soon after a deposit a payout of most of it is
+// treated as suspicious
+var FraudRapidWindow = getDuration("BANK_FRAUD_RAPID_WINDOW", time.Hour)
+
+// FraudLoginWindow is how long after a suspicious login payments are
+// screened against it
+var FraudLoginWindow = getDuration("BANK_FRAUD_LOGIN_WINDOW", 24*time.Hour)
+
+// FraudLargeShareBps is the share of an account's balance, in basis points,
+// above which a payment counts as large
+var FraudLargeShareBps = getInt("BANK_FRAUD_LARGE_SHARE_BPS", 5000)
+
+// FraudFailedLogins is how many failed logins in a row make the next
+// successful one suspicious
+var FraudFailedLogins = getInt("BANK_FRAUD_FAILED_LOGINS", 5)
+
+// HoldExpiry is how long reserved funds stay reserved unless the hold is
+// captured or released sooner
+var HoldExpiry = getDuration("BANK_HOLD_EXPIRY", 7*24*time.Hour)
+
+// DormancyMonths is how long an account can go without the customer moving
+// money in or out before it is marked dormant
+var DormancyMonths = getInt("BANK_DORMANCY_MONTHS", 12)
+
+// OAuthIssuer is the URL third-party apps reach the bank at. It names the
+// issuer of OAuth tokens and prefixes the endpoints in the OpenID
+// configuration.
+var OAuthIssuer = strings.TrimSuffix(getEnv("BANK_OAUTH_ISSUER", "http://localhost:8080"), "/")
+
+// OAuthCodeExpiry is how long an app has to exchange an authorization code
+var OAuthCodeExpiry = getDuration("BANK_OAUTH_CODE_EXPIRY", 10*time.Minute)
+
+// OAuthAccessTokenExpiry is how long an OAuth access token is accepted for
+var OAuthAccessTokenExpiry = getDuration("BANK_OAUTH_ACCESS_TOKEN_EXPIRY", time.Hour)
+
+// OAuthRefreshTokenExpiry is how long an app can go without refreshing
+// before the customer has to consent again
+var OAuthRefreshTokenExpiry = getDuration("BANK_OAUTH_REFRESH_TOKEN_EXPIRY", 30*24*time.Hour)
+
+// EventPollInterval is how often outbox events are handed to their
+// subscribers; 0 disables the dispatcher
+var EventPollInterval = getDuration("BANK_EVENT_POLL_INTERVAL", time.Second)
+
+// EventMaxAttempts is how many times in a row a subscriber may fail on an
+// event before the event is parked in its dead letters and the subscriber
+// moves on
+var EventMaxAttempts = getInt("BANK_EVENT_MAX_ATTEMPTS", 5)
+
+// WebhookPollInterval is how often the webhook worker looks for deliveries
+// that are due; 0 disables it
+var WebhookPollInterval = getDuration("BANK_WEBHOOK_POLL_INTERVAL", 10*time.Second)
+
+// WebhookTimeout is how long a subscriber has to answer a delivery
+var WebhookTimeout = getDuration("BANK_WEBHOOK_TIMEOUT", 10*time.Second)
+
+// WebhookRetryBase is the wait before the first retry of a failed delivery.
+// Each later retry waits twice as long as the one before.
+var WebhookRetryBase = getDuration("BANK_WEBHOOK_RETRY_BASE", 30*time.Second)
+
+// WebhookMaxAttempts is how many times a delivery is tried before it is
+// moved to the dead letters
+var WebhookMaxAttempts = getInt("BANK_WEBHOOK_MAX_ATTEMPTS", 8)
+
+// EmailSender picks how email is sent: "file" appends it to NotifyFile and
+// "smtp" sends it through SMTPAddr
+var EmailSender = getEnv("BANK_EMAIL_SENDER", "file")
+
+// SMSSender picks how SMS is sent: "file" appends it to NotifyFile and
+// "gateway" posts it to SMSGatewayURL
+var SMSSender = getEnv("BANK_SMS_SENDER", "file")
+
+// NotifyFile is where the file sender writes messages
+var NotifyFile = getEnv("BANK_NOTIFY_FILE", "notifications.log")
+
+// SMTP server and sender address for email. The default address is where
+// the fake-smtp command listens.
+var (
+	SMTPAddr     = getEnv("BANK_SMTP_ADDR", "localhost:2525")
+	SMTPFrom     = getEnv("BANK_SMTP_FROM", "Bank Sys <no-reply@banksys.local>")
+	SMTPUsername = getEnv("BANK_SMTP_USERNAME", "")
+	SMTPPassword = getEnv("BANK_SMTP_PASSWORD", "")
+)
+
+// SMS gateway endpoint and the bearer token it expects
+var (
+	SMSGatewayURL   = getEnv("BANK_SMS_GATEWAY_URL", "")
+	SMSGatewayToken = getEnv("BANK_SMS_GATEWAY_TOKEN", "")
+)
+
+// NotifyPollInterval is how often queued messages are sent; 0 disables the
+// sender
+var NotifyPollInterval = getDuration("BANK_NOTIFY_POLL_INTERVAL", 5*time.Second)
+
+// NotifyMaxAttempts is how many times a message is tried before it is
+// marked failed. Each retry waits twice as long as the one before,
+// starting from NotifyRetryBase.
+var (
+	NotifyMaxAttempts = getInt("BANK_NOTIFY_MAX_ATTEMPTS", 5)
+	NotifyRetryBase   = getDuration("BANK_NOTIFY_RETRY_BASE", time.Minute)
+)
+
+// LowBalanceThreshold is the balance, in KES, below which a customer is
+// alerted after money leaves an account. Accounts in other currencies use
+// the equivalent at the stored exchange rate.
+var LowBalanceThreshold = getEnv("BANK_LOW_BALANCE_THRESHOLD", "1000")
+
+// LargeWithdrawalThreshold is the smallest withdrawal, in KES, a customer
+// is alerted about. Accounts in other currencies use the equivalent at the
+// stored exchange rate.
+var LargeWithdrawalThreshold = getEnv("BANK_LARGE_WITHDRAWAL_THRESHOLD", "50000")
+
+// InstallmentReminderDays is how many days before an installment is due
+// the borrower is reminded about it
+var InstallmentReminderDays = getInt("BANK_INSTALLMENT_REMINDER_DAYS", 3)
+
+// Read an environment variable, falling back to a default when unset
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Read a duration such as "24h" from the environment
+func getDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return d
+}
+
+// Read an integer from the environment
+func getInt(key string, fallback int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return n
+}
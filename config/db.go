@@ -10,12 +10,19 @@ import (
 
 var DB *sql.DB
 
+// DBPath is the SQLite database file the bank is kept in
+var DBPath = getEnv("BANK_DB_PATH", "bank.db")
+
 func InitDB() {
 	var err error
-	DB, err = sql.Open("sqlite3", "bank.db")
+	// BEGIN IMMEDIATE takes the write lock up front, so a transaction that
+	// checks a balance and then posts against it cannot interleave with
+	// another one doing the same; waiters retry for up to 5 seconds.
+	DB, err = sql.Open("sqlite3", DBPath+"?_txlock=immediate&_busy_timeout=5000")
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 	fmt.Println("Database initialized successfully.")
 	CreateTables()
+	Migrate()
 }
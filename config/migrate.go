@@ -0,0 +1,332 @@
+package config
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migrations upgrade databases created by earlier versions of CreateTables.
+// Each entry runs once, in order, and the schema version is tracked with
+// PRAGMA user_version so the list must only ever be appended to.
+var migrations = []func(tx *sql.Tx) error{
+	// 1: transactions are posted against an account rather than a user
+	func(tx *sql.Tx) error {
+		return addColumn(tx, "transactions", "account_number", "TEXT")
+	},
+	// 2: transfer legs share a reference, and postings record when they happened
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "transactions", "reference", "TEXT"); err != nil {
+			return err
+		}
+		return addColumn(tx, "transactions", "created_at", "DATETIME")
+	},
+	// 3: seed materialized balances from the ledger
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT OR REPLACE INTO balances (account_number, balance, updated_at)
+			SELECT account_number,
+				SUM(CASE WHEN type IN ('deposit', 'transfer_in') THEN amount ELSE -amount END),
+				CURRENT_TIMESTAMP
+			FROM transactions WHERE account_number IS NOT NULL
+			GROUP BY account_number`)
+		return err
+	},
+	// 4: amounts are stored in minor units of the account currency and loan
+	// interest rates in basis points instead of a float percentage
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "accounts", "currency", "TEXT NOT NULL DEFAULT 'KES'"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "transactions", "currency", "TEXT NOT NULL DEFAULT 'KES'"); err != nil {
+			return err
+		}
+
+		statements := []string{
+			"UPDATE transactions SET amount = amount * 100",
+			"UPDATE balances SET balance = balance * 100",
+			`CREATE TABLE loans_minor (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id TEXT NOT NULL,
+				loan_id TEXT NOT NULL UNIQUE,
+				amount INTEGER NOT NULL,
+				currency TEXT NOT NULL DEFAULT 'KES',
+				interest_rate_bps INTEGER NOT NULL,
+				repayment_period INTEGER NOT NULL,
+				status TEXT NOT NULL DEFAULT 'pending',
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY(user_id) REFERENCES users(user_id)
+			)`,
+			`INSERT INTO loans_minor (id, user_id, loan_id, amount, interest_rate_bps, repayment_period, status, created_at)
+				SELECT id, user_id, loan_id, amount * 100, CAST(ROUND(interest_rate * 100) AS INTEGER), repayment_period, status, created_at
+				FROM loans`,
+			"DROP TABLE loans",
+			"ALTER TABLE loans_minor RENAME TO loans",
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 5: admin users, and cross-currency postings keep the amount that was
+	// sent alongside the converted amount and the rate applied
+	func(tx *sql.Tx) error {
+		columns := []struct{ table, column, definition string }{
+			{"users", "role", "TEXT NOT NULL DEFAULT 'customer'"},
+			{"transactions", "original_amount", "INTEGER"},
+			{"transactions", "original_currency", "TEXT"},
+			{"transactions", "fx_rate", "INTEGER"},
+		}
+		for _, c := range columns {
+			if err := addColumn(tx, c.table, c.column, c.definition); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 6: admin-approved overdraft facilities
+	func(tx *sql.Tx) error {
+		columns := []struct{ column, definition string }{
+			{"overdraft_limit", "INTEGER NOT NULL DEFAULT 0"},
+			{"overdraft_rate_bps", "INTEGER NOT NULL DEFAULT 0"},
+			{"overdraft_approved_by", "TEXT"},
+			{"overdraft_approved_at", "DATETIME"},
+		}
+		for _, c := range columns {
+			if err := addColumn(tx, "accounts", c.column, c.definition); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 7: savings accounts earn interest under a savings product; seed a
+	// default KES product so existing savings accounts start earning
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "accounts", "savings_product", "TEXT"); err != nil {
+			return err
+		}
+
+		statements := []string{
+			`INSERT OR IGNORE INTO savings_products (code, name, currency, is_default) VALUES ('standard', 'Standard Savings', 'KES', 1)`,
+			`INSERT OR IGNORE INTO savings_product_tiers (product_code, min_balance, rate_bps) VALUES
+				('standard', 0, 200),
+				('standard', 10000000, 350),
+				('standard', 100000000, 500)`,
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 8: loans track what is still owed so they can be repaid in parts
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "loans", "outstanding", "INTEGER"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE loans SET outstanding = amount WHERE outstanding IS NULL")
+		return err
+	},
+	// 9: approved loans record who approved them and where the money went,
+	// and customers can opt out of automatic arrears collection
+	func(tx *sql.Tx) error {
+		columns := []struct{ table, column, definition string }{
+			{"loans", "approved_by", "TEXT"},
+			{"loans", "approved_at", "DATETIME"},
+			{"loans", "disbursed_to", "TEXT"},
+			{"users", "auto_collect", "INTEGER NOT NULL DEFAULT 1"},
+		}
+		for _, c := range columns {
+			if err := addColumn(tx, c.table, c.column, c.definition); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 10: postings record the channel they came through so outgoing
+	// payments can be limited per channel; seed limits for web banking
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "transactions", "channel", "TEXT"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO transaction_limits (account_type, channel, currency, per_transaction, daily_amount, monthly_amount, daily_count, monthly_count) VALUES
+				('current', 'web', 'KES', 15000000, 30000000, 300000000, 20, 300),
+				('savings', 'web', 'KES', 5000000, 10000000, 50000000, 3, 10)`)
+		return err
+	},
+	// 11: fraud rules screened on outgoing payments
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO fraud_rules (code, description, action) VALUES
+				('unusual_amount', 'Amount far above what the account usually pays out', 'hold'),
+				('deposit_then_withdraw', 'Most of a recent deposit leaving again straight away', 'hold'),
+				('new_device_large_payment', 'Large payment soon after logging in from a new device', 'hold'),
+				('failed_logins_then_success', 'Payment soon after a login that followed many failed attempts', 'block')`)
+		return err
+	},
+	// 12: accounts record why and when their status last changed
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "accounts", "status_reason", "TEXT"); err != nil {
+			return err
+		}
+		return addColumn(tx, "accounts", "status_changed_at", "DATETIME")
+	},
+	// 13: payments made through the API get the same limits as the web
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO transaction_limits (account_type, channel, currency, per_transaction, daily_amount, monthly_amount, daily_count, monthly_count)
+			SELECT account_type, 'api', currency, per_transaction, daily_amount, monthly_amount, daily_count, monthly_count
+			FROM transaction_limits WHERE channel='web'`)
+		return err
+	},
+	// 14: overdue installments record when loan.overdue was raised for them
+	func(tx *sql.Tx) error {
+		return addColumn(tx, "loan_installments", "overdue_at", "DATETIME")
+	},
+	// 15: customers can give an email address and phone number for notifications
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "users", "email", "TEXT"); err != nil {
+			return err
+		}
+		return addColumn(tx, "users", "phone", "TEXT")
+	},
+	// 16: installments record when the borrower was reminded they are due
+	func(tx *sql.Tx) error {
+		return addColumn(tx, "loan_installments", "reminded_at", "DATETIME")
+	},
+	// 17: idempotency keys remember a hash of the request they were used
+	// for, so reusing one for a different request can be refused
+	func(tx *sql.Tx) error {
+		return addColumn(tx, "idempotency_keys", "request_hash", "TEXT")
+	},
+	// 18: interest accrual catches up on days the scheduler missed, starting
+	// after the last day each account has accrued
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO accrual_positions (account_number, kind, last_accrued_on)
+			SELECT account_number, kind, MAX(accrual_date) FROM interest_accruals
+			GROUP BY account_number, kind`)
+		return err
+	},
+	// 19: term deposits accrue their interest daily until they are paid out
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "term_deposits", "accrued_interest", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return addColumn(tx, "term_deposits", "accrued_on", "DATE")
+	},
+	// 20: standing orders get the same limits as the web
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO transaction_limits (account_type, channel, currency, per_transaction, daily_amount, monthly_amount, daily_count, monthly_count)
+			SELECT account_type, 'standing_order', currency, per_transaction, daily_amount, monthly_amount, daily_count, monthly_count
+			FROM transaction_limits WHERE channel='web'`)
+		return err
+	},
+	// 21: limits for every currency and account type on every channel,
+	// since a debit with no limit set is now refused. Amounts are the KES
+	// limits converted at rough rates and rounded, in minor units; loan
+	// accounts get the savings limits.
+	func(tx *sql.Tx) error {
+		type amounts struct{ perTransaction, daily, monthly int64 }
+		seeds := []struct {
+			currency         string
+			current, savings amounts
+		}{
+			{"KES", amounts{15000000, 30000000, 300000000}, amounts{5000000, 10000000, 50000000}},
+			{"USD", amounts{100000, 200000, 2000000}, amounts{40000, 80000, 400000}},
+			{"EUR", amounts{100000, 200000, 2000000}, amounts{40000, 80000, 400000}},
+			{"GBP", amounts{80000, 160000, 1600000}, amounts{30000, 60000, 300000}},
+			{"TZS", amounts{300000000, 600000000, 6000000000}, amounts{100000000, 200000000, 1000000000}},
+			{"UGX", amounts{4000000, 8000000, 80000000}, amounts{1400000, 2800000, 14000000}},
+		}
+		for _, seed := range seeds {
+			for _, channel := range []string{"web", "api", "standing_order"} {
+				for _, l := range []struct {
+					accountType string
+					amounts
+					dailyCount, monthlyCount int
+				}{
+					{"current", seed.current, 20, 300},
+					{"savings", seed.savings, 3, 10},
+					{"loan", seed.savings, 3, 10},
+				} {
+					_, err := tx.Exec(`
+						INSERT OR IGNORE INTO transaction_limits (account_type, channel, currency, per_transaction, daily_amount, monthly_amount, daily_count, monthly_count)
+						VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+						l.accountType, channel, seed.currency, l.perTransaction, l.daily, l.monthly, l.dailyCount, l.monthlyCount)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	},
+	// 22: outbox subscribers count their failures on an event so one that
+	// keeps failing can be parked
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "outbox_positions", "failures", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return addColumn(tx, "outbox_positions", "last_error", "TEXT")
+	},
+}
+
+// Migrate brings the database schema up to date
+func Migrate() {
+	var version int
+	if err := DB.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		log.Fatal("Error reading schema version:", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := DB.Begin()
+		if err != nil {
+			log.Fatal("Error starting migration:", err)
+		}
+		if err := migrations[i](tx); err != nil {
+			tx.Rollback()
+			log.Fatalf("Error applying migration %d: %v", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			log.Fatalf("Error recording migration %d: %v", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			log.Fatalf("Error committing migration %d: %v", i+1, err)
+		}
+	}
+}
+
+// addColumn adds a column unless the table already has it
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
@@ -44,6 +44,395 @@ func CreateTables() {
 		FOREIGN KEY(user_id) REFERENCES users(user_id)
 	);`
 
+	accountsTable := `CREATE TABLE IF NOT EXISTS accounts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_number TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'active',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(user_id)
+	);`
+
+	balancesTable := `CREATE TABLE IF NOT EXISTS balances (
+		account_number TEXT PRIMARY KEY,
+		balance INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME,
+		FOREIGN KEY(account_number) REFERENCES accounts(account_number)
+	);`
+
+	idempotencyKeysTable := `CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id TEXT NOT NULL,
+		path TEXT NOT NULL,
+		idempotency_key TEXT NOT NULL,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		location TEXT,
+		content_type TEXT,
+		body BLOB,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY(user_id, path, idempotency_key),
+		FOREIGN KEY(user_id) REFERENCES users(user_id)
+	);`
+
+	fxRatesTable := `CREATE TABLE IF NOT EXISTS fx_rates (
+		base_currency TEXT NOT NULL,
+		quote_currency TEXT NOT NULL,
+		rate INTEGER NOT NULL,
+		source TEXT NOT NULL,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY(base_currency, quote_currency)
+	);`
+
+	interestAccrualsTable := `CREATE TABLE IF NOT EXISTS interest_accruals (
+		account_number TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		accrual_date DATE NOT NULL,
+		balance INTEGER NOT NULL,
+		rate_bps INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		posted_at DATETIME,
+		PRIMARY KEY(account_number, kind, accrual_date),
+		FOREIGN KEY(account_number) REFERENCES accounts(account_number)
+	);`
+
+	accrualPositionsTable := `CREATE TABLE IF NOT EXISTS accrual_positions (
+		account_number TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		last_accrued_on DATE NOT NULL,
+		PRIMARY KEY(account_number, kind),
+		FOREIGN KEY(account_number) REFERENCES accounts(account_number)
+	);`
+
+	savingsProductsTable := `CREATE TABLE IF NOT EXISTS savings_products (
+		code TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		currency TEXT NOT NULL,
+		is_default INTEGER NOT NULL DEFAULT 0
+	);`
+
+	savingsProductTiersTable := `CREATE TABLE IF NOT EXISTS savings_product_tiers (
+		product_code TEXT NOT NULL,
+		min_balance INTEGER NOT NULL,
+		rate_bps INTEGER NOT NULL,
+		PRIMARY KEY(product_code, min_balance),
+		FOREIGN KEY(product_code) REFERENCES savings_products(code)
+	);`
+
+	termDepositsTable := `CREATE TABLE IF NOT EXISTS term_deposits (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		deposit_id TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		source_account TEXT NOT NULL,
+		principal INTEGER NOT NULL,
+		currency TEXT NOT NULL,
+		rate_bps INTEGER NOT NULL,
+		term_days INTEGER NOT NULL,
+		status TEXT NOT NULL DEFAULT 'active',
+		opened_at DATETIME NOT NULL,
+		matures_on DATE NOT NULL,
+		closed_at DATETIME,
+		interest_paid INTEGER,
+		FOREIGN KEY(user_id) REFERENCES users(user_id),
+		FOREIGN KEY(source_account) REFERENCES accounts(account_number)
+	);`
+
+	standingOrdersTable := `CREATE TABLE IF NOT EXISTS standing_orders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		order_id TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		from_account TEXT NOT NULL,
+		to_account TEXT,
+		loan_id TEXT,
+		amount INTEGER NOT NULL,
+		currency TEXT NOT NULL,
+		frequency TEXT NOT NULL,
+		start_date DATE NOT NULL,
+		end_date DATE,
+		next_run DATE NOT NULL,
+		runs INTEGER NOT NULL DEFAULT 0,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL DEFAULT 'active',
+		last_run_at DATETIME,
+		last_reference TEXT,
+		last_error TEXT,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(user_id),
+		FOREIGN KEY(from_account) REFERENCES accounts(account_number)
+	);`
+
+	loanInstallmentsTable := `CREATE TABLE IF NOT EXISTS loan_installments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		loan_id TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		due_date DATE NOT NULL,
+		amount_due INTEGER NOT NULL,
+		amount_paid INTEGER NOT NULL DEFAULT 0,
+		paid_at DATETIME,
+		UNIQUE(loan_id, seq),
+		FOREIGN KEY(loan_id) REFERENCES loans(loan_id)
+	);`
+
+	transactionLimitsTable := `CREATE TABLE IF NOT EXISTS transaction_limits (
+		account_type TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		currency TEXT NOT NULL,
+		per_transaction INTEGER NOT NULL DEFAULT 0,
+		daily_amount INTEGER NOT NULL DEFAULT 0,
+		monthly_amount INTEGER NOT NULL DEFAULT 0,
+		daily_count INTEGER NOT NULL DEFAULT 0,
+		monthly_count INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (account_type, channel, currency)
+	);`
+
+	loginsTable := `CREATE TABLE IF NOT EXISTS logins (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		ip TEXT,
+		success INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(user_id)
+	);`
+
+	fraudRulesTable := `CREATE TABLE IF NOT EXISTS fraud_rules (
+		code TEXT PRIMARY KEY,
+		description TEXT NOT NULL,
+		action TEXT NOT NULL DEFAULT 'hold'
+	);`
+
+	fraudCasesTable := `CREATE TABLE IF NOT EXISTS fraud_cases (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		case_id TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		decision TEXT NOT NULL,
+		rules TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		from_account TEXT NOT NULL,
+		to_account TEXT,
+		amount INTEGER NOT NULL,
+		currency TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		status TEXT NOT NULL,
+		reference TEXT,
+		reviewed_by TEXT,
+		reviewed_at DATETIME,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(user_id)
+	);`
+
+	holdsTable := `CREATE TABLE IF NOT EXISTS holds (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hold_id TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		account_number TEXT NOT NULL,
+		amount INTEGER NOT NULL,
+		captured INTEGER NOT NULL DEFAULT 0,
+		currency TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		reference TEXT,
+		status TEXT NOT NULL DEFAULT 'active',
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME NOT NULL,
+		closed_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(user_id),
+		FOREIGN KEY(account_number) REFERENCES accounts(account_number)
+	);`
+
+	accountStatusChangesTable := `CREATE TABLE IF NOT EXISTS account_status_changes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_number TEXT NOT NULL,
+		from_status TEXT NOT NULL,
+		to_status TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		changed_by TEXT,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(account_number) REFERENCES accounts(account_number)
+	);`
+
+	apiTokensTable := `CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_id TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		name TEXT NOT NULL,
+		client_id TEXT UNIQUE,
+		token_hash TEXT NOT NULL UNIQUE,
+		prefix TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		revoked_at DATETIME,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(user_id)
+	);`
+
+	oauthClientsTable := `CREATE TABLE IF NOT EXISTS oauth_clients (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		client_id TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		secret_hash TEXT,
+		redirect_uris TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		disabled_at DATETIME,
+		FOREIGN KEY(created_by) REFERENCES users(user_id)
+	);`
+
+	oauthGrantsTable := `CREATE TABLE IF NOT EXISTS oauth_grants (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		grant_id TEXT NOT NULL UNIQUE,
+		client_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		revoked_at DATETIME,
+		FOREIGN KEY(client_id) REFERENCES oauth_clients(client_id),
+		FOREIGN KEY(user_id) REFERENCES users(user_id)
+	);`
+
+	oauthCodesTable := `CREATE TABLE IF NOT EXISTS oauth_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		code_hash TEXT NOT NULL UNIQUE,
+		grant_id TEXT NOT NULL,
+		redirect_uri TEXT NOT NULL,
+		code_challenge TEXT NOT NULL,
+		nonce TEXT,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		FOREIGN KEY(grant_id) REFERENCES oauth_grants(grant_id)
+	);`
+
+	oauthRefreshTokensTable := `CREATE TABLE IF NOT EXISTS oauth_refresh_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		grant_id TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		revoked_at DATETIME,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(grant_id) REFERENCES oauth_grants(grant_id)
+	);`
+
+	oauthKeysTable := `CREATE TABLE IF NOT EXISTS oauth_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kid TEXT NOT NULL UNIQUE,
+		private_key TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`
+
+	webhookSubscriptionsTable := `CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		subscription_id TEXT NOT NULL UNIQUE,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		disabled_at DATETIME,
+		FOREIGN KEY(created_by) REFERENCES users(user_id)
+	);`
+
+	webhookDeliveriesTable := `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		delivery_id TEXT NOT NULL UNIQUE,
+		subscription_id TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		event_type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME NOT NULL,
+		last_status_code INTEGER,
+		last_error TEXT,
+		created_at DATETIME NOT NULL,
+		delivered_at DATETIME,
+		FOREIGN KEY(subscription_id) REFERENCES webhook_subscriptions(subscription_id)
+	);`
+
+	webhookDeadLettersTable := `CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		delivery_id TEXT NOT NULL UNIQUE,
+		subscription_id TEXT NOT NULL,
+		event_type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		last_error TEXT NOT NULL,
+		failed_at DATETIME NOT NULL,
+		redelivered_at DATETIME,
+		FOREIGN KEY(delivery_id) REFERENCES webhook_deliveries(delivery_id)
+	);`
+
+	outboxEventsTable := `CREATE TABLE IF NOT EXISTS outbox_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id TEXT NOT NULL UNIQUE,
+		type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`
+
+	outboxPositionsTable := `CREATE TABLE IF NOT EXISTS outbox_positions (
+		subscriber TEXT PRIMARY KEY,
+		last_seq INTEGER NOT NULL,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		updated_at DATETIME NOT NULL
+	);`
+
+	outboxDeadLettersTable := `CREATE TABLE IF NOT EXISTS outbox_dead_letters (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		subscriber TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		attempts INTEGER NOT NULL,
+		last_error TEXT NOT NULL,
+		failed_at DATETIME NOT NULL,
+		retried_at DATETIME,
+		UNIQUE(subscriber, seq),
+		FOREIGN KEY(seq) REFERENCES outbox_events(id)
+	);`
+
+	notificationPreferencesTable := `CREATE TABLE IF NOT EXISTS notification_preferences (
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL,
+		PRIMARY KEY (user_id, kind, channel),
+		FOREIGN KEY(user_id) REFERENCES users(user_id)
+	);`
+
+	outboundMessagesTable := `CREATE TABLE IF NOT EXISTS outbound_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id TEXT NOT NULL UNIQUE,
+		event_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		subject TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME NOT NULL,
+		last_error TEXT,
+		created_at DATETIME NOT NULL,
+		sent_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(user_id)
+	);`
+
+	notificationsTable := `CREATE TABLE IF NOT EXISTS notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		notification_id TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL,
+		link TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		read_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(user_id)
+	);`
+
 	_, err := DB.Exec(usersTable)
 	if err != nil {
 		log.Fatal("Error creating users table:", err)
@@ -64,5 +453,165 @@ func CreateTables() {
 		log.Fatal("Error creating loans table:", err)
 	}
 
+	_, err = DB.Exec(accountsTable)
+	if err != nil {
+		log.Fatal("Error creating accounts table:", err)
+	}
+
+	_, err = DB.Exec(balancesTable)
+	if err != nil {
+		log.Fatal("Error creating balances table:", err)
+	}
+
+	_, err = DB.Exec(idempotencyKeysTable)
+	if err != nil {
+		log.Fatal("Error creating idempotency_keys table:", err)
+	}
+
+	_, err = DB.Exec(fxRatesTable)
+	if err != nil {
+		log.Fatal("Error creating fx_rates table:", err)
+	}
+
+	_, err = DB.Exec(interestAccrualsTable)
+	if err != nil {
+		log.Fatal("Error creating interest_accruals table:", err)
+	}
+
+	_, err = DB.Exec(accrualPositionsTable)
+	if err != nil {
+		log.Fatal("Error creating accrual_positions table:", err)
+	}
+
+	_, err = DB.Exec(savingsProductsTable)
+	if err != nil {
+		log.Fatal("Error creating savings_products table:", err)
+	}
+
+	_, err = DB.Exec(savingsProductTiersTable)
+	if err != nil {
+		log.Fatal("Error creating savings_product_tiers table:", err)
+	}
+
+	_, err = DB.Exec(termDepositsTable)
+	if err != nil {
+		log.Fatal("Error creating term_deposits table:", err)
+	}
+
+	_, err = DB.Exec(standingOrdersTable)
+	if err != nil {
+		log.Fatal("Error creating standing_orders table:", err)
+	}
+
+	_, err = DB.Exec(loanInstallmentsTable)
+	if err != nil {
+		log.Fatal("Error creating loan_installments table:", err)
+	}
+
+	_, err = DB.Exec(transactionLimitsTable)
+	if err != nil {
+		log.Fatal("Error creating transaction_limits table:", err)
+	}
+
+	_, err = DB.Exec(loginsTable)
+	if err != nil {
+		log.Fatal("Error creating logins table:", err)
+	}
+
+	_, err = DB.Exec(fraudRulesTable)
+	if err != nil {
+		log.Fatal("Error creating fraud_rules table:", err)
+	}
+
+	_, err = DB.Exec(fraudCasesTable)
+	if err != nil {
+		log.Fatal("Error creating fraud_cases table:", err)
+	}
+
+	_, err = DB.Exec(holdsTable)
+	if err != nil {
+		log.Fatal("Error creating holds table:", err)
+	}
+
+	_, err = DB.Exec(accountStatusChangesTable)
+	if err != nil {
+		log.Fatal("Error creating account_status_changes table:", err)
+	}
+
+	_, err = DB.Exec(apiTokensTable)
+	if err != nil {
+		log.Fatal("Error creating api_tokens table:", err)
+	}
+
+	_, err = DB.Exec(oauthClientsTable)
+	if err != nil {
+		log.Fatal("Error creating oauth_clients table:", err)
+	}
+
+	_, err = DB.Exec(oauthGrantsTable)
+	if err != nil {
+		log.Fatal("Error creating oauth_grants table:", err)
+	}
+
+	_, err = DB.Exec(oauthCodesTable)
+	if err != nil {
+		log.Fatal("Error creating oauth_codes table:", err)
+	}
+
+	_, err = DB.Exec(oauthRefreshTokensTable)
+	if err != nil {
+		log.Fatal("Error creating oauth_refresh_tokens table:", err)
+	}
+
+	_, err = DB.Exec(oauthKeysTable)
+	if err != nil {
+		log.Fatal("Error creating oauth_keys table:", err)
+	}
+
+	_, err = DB.Exec(webhookSubscriptionsTable)
+	if err != nil {
+		log.Fatal("Error creating webhook_subscriptions table:", err)
+	}
+
+	_, err = DB.Exec(webhookDeliveriesTable)
+	if err != nil {
+		log.Fatal("Error creating webhook_deliveries table:", err)
+	}
+
+	_, err = DB.Exec(webhookDeadLettersTable)
+	if err != nil {
+		log.Fatal("Error creating webhook_dead_letters table:", err)
+	}
+
+	_, err = DB.Exec(outboxEventsTable)
+	if err != nil {
+		log.Fatal("Error creating outbox_events table:", err)
+	}
+
+	_, err = DB.Exec(outboxPositionsTable)
+	if err != nil {
+		log.Fatal("Error creating outbox_positions table:", err)
+	}
+
+	_, err = DB.Exec(outboxDeadLettersTable)
+	if err != nil {
+		log.Fatal("Error creating outbox_dead_letters table:", err)
+	}
+
+	_, err = DB.Exec(notificationPreferencesTable)
+	if err != nil {
+		log.Fatal("Error creating notification_preferences table:", err)
+	}
+
+	_, err = DB.Exec(outboundMessagesTable)
+	if err != nil {
+		log.Fatal("Error creating outbound_messages table:", err)
+	}
+
+	_, err = DB.Exec(notificationsTable)
+	if err != nil {
+		log.Fatal("Error creating notifications table:", err)
+	}
+
 	fmt.Println("Tables created successfully.")
 }
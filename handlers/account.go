@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Account types a customer may open. Loan accounts are not among them:
+// loans are paid into one of the customer's current or savings accounts.
+var accountTypes = map[string]bool{
+	"savings": true,
+	"current": true,
+}
+
+// Account struct in JSON format
+type Account struct {
+	Number   string      `json:"account_number"`
+	UserID   string      `json:"-"`
+	Type     string      `json:"type"`
+	Status   string      `json:"status"`
+	Currency string      `json:"currency"`
+	Balance  money.Money `json:"balance"`
+
+	// Why the account was last frozen, made dormant or closed
+	StatusReason string `json:"status_reason,omitempty"`
+
+	OverdraftLimit   money.Money `json:"overdraft_limit"`
+	OverdraftRateBps int64       `json:"overdraft_rate_bps"`
+
+	// Funds reserved by active holds
+	Held money.Money `json:"held"`
+}
+
+// Available is what the customer can still spend: the ledger balance plus
+// any unused overdraft, less funds reserved by holds
+func (a Account) Available() money.Money {
+	return a.Balance.Add(a.OverdraftLimit).Sub(a.Held)
+}
+
+// Columns read by scanAccount, qualified with the accounts table alias a
+const accountColumns = "a.account_number, a.user_id, a.type, a.status, a.currency, COALESCE(b.balance, 0), a.overdraft_limit, a.overdraft_rate_bps, " + heldColumn + ", COALESCE(a.status_reason, '')"
+
+// Accounts joined with their materialized balances, for use with accountColumns
+const accountsWithBalances = "accounts a LEFT JOIN balances b ON b.account_number = a.account_number"
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Read an account selected with accountColumns
+func scanAccount(row scanner) (Account, error) {
+	var account Account
+	var balance, overdraftLimit, held int64
+	err := row.Scan(&account.Number, &account.UserID, &account.Type, &account.Status, &account.Currency, &balance, &overdraftLimit, &account.OverdraftRateBps, &held, &account.StatusReason)
+	account.Balance = money.New(balance, account.Currency)
+	account.OverdraftLimit = money.New(overdraftLimit, account.Currency)
+	account.Held = money.New(held, account.Currency)
+	return account, err
+}
+
+// Open a new account of the given type and currency for a user
+func openAccount(userID, accountType, currency string) (string, error) {
+	for attempt := 0; attempt < accountNumberAttempts; attempt++ {
+		accountNumber, err := newAccountNumber(accountType)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = config.DB.Exec("INSERT INTO accounts (account_number, user_id, type, status, currency) VALUES (?, ?, ?, 'active', ?)", accountNumber, userID, accountType, currency)
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			continue // serial already taken, draw another
+		}
+		if err != nil {
+			return "", err
+		}
+		return accountNumber, nil
+	}
+	return "", fmt.Errorf("no free %s account number after %d attempts", accountType, accountNumberAttempts)
+}
+
+// Fetch all accounts owned by a user, with balances
+func getUserAccounts(userID string) ([]Account, error) {
+	rows, err := config.DB.Query("SELECT "+accountColumns+" FROM "+accountsWithBalances+" WHERE a.user_id=? ORDER BY a.id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// Fetch an account, making sure it belongs to the given user
+func getUserAccount(userID, accountNumber string) (Account, error) {
+	return scanAccount(config.DB.QueryRow("SELECT "+accountColumns+" FROM "+accountsWithBalances+" WHERE a.account_number=? AND a.user_id=?", accountNumber, userID))
+}
+
+// Fetch any account by number using the given connection or transaction
+func getAccount(q querier, accountNumber string) (Account, error) {
+	return scanAccount(q.QueryRow("SELECT "+accountColumns+" FROM "+accountsWithBalances+" WHERE a.account_number=?", accountNumber))
+}
+
+// Make sure a user has at least one account. Users registered before
+// accounts existed get a current account holding their earlier transactions.
+func ensureDefaultAccount(userID string) error {
+	var count int
+	err := config.DB.QueryRow("SELECT COUNT(*) FROM accounts WHERE user_id=?", userID).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	accountNumber, err := openAccount(userID, "current", money.DefaultCurrency)
+	if err != nil {
+		return err
+	}
+
+	return withTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE transactions SET account_number=? WHERE user_id=? AND account_number IS NULL", accountNumber, userID)
+		if err != nil {
+			return err
+		}
+		return recomputeBalance(tx, accountNumber)
+	})
+}
+
+// Resolve the account a request operates on
+func accountFromRequest(r *http.Request, userID string) (Account, error) {
+	accountNumber := r.FormValue("account_number")
+	if accountNumber == "" {
+		return Account{}, sql.ErrNoRows
+	}
+	return getUserAccount(userID, accountNumber)
+}
+
+// OpenAccount opens another account for the logged in user
+func OpenAccount(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	accountType := r.FormValue("type")
+	if !accountTypes[accountType] {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid account type")
+		return
+	}
+
+	currency := r.FormValue("currency")
+	if currency == "" {
+		currency = money.DefaultCurrency
+	}
+	if !money.ValidCurrency(currency) {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Unsupported currency")
+		return
+	}
+
+	if _, err := openAccount(userID, accountType, currency); err != nil {
+		ErrorPageTrans(w, r, http.StatusInternalServerError, "Failed to open account")
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
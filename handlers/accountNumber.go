@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+)
+
+// Account numbers are branch code + product code + 6 digit serial + a Luhn
+// check digit, e.g. 001 10 482913 7 for a current account at branch 001.
+const accountNumberLength = 12
+
+// Accounts opened before numbers carried a check digit have 10 random
+// digits. They are still valid destinations and are matched exactly.
+const legacyAccountNumberLength = 10
+
+// How many serials openAccount draws before giving up on a branch and
+// product whose serials are nearly all taken
+const accountNumberAttempts = 10
+
+// Compute the Luhn check digit for a string of digits
+func luhnCheckDigit(digits string) byte {
+	sum := 0
+	double := true
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// Report whether s consists only of digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Check the length and check digit of an account number
+func validAccountNumber(number string) bool {
+	if len(number) != accountNumberLength || !isDigits(number) {
+		return false
+	}
+	last := len(number) - 1
+	return luhnCheckDigit(number[:last]) == number[last]
+}
+
+// Report whether number could be an account number: either the current
+// format with a correct check digit or a legacy 10 digit number
+func plausibleAccountNumber(number string) bool {
+	return validAccountNumber(number) || (len(number) == legacyAccountNumberLength && isDigits(number))
+}
+
+// Generate a new account number for the given account type
+func newAccountNumber(accountType string) (string, error) {
+	product, ok := config.ProductCodes[accountType]
+	if !ok {
+		return "", fmt.Errorf("no product code for account type %q", accountType)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1e6))
+	if err != nil {
+		return "", err
+	}
+
+	body := fmt.Sprintf("%s%s%06d", config.BranchCode, product, serial.Int64())
+	if len(body) != accountNumberLength-1 || !isDigits(body) {
+		return "", fmt.Errorf("branch code %q and product code %q must be 3 and 2 digits", config.BranchCode, product)
+	}
+	return body + string(luhnCheckDigit(body)), nil
+}
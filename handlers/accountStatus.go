@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Account statuses. Frozen accounts can still receive money but nothing can
+// leave them, dormant ones are reactivated by the customer's next deposit
+// and closed ones take no postings at all.
+var accountStatuses = map[string]bool{
+	"active":  true,
+	"frozen":  true,
+	"dormant": true,
+	"closed":  true,
+}
+
+// Transaction types that show a customer is still using an account
+var activityTypes = []string{"deposit", "withdraw", "transfer_out"}
+
+// Make sure money may leave an account
+func checkDebit(account Account) error {
+	switch account.Status {
+	case "active":
+		return nil
+	case "frozen":
+		return &bankError{http.StatusForbidden, "Account is frozen"}
+	case "dormant":
+		return &bankError{http.StatusForbidden, "Account is dormant; make a deposit to reactivate it"}
+	case "closed":
+		return &bankError{http.StatusBadRequest, "Account is closed"}
+	}
+	return &bankError{http.StatusBadRequest, "Account is not active"}
+}
+
+// Make sure money may arrive in an account
+func checkCredit(account Account) error {
+	if account.Status == "closed" {
+		return &bankError{http.StatusBadRequest, "Account is closed"}
+	}
+	return nil
+}
+
+// Move an account to a new status, recording who did it and why. changedBy
+// is empty for changes made by background jobs.
+func setAccountStatus(tx *sql.Tx, account Account, status, reason, changedBy string) error {
+	now := time.Now().UTC().Format(dbTime)
+	_, err := tx.Exec("UPDATE accounts SET status=?, status_reason=?, status_changed_at=? WHERE account_number=?",
+		status, reason, now, account.Number)
+	if err != nil {
+		return err
+	}
+
+	var by interface{}
+	if changedBy != "" {
+		by = changedBy
+	}
+	_, err = tx.Exec("INSERT INTO account_status_changes (account_number, from_status, to_status, reason, changed_by, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		account.Number, account.Status, status, reason, by, now)
+	if err != nil {
+		return err
+	}
+	return publishEvent(tx, "account.status_changed", map[string]interface{}{
+		"account_number": account.Number,
+		"from_status":    account.Status,
+		"to_status":      status,
+		"reason":         reason,
+		"changed_at":     now,
+	})
+}
+
+// markDormantAccounts makes dormant every active current or savings
+// account the customer has not paid into or out of for
+// config.DormancyMonths
+func markDormantAccounts(tx *sql.Tx, now time.Time) (string, error) {
+	cutoff := addMonths(startOfDay(now), -int(config.DormancyMonths)).Format(dbTime)
+	rows, err := tx.Query(`
+		SELECT `+accountColumns+` FROM `+accountsWithBalances+`
+		WHERE a.status='active' AND a.type IN ('current', 'savings') AND a.created_at < ?
+		AND NOT EXISTS (
+			SELECT 1 FROM transactions t
+			WHERE t.account_number = a.account_number AND t.created_at >= ?
+			AND t.type IN ('`+strings.Join(activityTypes, "', '")+`'))`, cutoff, cutoff)
+	if err != nil {
+		return "", err
+	}
+
+	var accounts []Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			rows.Close()
+			return "", err
+		}
+		accounts = append(accounts, account)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	reason := fmt.Sprintf("No activity for %d months", config.DormancyMonths)
+	for _, account := range accounts {
+		if err := setAccountStatus(tx, account, "dormant", reason, ""); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("marked %d account(s) dormant", len(accounts)), nil
+}
+
+// Close one of a customer's accounts. The account must be empty, with no
+// funds held, its owner must have no active loans, no standing order may
+// be repaying a loan from it and no running term deposit may pay out to
+// it; other standing orders from or to it are cancelled.
+func closeAccount(tx *sql.Tx, account Account) error {
+	switch account.Status {
+	case "closed":
+		return &bankError{http.StatusBadRequest, "Account is already closed"}
+	case "frozen":
+		return &bankError{http.StatusForbidden, "A frozen account cannot be closed"}
+	}
+	if account.Balance.Amount != 0 {
+		return &bankError{http.StatusBadRequest, "Account balance must be zero before it can be closed"}
+	}
+	if account.Held.Amount != 0 {
+		return &bankError{http.StatusBadRequest, "Account has funds on hold"}
+	}
+
+	var loans, repayments, deposits int
+	err := tx.QueryRow("SELECT COUNT(*) FROM loans WHERE status='active' AND user_id=?", account.UserID).Scan(&loans)
+	if err != nil {
+		return err
+	}
+	if loans > 0 {
+		return &bankError{http.StatusBadRequest, "Accounts cannot be closed while you have an active loan"}
+	}
+	err = tx.QueryRow("SELECT COUNT(*) FROM standing_orders WHERE kind='loan_repayment' AND status IN ('active', 'paused') AND from_account=?", account.Number).Scan(&repayments)
+	if err != nil {
+		return err
+	}
+	if repayments > 0 {
+		return &bankError{http.StatusBadRequest, "Account repays a loan through a standing order"}
+	}
+	err = tx.QueryRow("SELECT COUNT(*) FROM term_deposits WHERE status='active' AND source_account=?", account.Number).Scan(&deposits)
+	if err != nil {
+		return err
+	}
+	if deposits > 0 {
+		return &bankError{http.StatusBadRequest, "Account has a term deposit that has not matured"}
+	}
+
+	_, err = tx.Exec("UPDATE standing_orders SET status='cancelled' WHERE status IN ('active', 'paused') AND (from_account=? OR to_account=?)",
+		account.Number, account.Number)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE accounts SET overdraft_limit=0 WHERE account_number=?", account.Number)
+	if err != nil {
+		return err
+	}
+	return setAccountStatus(tx, account, "closed", "Closed by customer", account.UserID)
+}
+
+// Close one of a user's accounts by number
+func closeUserAccount(userID, accountNumber string) error {
+	return withTx(func(tx *sql.Tx) error {
+		account, err := scanAccount(tx.QueryRow("SELECT "+accountColumns+" FROM "+accountsWithBalances+" WHERE a.account_number=? AND a.user_id=?",
+			accountNumber, userID))
+		if err == sql.ErrNoRows {
+			return &bankError{http.StatusNotFound, "Account not found"}
+		} else if err != nil {
+			return err
+		}
+		return closeAccount(tx, account)
+	})
+}
+
+// CloseAccount closes one of the logged in user's accounts
+func CloseAccount(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	if err := closeUserAccount(userID, mux.Vars(r)["number"]); err != nil {
+		transactionError(w, r, err, "Failed to close account")
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// AccountStatusChange is an entry in an account's status history
+type AccountStatusChange struct {
+	AccountNumber string
+	FromStatus    string
+	ToStatus      string
+	Reason        string
+	ChangedBy     string
+	CreatedAt     string
+}
+
+// AdminAccounts lists accounts, optionally only those with one status, with
+// forms to freeze and unfreeze them and the latest status changes
+func AdminAccounts(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	query := "SELECT " + accountColumns + " FROM " + accountsWithBalances
+	var args []interface{}
+	if accountStatuses[status] {
+		query += " WHERE a.status=?"
+		args = append(args, status)
+	}
+	rows, err := config.DB.Query(query+" ORDER BY a.id DESC LIMIT 200", args...)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		accounts = append(accounts, account)
+	}
+
+	changeRows, err := config.DB.Query(`
+		SELECT c.account_number, c.from_status, c.to_status, c.reason, COALESCE(u.user_name, ''), c.created_at
+		FROM account_status_changes c LEFT JOIN users u ON u.user_id = c.changed_by
+		ORDER BY c.id DESC LIMIT 50`)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer changeRows.Close()
+
+	var changes []AccountStatusChange
+	for changeRows.Next() {
+		var c AccountStatusChange
+		if err := changeRows.Scan(&c.AccountNumber, &c.FromStatus, &c.ToStatus, &c.Reason, &c.ChangedBy, &c.CreatedAt); err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		changes = append(changes, c)
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/admin_accounts.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Accounts": accounts,
+		"Changes":  changes,
+		"Status":   status,
+		"Statuses": sortedKeys(accountStatuses),
+	})
+}
+
+// FreezeAccount stops money leaving an account until it is unfrozen
+func FreezeAccount(w http.ResponseWriter, r *http.Request) {
+	adminSetAccountStatus(w, r, "frozen", "active", "dormant")
+}
+
+// UnfreezeAccount returns a frozen or dormant account to active
+func UnfreezeAccount(w http.ResponseWriter, r *http.Request) {
+	adminSetAccountStatus(w, r, "active", "frozen", "dormant")
+}
+
+// Move the account in the request to status if it currently has one of the
+// from statuses. A reason is required.
+func adminSetAccountStatus(w http.ResponseWriter, r *http.Request, status string, from ...string) {
+	adminID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		ErrorPage(w, r, http.StatusBadRequest, "A reason is required")
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		account, err := getAccount(tx, mux.Vars(r)["number"])
+		if err == sql.ErrNoRows {
+			return &bankError{http.StatusNotFound, "Account not found"}
+		} else if err != nil {
+			return err
+		}
+		for _, s := range from {
+			if account.Status == s {
+				return setAccountStatus(tx, account, status, reason, adminID)
+			}
+		}
+		return &bankError{http.StatusBadRequest, "Account is " + account.Status}
+	})
+	if err != nil {
+		adminError(w, r, err, "Failed to update account")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/accounts", http.StatusSeeOther)
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"errors"
+	"testing"
+)
+
+func TestCloseAccountWithLoans(t *testing.T) {
+	openTestDB(t)
+	current := testAccount(t, "alice", "current", "")
+	savingsNumber, err := openAccount(current.UserID, "savings", money.DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The loan was paid into the current account, not the one being closed
+	_, err = config.DB.Exec(`
+		INSERT INTO loans (user_id, loan_id, amount, currency, interest_rate_bps, repayment_period, status, outstanding, disbursed_to)
+		VALUES (?, 'loan-1', 10000, 'KES', 0, 1, 'active', 10000, ?)`, current.UserID, current.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var be *bankError
+	if err := closeUserAccount(current.UserID, savingsNumber); !errors.As(err, &be) {
+		t.Fatalf("closed an account while its owner has an active loan: %v", err)
+	}
+
+	// Once the loan is repaid, a standing order still set up to repay it
+	// from the account keeps it open
+	if _, err := config.DB.Exec("UPDATE loans SET status='repaid', outstanding=0"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.DB.Exec(`
+		INSERT INTO standing_orders (order_id, user_id, kind, from_account, loan_id, amount, currency, frequency, start_date, next_run, status, created_at)
+		VALUES ('order-1', ?, 'loan_repayment', ?, 'loan-1', 1000, 'KES', 'monthly', '2026-01-01', '2026-01-01', 'paused', '2026-01-01 00:00:00')`,
+		current.UserID, savingsNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closeUserAccount(current.UserID, savingsNumber); !errors.As(err, &be) {
+		t.Fatalf("closed an account a standing order repays a loan from: %v", err)
+	}
+
+	if _, err := config.DB.Exec("UPDATE standing_orders SET status='cancelled'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeUserAccount(current.UserID, savingsNumber); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"net/http"
+)
+
+// Report whether a user has the admin role
+func isAdmin(userID string) bool {
+	var role string
+	err := config.DB.QueryRow("SELECT role FROM users WHERE user_id=?", userID).Scan(&role)
+	return err == nil && role == "admin"
+}
+
+// Resolve the logged in admin, rendering an error page for anyone else
+func requireAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return "", false
+	}
+	if !isAdmin(userID) {
+		ErrorPage(w, r, http.StatusForbidden, "Admin access required")
+		return "", false
+	}
+	return userID, true
+}
+
+// Report err on the general error page, showing fallback instead of the
+// details of anything that is not a bankError
+func adminError(w http.ResponseWriter, r *http.Request, err error, fallback string) {
+	if fe, ok := err.(*fraudError); ok {
+		err = &fe.bankError
+	}
+	if be, ok := err.(*bankError); ok {
+		ErrorPage(w, r, be.Status, be.Message)
+		return
+	}
+	ErrorPage(w, r, http.StatusInternalServerError, fallback)
+}
+
+// PromoteAdmin grants the admin role to a user
+func PromoteAdmin(username string) error {
+	result, err := config.DB.Exec("UPDATE users SET role='admin' WHERE user_name=?", username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return &bankError{http.StatusNotFound, "User not found"}
+	}
+	return nil
+}
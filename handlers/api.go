@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiContextKey keys the values APIAuth stores on a request
+type apiContextKey string
+
+// The user an API request is made on behalf of, and the APIToken it was
+// signed in with unless it used the session cookie
+const (
+	apiUserKey  apiContextKey = "user_id"
+	apiTokenKey apiContextKey = "token"
+)
+
+// Largest request body the API will read
+const maxAPIBody = 1 << 20
+
+// APIError is the body of every failed API response
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Pagination describes which part of a list an API response holds
+type Pagination struct {
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	Total  int `json:"total"`
+}
+
+// Report whether a request is for the JSON API
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// APIAuth lets a request through to the API only when it carries an API
+// token in the Authorization header or comes from a signed in user, and
+// records who that is for the handlers
+func APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if r.Header.Get("Authorization") != "" {
+			userID, token, err := authenticateAPIToken(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				apiError(w, err, "Database error")
+				return
+			}
+			ctx = context.WithValue(context.WithValue(ctx, apiUserKey, userID), apiTokenKey, token)
+		} else {
+			userID, err := getUserIDFromSession(r)
+			if err != nil || userID == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				writeAPIError(w, http.StatusUnauthorized, "Authentication required")
+				return
+			}
+			ctx = context.WithValue(ctx, apiUserKey, userID)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// The user APIAuth found for a request
+func apiUserID(r *http.Request) string {
+	userID, _ := r.Context().Value(apiUserKey).(string)
+	return userID
+}
+
+// APINotFound answers API requests for paths that do not exist
+func APINotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "No such endpoint")
+}
+
+// OpenAPISpec serves the OpenAPI document describing the JSON API. It is
+// public so integrators and tools can read it without signing in.
+func OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, "static/openapi.json")
+}
+
+// Write v as the data of a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": v})
+}
+
+// Write one page of a list as a JSON response
+func writeJSONPage(w http.ResponseWriter, v interface{}, page Pagination) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": v, "pagination": page})
+}
+
+// Write an error envelope. The code is the snake_case status text, such as
+// "not_found".
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	code := strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": APIError{Code: code, Message: message}})
+}
+
+// Report err as an API error, showing fallback instead of the details of
+// anything that is not a bankError. A payment held for fraud review is not
+// an error: it is accepted and made once approved.
+func apiError(w http.ResponseWriter, err error, fallback string) {
+	if fe, ok := err.(*fraudError); ok {
+		if fe.Decision == "hold" {
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "held_for_review", "message": fe.Message})
+			return
+		}
+		err = &fe.bankError
+	}
+	if be, ok := err.(*bankError); ok {
+		writeAPIError(w, be.Status, be.Message)
+		return
+	}
+	writeAPIError(w, http.StatusInternalServerError, fallback)
+}
+
+// Decode a JSON request body into v, rejecting unknown fields
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return &bankError{http.StatusBadRequest, "Invalid request body: " + err.Error()}
+	}
+	return nil
+}
+
+// Read the limit and offset query parameters. Lists default to 50 items
+// and return at most 200.
+func pageFromRequest(r *http.Request) (Pagination, error) {
+	page := Pagination{Limit: 50}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 200 {
+			return page, &bankError{http.StatusBadRequest, "limit must be between 1 and 200"}
+		}
+		page.Limit = n
+	}
+	if value := r.URL.Query().Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return page, &bankError{http.StatusBadRequest, "offset must not be negative"}
+		}
+		page.Offset = n
+	}
+	return page, nil
+}
+
+// Record the length of a list already in memory and return the bounds of
+// the page within it
+func (p *Pagination) slice(total int) (int, int) {
+	p.Total = total
+	start, end := p.Offset, p.Offset+p.Limit
+	if start > total {
+		start = total
+	}
+	if end > total {
+		end = total
+	}
+	return start, end
+}
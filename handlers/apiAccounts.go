@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// apiAccount is an account as the API returns it
+type apiAccount struct {
+	Account
+	Available money.Money `json:"available"`
+}
+
+// Transaction is a ledger entry as the API returns it
+type Transaction struct {
+	ID             int64        `json:"id"`
+	Type           string       `json:"type"`
+	Amount         money.Money  `json:"amount"`
+	OriginalAmount *money.Money `json:"original_amount,omitempty"`
+	FXRate         string       `json:"fx_rate,omitempty"`
+	Reference      string       `json:"reference,omitempty"`
+	Channel        string       `json:"channel,omitempty"`
+	CreatedAt      string       `json:"created_at"`
+}
+
+// Body of a request that moves an amount of money
+type amountRequest struct {
+	Amount json.Number `json:"amount"`
+}
+
+// Parse an amount given in the API in the account's currency
+func parseAPIAmount(value json.Number, currency string) (money.Money, error) {
+	amount, err := money.Parse(value.String(), currency)
+	if err != nil || amount.Amount <= 0 {
+		return amount, &bankError{http.StatusBadRequest, "Invalid amount"}
+	}
+	return amount, nil
+}
+
+// Fetch one of the API caller's accounts by the number in the path
+func apiAccountFromPath(r *http.Request) (Account, error) {
+	account, err := getUserAccount(apiUserID(r), mux.Vars(r)["number"])
+	if err == sql.ErrNoRows {
+		return account, &bankError{http.StatusNotFound, "Account not found"}
+	}
+	return account, err
+}
+
+// Write the current state of an account
+func writeAccount(w http.ResponseWriter, status int, accountNumber, userID string) {
+	account, err := getUserAccount(userID, accountNumber)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	writeJSON(w, status, apiAccount{account, account.Available()})
+}
+
+// APIListAccounts lists the caller's accounts
+func APIListAccounts(w http.ResponseWriter, r *http.Request) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	accounts, err := getUserAccounts(apiUserID(r))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	start, end := page.slice(len(accounts))
+	list := make([]apiAccount, 0, end-start)
+	for _, account := range accounts[start:end] {
+		list = append(list, apiAccount{account, account.Available()})
+	}
+	writeJSONPage(w, list, page)
+}
+
+// APIOpenAccount opens an account of the requested type and currency
+func APIOpenAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type     string `json:"type"`
+		Currency string `json:"currency"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		apiError(w, err, "")
+		return
+	}
+	if !accountTypes[req.Type] {
+		writeAPIError(w, http.StatusBadRequest, "Invalid account type")
+		return
+	}
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+	if !money.ValidCurrency(req.Currency) {
+		writeAPIError(w, http.StatusBadRequest, "Unsupported currency")
+		return
+	}
+
+	userID := apiUserID(r)
+	accountNumber, err := openAccount(userID, req.Type, req.Currency)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to open account")
+		return
+	}
+	writeAccount(w, http.StatusCreated, accountNumber, userID)
+}
+
+// APIGetAccount returns one of the caller's accounts
+func APIGetAccount(w http.ResponseWriter, r *http.Request) {
+	account, err := apiAccountFromPath(r)
+	if err != nil {
+		apiError(w, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, apiAccount{account, account.Available()})
+}
+
+// APICloseAccount closes one of the caller's accounts
+func APICloseAccount(w http.ResponseWriter, r *http.Request) {
+	if err := closeUserAccount(apiUserID(r), mux.Vars(r)["number"]); err != nil {
+		apiError(w, err, "Failed to close account")
+		return
+	}
+	writeAccount(w, http.StatusOK, mux.Vars(r)["number"], apiUserID(r))
+}
+
+// APIListTransactions pages through an account's ledger, newest first
+func APIListTransactions(w http.ResponseWriter, r *http.Request) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	account, err := apiAccountFromPath(r)
+	if err != nil {
+		apiError(w, err, "Database error")
+		return
+	}
+
+	err = config.DB.QueryRow("SELECT COUNT(*) FROM transactions WHERE account_number=?", account.Number).Scan(&page.Total)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT id, type, amount, currency, original_amount, original_currency, fx_rate, COALESCE(reference, ''), COALESCE(channel, ''), COALESCE(created_at, '')
+		FROM transactions WHERE account_number=? ORDER BY id DESC LIMIT ? OFFSET ?`, account.Number, page.Limit, page.Offset)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		var t Transaction
+		var originalAmount, fxRate sql.NullInt64
+		var originalCurrency sql.NullString
+		err := rows.Scan(&t.ID, &t.Type, &t.Amount.Amount, &t.Amount.Currency, &originalAmount, &originalCurrency, &fxRate,
+			&t.Reference, &t.Channel, &t.CreatedAt)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if originalAmount.Valid {
+			original := money.New(originalAmount.Int64, originalCurrency.String)
+			t.OriginalAmount = &original
+		}
+		if fxRate.Valid {
+			t.FXRate = money.FormatExchangeRate(fxRate.Int64)
+		}
+		transactions = append(transactions, t)
+	}
+	writeJSONPage(w, transactions, page)
+}
+
+// APIDeposit pays money into one of the caller's accounts
+func APIDeposit(w http.ResponseWriter, r *http.Request) {
+	var req amountRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	account, err := apiAccountFromPath(r)
+	if err != nil {
+		apiError(w, err, "Database error")
+		return
+	}
+	amount, err := parseAPIAmount(req.Amount, account.Currency)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	if err := depositFunds(account, amount, "api"); err != nil {
+		apiError(w, err, "Failed to deposit")
+		return
+	}
+	writeAccount(w, http.StatusCreated, account.Number, account.UserID)
+}
+
+// APIWithdraw takes money out of one of the caller's accounts
+func APIWithdraw(w http.ResponseWriter, r *http.Request) {
+	var req amountRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	account, err := apiAccountFromPath(r)
+	if err != nil {
+		apiError(w, err, "Database error")
+		return
+	}
+	amount, err := parseAPIAmount(req.Amount, account.Currency)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	if err := withdrawFunds(account, amount, "api"); err != nil {
+		apiError(w, err, "Failed to withdraw")
+		return
+	}
+	writeAccount(w, http.StatusCreated, account.Number, account.UserID)
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"Bank-Management-System/money"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Fetch one of the API caller's loans by the ID in the path
+func apiLoanFromPath(r *http.Request) (Loan, error) {
+	loans, err := getLoans("l.loan_id=? AND l.user_id=?", mux.Vars(r)["id"], apiUserID(r))
+	if err != nil {
+		return Loan{}, err
+	}
+	if len(loans) == 0 {
+		return Loan{}, &bankError{http.StatusNotFound, "Loan not found"}
+	}
+	return loans[0], nil
+}
+
+// APIListLoans lists the caller's loans
+func APIListLoans(w http.ResponseWriter, r *http.Request) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	loans, err := getLoans("l.user_id=?", apiUserID(r))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	start, end := page.slice(len(loans))
+	writeJSONPage(w, append([]Loan{}, loans[start:end]...), page)
+}
+
+// APIApplyLoan applies for a loan. The interest rate is an annual
+// percentage and the repayment period is in months.
+func APIApplyLoan(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Amount          json.Number `json:"amount"`
+		InterestRate    json.Number `json:"interest_rate"`
+		RepaymentPeriod int         `json:"repayment_period"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	amount, err := parseAPIAmount(req.Amount, money.DefaultCurrency)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid loan amount")
+		return
+	}
+	rateBps, err := money.ParseRate(req.InterestRate.String())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid interest rate")
+		return
+	}
+	if req.RepaymentPeriod <= 0 {
+		writeAPIError(w, http.StatusBadRequest, "Invalid repayment period")
+		return
+	}
+
+	loanID, err := applyForLoan(apiUserID(r), amount, rateBps, req.RepaymentPeriod)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to apply for loan")
+		return
+	}
+
+	loans, err := getLoans("l.loan_id=?", loanID)
+	if err != nil || len(loans) == 0 {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/loans/"+loanID)
+	writeJSON(w, http.StatusCreated, loans[0])
+}
+
+// APIGetLoan returns one of the caller's loans
+func APIGetLoan(w http.ResponseWriter, r *http.Request) {
+	loan, err := apiLoanFromPath(r)
+	if err != nil {
+		apiError(w, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, loan)
+}
+
+// APIRepayLoan pays towards one of the caller's loans from one of their
+// accounts. Anything over what is owed is not taken.
+func APIRepayLoan(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FromAccount string      `json:"from_account"`
+		Amount      json.Number `json:"amount"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	account, err := getUserAccount(apiUserID(r), req.FromAccount)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusBadRequest, "Invalid account")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	amount, err := parseAPIAmount(req.Amount, account.Currency)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	var repaid money.Money
+	err = withTx(func(tx *sql.Tx) error {
+		repaid, err = repayLoan(tx, account, mux.Vars(r)["id"], amount, "api")
+		return err
+	})
+	if err = fraudCaseFor(err); err != nil {
+		apiError(w, err, "Failed to process repayment")
+		return
+	}
+
+	loan, err := apiLoanFromPath(r)
+	if err != nil {
+		apiError(w, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"repaid": repaid, "loan": loan})
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// APICreateTransfer moves money from one of the caller's accounts to
+// another account, given by number or by the recipient's username
+func APICreateTransfer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FromAccount string      `json:"from_account"`
+		To          string      `json:"to"`
+		Amount      json.Number `json:"amount"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	userID := apiUserID(r)
+	from, err := getUserAccount(userID, req.FromAccount)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusBadRequest, "Invalid account")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	amount, err := parseAPIAmount(req.Amount, from.Currency)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	to, err := resolveRecipient(req.To)
+	if err != nil {
+		apiError(w, err, "Database error")
+		return
+	}
+
+	reference, err := transferFunds(from, to, amount, "api")
+	if err != nil {
+		apiError(w, err, "Failed to transfer")
+		return
+	}
+
+	transfer, err := getTransfer(userID, reference)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/transfers/"+reference)
+	writeJSON(w, http.StatusCreated, transfer)
+}
+
+// APIGetTransfer returns a transfer the caller sent
+func APIGetTransfer(w http.ResponseWriter, r *http.Request) {
+	transfer, err := getTransfer(apiUserID(r), mux.Vars(r)["reference"])
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "Transfer not found")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, transfer)
+}
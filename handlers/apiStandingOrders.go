@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// apiStandingOrder is a standing order as the API returns it
+type apiStandingOrder struct {
+	ID          string      `json:"order_id"`
+	Kind        string      `json:"kind"`
+	FromAccount string      `json:"from_account"`
+	ToAccount   string      `json:"to_account,omitempty"`
+	LoanID      string      `json:"loan_id,omitempty"`
+	Amount      money.Money `json:"amount"`
+	Frequency   string      `json:"frequency"`
+	StartDate   string      `json:"start_date"`
+	EndDate     string      `json:"end_date,omitempty"`
+	NextRun     string      `json:"next_run"`
+	Runs        int         `json:"runs"`
+	Status      string      `json:"status"`
+	LastRunAt   string      `json:"last_run_at,omitempty"`
+	LastError   string      `json:"last_error,omitempty"`
+}
+
+// Convert a standing order to its API form
+func toAPIStandingOrder(o StandingOrder) apiStandingOrder {
+	v := apiStandingOrder{
+		ID: o.ID, Kind: o.Kind, FromAccount: o.FromAccount, ToAccount: o.ToAccount, LoanID: o.LoanID, Amount: o.Amount,
+		Frequency: o.Frequency, StartDate: o.StartDate.Format(dbDate), NextRun: o.NextRun.Format(dbDate), Runs: o.Runs,
+		Status: o.Status, LastError: o.LastError,
+	}
+	if o.EndDate.Valid {
+		v.EndDate = o.EndDate.Time.Format(dbDate)
+	}
+	if o.LastRunAt.Valid {
+		v.LastRunAt = o.LastRunAt.Time.Format(dbTime)
+	}
+	return v
+}
+
+// Schedule fields shared by the create and update requests
+type scheduleRequest struct {
+	Amount    json.Number `json:"amount"`
+	Frequency string      `json:"frequency"`
+	StartDate string      `json:"start_date"`
+	EndDate   string      `json:"end_date"`
+}
+
+// Write the current state of a standing order
+func writeStandingOrder(w http.ResponseWriter, status int, userID, orderID string) {
+	o, err := getStandingOrder(userID, orderID)
+	if err != nil {
+		apiError(w, err, "Database error")
+		return
+	}
+	writeJSON(w, status, toAPIStandingOrder(o))
+}
+
+// APIListStandingOrders lists the caller's standing orders that have not
+// been cancelled, newest first
+func APIListStandingOrders(w http.ResponseWriter, r *http.Request) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	userID := apiUserID(r)
+	err = config.DB.QueryRow("SELECT COUNT(*) FROM standing_orders WHERE user_id=? AND status != 'cancelled'", userID).Scan(&page.Total)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	rows, err := config.DB.Query("SELECT "+standingOrderColumns+" FROM standing_orders WHERE user_id=? AND status != 'cancelled' ORDER BY id DESC LIMIT ? OFFSET ?",
+		userID, page.Limit, page.Offset)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	orders := []apiStandingOrder{}
+	for rows.Next() {
+		o, err := scanStandingOrder(rows)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		orders = append(orders, toAPIStandingOrder(o))
+	}
+	writeJSONPage(w, orders, page)
+}
+
+// APICreateStandingOrder schedules transfers to another account or
+// repayments of one of the caller's loans
+func APICreateStandingOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		scheduleRequest
+		Kind        string `json:"kind"`
+		FromAccount string `json:"from_account"`
+		To          string `json:"to"`
+		LoanID      string `json:"loan_id"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	userID := apiUserID(r)
+	from, err := getUserAccount(userID, req.FromAccount)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusBadRequest, "Invalid account")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	amount, err := parseAPIAmount(req.Amount, from.Currency)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+	frequency, start, end, err := parseSchedule(req.Frequency, req.StartDate, req.EndDate)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	o := StandingOrder{UserID: userID, Kind: req.Kind, LoanID: req.LoanID, Amount: amount,
+		Frequency: frequency, StartDate: start, EndDate: end}
+	orderID, err := createStandingOrder(o, from, req.To)
+	if err != nil {
+		apiError(w, err, "Failed to create standing order")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/standing-orders/"+orderID)
+	writeStandingOrder(w, http.StatusCreated, userID, orderID)
+}
+
+// APIGetStandingOrder returns one of the caller's standing orders
+func APIGetStandingOrder(w http.ResponseWriter, r *http.Request) {
+	writeStandingOrder(w, http.StatusOK, apiUserID(r), mux.Vars(r)["id"])
+}
+
+// APIUpdateStandingOrder replaces the amount and schedule of a standing
+// order. The schedule restarts from the new first payment date.
+func APIUpdateStandingOrder(w http.ResponseWriter, r *http.Request) {
+	var req scheduleRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	userID := apiUserID(r)
+	o, err := getStandingOrder(userID, mux.Vars(r)["id"])
+	if err != nil {
+		apiError(w, err, "Database error")
+		return
+	}
+
+	amount, err := parseAPIAmount(req.Amount, o.Amount.Currency)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+	frequency, start, end, err := parseSchedule(req.Frequency, req.StartDate, req.EndDate)
+	if err != nil {
+		apiError(w, err, "")
+		return
+	}
+
+	if err := updateStandingOrder(o, amount, frequency, start, end); err != nil {
+		apiError(w, err, "Failed to update standing order")
+		return
+	}
+	writeStandingOrder(w, http.StatusOK, userID, o.ID)
+}
+
+// APIPauseStandingOrder stops a standing order's payments until it is resumed
+func APIPauseStandingOrder(w http.ResponseWriter, r *http.Request) {
+	apiStandingOrderAction(w, r, func(o StandingOrder) error {
+		return changeStandingOrderStatus(o, "paused", "active")
+	})
+}
+
+// APIResumeStandingOrder restarts a paused standing order, skipping the
+// payments that fell due while it was paused
+func APIResumeStandingOrder(w http.ResponseWriter, r *http.Request) {
+	apiStandingOrderAction(w, r, resumeStandingOrder)
+}
+
+// APICancelStandingOrder stops a standing order for good
+func APICancelStandingOrder(w http.ResponseWriter, r *http.Request) {
+	apiStandingOrderAction(w, r, func(o StandingOrder) error {
+		return changeStandingOrderStatus(o, "cancelled", "active", "paused")
+	})
+}
+
+// Apply action to the caller's standing order in the path and write the
+// order as it is afterwards
+func apiStandingOrderAction(w http.ResponseWriter, r *http.Request, action func(StandingOrder) error) {
+	userID := apiUserID(r)
+	o, err := getStandingOrder(userID, mux.Vars(r)["id"])
+	if err != nil {
+		apiError(w, err, "Database error")
+		return
+	}
+
+	if err := action(o); err != nil {
+		apiError(w, err, "Failed to update standing order")
+		return
+	}
+	writeStandingOrder(w, http.StatusOK, userID, o.ID)
+}
@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Scopes an API token can be granted, with what each allows. Requests
+// signed in with the session cookie may do everything.
+var apiScopes = map[string]string{
+	"balances:read":      "View accounts, balances, transactions, transfers and standing orders",
+	"transactions:write": "Deposit, withdraw, transfer and manage standing orders",
+	"accounts:manage":    "Open and close accounts",
+	"loans:manage":       "Apply for, view and repay loans",
+}
+
+// The API scopes in order
+func apiScopeNames() []string {
+	names := make([]string, 0, len(apiScopes))
+	for name := range apiScopes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// How many days a new token can be valid for
+var apiTokenLifetimes = []int{7, 30, 90, 365}
+
+// Prefixes that mark a secret as one of ours, so leaked tokens are easy to
+// recognise and personal tokens are not mistaken for client keys
+const (
+	personalTokenPrefix = "bpat_"
+	clientIDPrefix      = "bck_"
+)
+
+// APIToken is a personal access token or a client key. Personal tokens are
+// sent as "Authorization: Bearer <token>"; client keys as HTTP Basic auth
+// with the client ID as the username and the secret as the password. Only
+// a hash of the secret is kept.
+type APIToken struct {
+	ID         string
+	Kind       string
+	Name       string
+	ClientID   string
+	Prefix     string
+	Scopes     []string
+	ExpiresAt  time.Time
+	LastUsedAt sql.NullTime
+	RevokedAt  sql.NullTime
+	CreatedAt  time.Time
+}
+
+// Status is "revoked", "expired" or "active"
+func (t APIToken) Status() string {
+	if t.RevokedAt.Valid {
+		return "revoked"
+	}
+	if !time.Now().UTC().Before(t.ExpiresAt) {
+		return "expired"
+	}
+	return "active"
+}
+
+// Report whether the token was granted a scope
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+const apiTokenColumns = "token_id, kind, name, COALESCE(client_id, ''), prefix, scopes, expires_at, last_used_at, revoked_at, created_at"
+
+func scanAPIToken(row scanner) (APIToken, error) {
+	var t APIToken
+	var scopes string
+	err := row.Scan(&t.ID, &t.Kind, &t.Name, &t.ClientID, &t.Prefix, &scopes, &t.ExpiresAt, &t.LastUsedAt, &t.RevokedAt, &t.CreatedAt)
+	t.Scopes = strings.Fields(scopes)
+	return t, err
+}
+
+// A random hex string of n bytes
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Hash a token secret for storage. The secrets are long and random, so a
+// plain SHA-256 is enough to make a leaked table useless.
+func hashToken(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// Issue a personal token or client key for a user. It returns the secret,
+// which is not stored and cannot be shown again, and for client keys the
+// client ID.
+func createAPIToken(userID, kind, name string, scopes []string, days int) (clientID, secret string, err error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", "", &bankError{http.StatusBadRequest, "A name is required"}
+	}
+	if len(scopes) == 0 {
+		return "", "", &bankError{http.StatusBadRequest, "Choose at least one scope"}
+	}
+	for _, scope := range scopes {
+		if _, ok := apiScopes[scope]; !ok {
+			return "", "", &bankError{http.StatusBadRequest, "Unknown scope " + scope}
+		}
+	}
+	valid := false
+	for _, d := range apiTokenLifetimes {
+		valid = valid || d == days
+	}
+	if !valid {
+		return "", "", &bankError{http.StatusBadRequest, "Invalid expiry"}
+	}
+
+	random, err := randomHex(24)
+	if err != nil {
+		return "", "", err
+	}
+	var dbClientID interface{}
+	switch kind {
+	case "personal":
+		secret = personalTokenPrefix + random
+	case "client":
+		id, err := randomHex(8)
+		if err != nil {
+			return "", "", err
+		}
+		clientID, secret, dbClientID = clientIDPrefix+id, random, clientIDPrefix+id
+	default:
+		return "", "", &bankError{http.StatusBadRequest, "Invalid token type"}
+	}
+
+	now := time.Now().UTC()
+	_, err = config.DB.Exec(`
+		INSERT INTO api_tokens (token_id, user_id, kind, name, client_id, token_hash, prefix, scopes, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		uuid.New().String(), userID, kind, name, dbClientID, hashToken(secret), strings.TrimSuffix(secret, random)+random[:6],
+		strings.Join(scopes, " "), now.AddDate(0, 0, days).Format(dbTime), now.Format(dbTime))
+	return clientID, secret, err
+}
+
+// Find the user and token an Authorization header carries: a personal
+// token or OAuth access token as a bearer token, or a client key by Basic
+// auth. Tokens that are unknown, expired or revoked are refused alike.
+func authenticateAPIToken(r *http.Request) (string, APIToken, error) {
+	var row *sql.Row
+	var secret string
+	if clientID, password, ok := r.BasicAuth(); ok {
+		row = config.DB.QueryRow("SELECT token_id, user_id, token_hash FROM api_tokens WHERE kind='client' AND client_id=?", clientID)
+		secret = password
+	} else if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if !strings.HasPrefix(token, personalTokenPrefix) {
+			return authenticateOAuthToken(token)
+		}
+		row = config.DB.QueryRow("SELECT token_id, user_id, token_hash FROM api_tokens WHERE kind='personal' AND token_hash=?", hashToken(token))
+		secret = token
+	} else {
+		return "", APIToken{}, &bankError{http.StatusUnauthorized, "Unsupported authorization scheme"}
+	}
+
+	var tokenID, userID, hash string
+	err := row.Scan(&tokenID, &userID, &hash)
+	if err == sql.ErrNoRows || (err == nil && subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(secret))) != 1) {
+		return "", APIToken{}, &bankError{http.StatusUnauthorized, "Invalid API token"}
+	} else if err != nil {
+		return "", APIToken{}, err
+	}
+
+	t, err := scanAPIToken(config.DB.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_id=?", tokenID))
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	if t.Status() != "active" {
+		return "", APIToken{}, &bankError{http.StatusUnauthorized, "API token has " + t.Status()}
+	}
+
+	config.DB.Exec("UPDATE api_tokens SET last_used_at=? WHERE token_id=?", time.Now().UTC().Format(dbTime), t.ID)
+	return userID, t, nil
+}
+
+// RequireScope lets a request through to an API handler only if it was
+// signed in with the session cookie or with a token granted scope
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t, ok := r.Context().Value(apiTokenKey).(APIToken); ok && !t.HasScope(scope) {
+			writeAPIError(w, http.StatusForbidden, "API token lacks the "+scope+" scope")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// APITokensPage lists the logged in user's tokens and client keys, with a
+// form to create another
+func APITokensPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	renderAPITokens(w, r, userID, nil)
+}
+
+// Render the token page, showing a newly created secret if there is one
+func renderAPITokens(w http.ResponseWriter, r *http.Request, userID string, created map[string]string) {
+	rows, err := config.DB.Query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id=? ORDER BY id DESC", userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		tokens = append(tokens, t)
+	}
+
+	type scope struct {
+		Name        string
+		Description string
+	}
+	var scopes []scope
+	for _, name := range apiScopeNames() {
+		scopes = append(scopes, scope{name, apiScopes[name]})
+	}
+
+	apps, err := getConnectedApps(userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/api_tokens.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Tokens":    tokens,
+		"Apps":      apps,
+		"Scopes":    scopes,
+		"Lifetimes": apiTokenLifetimes,
+		"Created":   created,
+	})
+}
+
+// CreateAPIToken issues a token or client key for the logged in user and
+// shows its secret once
+func CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid form")
+		return
+	}
+
+	days, _ := strconv.Atoi(r.FormValue("expires_in_days"))
+	scopes := append([]string{}, r.Form["scopes"]...)
+	sort.Strings(scopes)
+	kind := r.FormValue("kind")
+	clientID, secret, err := createAPIToken(userID, kind, r.FormValue("name"), scopes, days)
+	if err != nil {
+		transactionError(w, r, err, "Failed to create API token")
+		return
+	}
+
+	renderAPITokens(w, r, userID, map[string]string{"Kind": kind, "ClientID": clientID, "Secret": secret})
+}
+
+// RevokeAPIToken stops one of the logged in user's tokens working
+func RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	result, err := config.DB.Exec("UPDATE api_tokens SET revoked_at=? WHERE token_id=? AND user_id=? AND revoked_at IS NULL",
+		time.Now().UTC().Format(dbTime), mux.Vars(r)["id"], userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		ErrorPage(w, r, http.StatusNotFound, "API token not found")
+		return
+	}
+
+	http.Redirect(w, r, "/api-tokens", http.StatusSeeOther)
+}
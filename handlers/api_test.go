@@ -0,0 +1,401 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"Bank-Management-System/config"
+	"Bank-Management-System/handlers"
+	"Bank-Management-System/routes"
+
+	"github.com/gorilla/mux"
+)
+
+// Start the app on a scratch database and return its router and a test
+// server running it
+func startTestServer(t *testing.T) (*mux.Router, *httptest.Server) {
+	t.Helper()
+	// The pages render templates relative to the repository root
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	config.DBPath = filepath.Join(t.TempDir(), "bank.db")
+	config.InitDB()
+	t.Cleanup(func() { config.DB.Close() })
+
+	router := routes.Routes()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return router, server
+}
+
+// TestAPIMatchesOpenAPI drives the real API against a scratch database and
+// checks every response against the OpenAPI document the server publishes,
+// so the document cannot drift from the handlers. It also fails when an API
+// route is not documented or a documented operation is not exercised.
+func TestAPIMatchesOpenAPI(t *testing.T) {
+	router, server := startTestServer(t)
+	c := &apiChecker{t: t, server: server.URL, covered: map[string]bool{}}
+	if err := c.run(router); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("checked %d response(s)", c.requests)
+}
+
+// apiChecker makes API requests and reports where they disagree with the
+// OpenAPI document
+type apiChecker struct {
+	t        *testing.T
+	server   string
+	doc      *apiDocument
+	covered  map[string]bool
+	requests int
+}
+
+// Run the scenario. An error means the check itself could not go on, as
+// opposed to a response not matching the document.
+func (c *apiChecker) run(router *mux.Router) error {
+	response, err := http.Get(c.server + "/api/openapi.json")
+	if err != nil {
+		return err
+	}
+	spec, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	if c.doc, err = parseAPIDocument(spec); err != nil {
+		return fmt.Errorf("reading /api/openapi.json: %v", err)
+	}
+
+	anonymous := &http.Client{}
+	c.call(anonymous, "GET", "/accounts", nil, http.StatusUnauthorized)
+
+	alice, err := c.signUp("checker_alice", false)
+	if err != nil {
+		return err
+	}
+	if _, err := c.signUp("checker_bob", false); err != nil {
+		return err
+	}
+	admin, err := c.signUp("checker_admin", true)
+	if err != nil {
+		return err
+	}
+
+	// Accounts
+	accounts := c.call(alice, "GET", "/accounts?limit=10", nil, http.StatusOK)
+	current := c.field(accounts, "data", 0, "account_number")
+	savings := c.field(c.call(alice, "POST", "/accounts", map[string]string{"type": "savings"}, http.StatusCreated), "data", "account_number")
+	c.call(alice, "POST", "/accounts", map[string]string{"type": "shares"}, http.StatusBadRequest)
+	c.call(alice, "GET", "/accounts/"+current, nil, http.StatusOK)
+	c.call(alice, "GET", "/accounts/0000000000", nil, http.StatusNotFound)
+	c.call(alice, "GET", "/accounts?limit=0", nil, http.StatusBadRequest)
+	c.call(alice, "POST", "/accounts/"+savings+"/close", nil, http.StatusOK)
+	c.call(alice, "POST", "/accounts/"+savings+"/close", nil, http.StatusBadRequest)
+
+	// Payments
+	c.call(alice, "POST", "/accounts/"+current+"/deposits", map[string]string{"amount": "1000.00"}, http.StatusCreated)
+	c.call(alice, "POST", "/accounts/"+current+"/deposits", map[string]string{"amount": "-5"}, http.StatusBadRequest)
+	c.call(alice, "POST", "/accounts/"+current+"/withdrawals", map[string]string{"amount": "50"}, http.StatusCreated)
+	c.call(alice, "POST", "/accounts/"+current+"/withdrawals", map[string]string{"amount": "900"}, http.StatusAccepted)
+	c.call(alice, "GET", "/accounts/"+current+"/transactions", nil, http.StatusOK)
+	transfer := c.call(alice, "POST", "/transfers", map[string]string{"from_account": current, "to": "checker_bob", "amount": "20"}, http.StatusCreated)
+	c.call(alice, "GET", "/transfers/"+c.field(transfer, "data", "reference"), nil, http.StatusOK)
+	c.call(alice, "GET", "/transfers/unknown", nil, http.StatusNotFound)
+	c.call(alice, "POST", "/transfers", map[string]string{"from_account": current, "to": "checker_bob", "amount": "1000000"}, http.StatusBadRequest)
+
+	// Loans
+	loan := c.call(alice, "POST", "/loans", map[string]interface{}{"amount": "500", "interest_rate": "12.5", "repayment_period": 6}, http.StatusCreated)
+	loanID := c.field(loan, "data", "loan_id")
+	c.call(alice, "POST", "/loans", map[string]interface{}{"amount": "500", "interest_rate": "12.5", "repayment_period": 0}, http.StatusBadRequest)
+	c.call(alice, "GET", "/loans", nil, http.StatusOK)
+	c.call(alice, "GET", "/loans/"+loanID, nil, http.StatusOK)
+	c.call(alice, "GET", "/loans/unknown", nil, http.StatusNotFound)
+	if err := c.form(admin, "/admin/loans/"+loanID+"/approve", nil); err != nil {
+		return err
+	}
+	c.call(alice, "POST", "/loans/"+loanID+"/repayments", map[string]string{"from_account": current, "amount": "10"}, http.StatusCreated)
+
+	// Standing orders
+	order := c.call(alice, "POST", "/standing-orders", map[string]string{
+		"kind": "transfer", "from_account": current, "to": "checker_bob", "amount": "5", "frequency": "monthly"}, http.StatusCreated)
+	orderID := c.field(order, "data", "order_id")
+	c.call(alice, "POST", "/standing-orders", map[string]string{
+		"kind": "transfer", "from_account": current, "to": "checker_bob", "amount": "5", "frequency": "hourly"}, http.StatusBadRequest)
+	c.call(alice, "GET", "/standing-orders", nil, http.StatusOK)
+	c.call(alice, "GET", "/standing-orders/"+orderID, nil, http.StatusOK)
+	c.call(alice, "PUT", "/standing-orders/"+orderID, map[string]string{"amount": "6", "frequency": "weekly"}, http.StatusOK)
+	c.call(alice, "POST", "/standing-orders/"+orderID+"/pause", nil, http.StatusOK)
+	c.call(alice, "POST", "/standing-orders/"+orderID+"/resume", nil, http.StatusOK)
+	c.call(alice, "POST", "/standing-orders/"+orderID+"/cancel", nil, http.StatusOK)
+	c.call(alice, "POST", "/standing-orders/"+orderID+"/pause", nil, http.StatusBadRequest)
+
+	// API tokens
+	if err := c.checkTokens(alice, current); err != nil {
+		return err
+	}
+
+	c.checkCoverage(router)
+	return nil
+}
+
+// Check that API tokens sign requests in, that each operation refuses
+// tokens without the scope the document says it needs, and that revoked
+// tokens stop working
+func (c *apiChecker) checkTokens(owner *http.Client, account string) error {
+	scopes := map[string]*http.Client{}
+	for _, operations := range c.doc.Paths {
+		for _, op := range operations {
+			if op.Scope != "" && scopes[op.Scope] == nil {
+				_, secret, err := c.createToken(owner, "personal", op.Scope)
+				if err != nil {
+					return err
+				}
+				scopes[op.Scope] = &http.Client{Transport: authTransport{"Bearer " + secret}}
+			}
+		}
+	}
+
+	var templates []string
+	for template := range c.doc.Paths {
+		templates = append(templates, template)
+	}
+	sort.Strings(templates)
+	for _, template := range templates {
+		path := regexp.MustCompile(`{[^}]+}`).ReplaceAllString(template, "unknown")
+		for method, op := range c.doc.Paths[template] {
+			for scope, client := range scopes {
+				if scope != op.Scope {
+					c.call(client, strings.ToUpper(method), path, map[string]string{}, http.StatusForbidden)
+				}
+			}
+		}
+	}
+
+	reader := scopes["balances:read"]
+	if reader == nil {
+		return fmt.Errorf("no operation requires the balances:read scope")
+	}
+	c.call(reader, "GET", "/accounts/"+account, nil, http.StatusOK)
+	c.call(reader, "POST", "/accounts/"+account+"/deposits", map[string]string{"amount": "1"}, http.StatusForbidden)
+	c.call(&http.Client{Transport: authTransport{"Bearer bpat_unknown"}}, "GET", "/accounts", nil, http.StatusUnauthorized)
+
+	clientID, secret, err := c.createToken(owner, "client", "loans:manage")
+	if err != nil {
+		return err
+	}
+	basic := base64.StdEncoding.EncodeToString([]byte(clientID + ":" + secret))
+	c.call(&http.Client{Transport: authTransport{"Basic " + basic}}, "GET", "/loans", nil, http.StatusOK)
+	wrong := base64.StdEncoding.EncodeToString([]byte(clientID + ":wrong"))
+	c.call(&http.Client{Transport: authTransport{"Basic " + wrong}}, "GET", "/loans", nil, http.StatusUnauthorized)
+
+	response, err := owner.Get(c.server + "/api-tokens")
+	if err != nil {
+		return err
+	}
+	page, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	for _, match := range regexp.MustCompile(`/api-tokens/([^/"]+)/revoke`).FindAllStringSubmatch(string(page), -1) {
+		if err := c.form(owner, match[0], nil); err != nil {
+			return err
+		}
+	}
+	c.call(reader, "GET", "/accounts", nil, http.StatusUnauthorized)
+	return nil
+}
+
+// Create an API token on the tokens page and read its secret back
+func (c *apiChecker) createToken(owner *http.Client, kind, scope string) (clientID, secret string, err error) {
+	response, err := owner.PostForm(c.server+"/api-tokens", url.Values{
+		"name": {"api test " + scope}, "kind": {kind}, "scopes": {scope}, "expires_in_days": {"7"}})
+	if err != nil {
+		return "", "", err
+	}
+	page, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if match := regexp.MustCompile(`<code id="client-id">([^<]+)</code>`).FindSubmatch(page); match != nil {
+		clientID = string(match[1])
+	}
+	match := regexp.MustCompile(`<code id="secret">([^<]+)</code>`).FindSubmatch(page)
+	if response.StatusCode != http.StatusOK || match == nil {
+		return "", "", fmt.Errorf("creating a %s token: status %d", kind, response.StatusCode)
+	}
+	return clientID, string(match[1]), nil
+}
+
+// authTransport signs every request with an Authorization header
+type authTransport struct {
+	authorization string
+}
+
+func (t authTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", t.authorization)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Register a user and return a client signed in as them
+func (c *apiChecker) signUp(username string, admin bool) (*http.Client, error) {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	err := c.form(client, "/register", url.Values{"name": {username}, "username": {username}, "pin": {"1234"}, "confirm-pin": {"1234"}})
+	if err != nil {
+		return nil, err
+	}
+	if admin {
+		if err := handlers.PromoteAdmin(username); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.form(client, "/login", url.Values{"user-name": {username}, "pin": {"1234"}}); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Post a form to one of the web pages, which answer with a redirect
+func (c *apiChecker) form(client *http.Client, path string, values url.Values) error {
+	response, err := client.PostForm(c.server+path, values)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusSeeOther {
+		return fmt.Errorf("POST %s: status %d", path, response.StatusCode)
+	}
+	return nil
+}
+
+// Make an API request, check the response against the document and return
+// its decoded body
+func (c *apiChecker) call(client *http.Client, method, path string, body interface{}, want int) map[string]interface{} {
+	c.requests++
+	name := method + " " + path
+
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	request, _ := http.NewRequest(method, c.server+c.doc.BasePath()+path, reader)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if method == "POST" {
+		request.Header.Set("Idempotency-Key", fmt.Sprintf("api-test-%d", c.requests))
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		c.t.Error(name + ": " + err.Error())
+		return nil
+	}
+	data, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != want {
+		c.t.Errorf("%s: want status %d, got %d: %s", name, want, response.StatusCode, bytes.TrimSpace(data))
+	}
+
+	route := strings.SplitN(path, "?", 2)[0]
+	template, op, ok := c.doc.Find(method, route)
+	if !ok {
+		c.t.Error(name + ": not in the OpenAPI document")
+		return nil
+	}
+	c.covered[strings.ToLower(method)+" "+template] = true
+	for _, problem := range c.doc.CheckResponse(op, response.StatusCode, data) {
+		c.t.Errorf("%s (%d): %s", name, response.StatusCode, problem)
+	}
+
+	var decoded map[string]interface{}
+	json.Unmarshal(data, &decoded)
+	return decoded
+}
+
+// Dig a string out of a decoded body by property names and array indexes
+func (c *apiChecker) field(value interface{}, path ...interface{}) string {
+	for _, step := range path {
+		switch key := step.(type) {
+		case string:
+			object, _ := value.(map[string]interface{})
+			value = object[key]
+		case int:
+			array, _ := value.([]interface{})
+			if key >= len(array) {
+				value = nil
+				break
+			}
+			value = array[key]
+		}
+	}
+	s, ok := value.(string)
+	if !ok {
+		c.t.Errorf("no string at %v", path)
+	}
+	return s
+}
+
+// Fail for API routes the document does not describe and documented
+// operations the scenario never called
+func (c *apiChecker) checkCoverage(router *mux.Router) {
+	base := c.doc.BasePath()
+	routed := map[string]bool{}
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		if err != nil || !strings.HasPrefix(template, base+"/") {
+			return nil
+		}
+		for _, method := range methods {
+			key := strings.ToLower(method) + " " + strings.TrimPrefix(template, base)
+			routed[key] = true
+			if _, op, ok := c.doc.Find(method, strings.TrimPrefix(template, base)); !ok || op.OperationID == "" {
+				c.t.Errorf("%s %s: route is not documented", method, template)
+			}
+		}
+		return nil
+	})
+
+	var documented []string
+	for template, operations := range c.doc.Paths {
+		for method := range operations {
+			documented = append(documented, method+" "+template)
+		}
+	}
+	sort.Strings(documented)
+	for _, key := range documented {
+		if !routed[key] {
+			c.t.Error(key + ": documented but not routed")
+		} else if !c.covered[key] {
+			c.t.Error(key + ": documented but not checked")
+		}
+	}
+}
@@ -2,10 +2,14 @@ package handlers
 
 import (
 	"Bank-Management-System/config"
+	"Bank-Management-System/money"
 	"crypto/sha256"
 	"encoding/hex"
 	"html/template"
+	"log"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -80,13 +84,27 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, err := openAccount(userID, "current", money.DefaultCurrency); err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Failed to open account")
+		return
+	}
+
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
 // Login Page
 func LoginPage(w http.ResponseWriter, r *http.Request) {
 	tmpl := template.Must(template.ParseFiles("templates/login.html"))
-	tmpl.Execute(w, nil)
+	tmpl.Execute(w, map[string]interface{}{"Next": localPath(r.URL.Query().Get("next"))})
+}
+
+// Return path if it is a path on this site, so a login link cannot be used
+// to send someone elsewhere, or "" if it is not
+func localPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return ""
+	}
+	return path
 }
 
 // Login User (Set Session Cookie)
@@ -99,12 +117,18 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("user-name")
 	pin := hashPassword(r.FormValue("pin"))
 
+	deviceID := deviceFromRequest(w, r)
+
 	var user User
 	err := config.DB.QueryRow("SELECT user_id, name FROM users WHERE user_name=? AND user_pin=?", username, pin).Scan(&user.ID, &user.Name)
 	if err != nil {
+		if userID, _ := getUserID(username); userID != "" {
+			recordLogin(userID, deviceID, r, false)
+		}
 		ErrorPage(w, r, http.StatusUnauthorized, "Invalid credentials")
 		return
 	}
+	recordLogin(user.ID, deviceID, r, true)
 
 	sessionToken := uuid.New().String()
 	expiration := time.Now().Add(24 * time.Hour)
@@ -120,9 +144,43 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	// Store session mapping to user UUID
 	config.DB.Exec("INSERT INTO sessions (session_token, user_id, expires_at) VALUES (?, ?, ?)", sessionToken, user.ID, expiration)
 
+	if next := localPath(r.FormValue("next")); next != "" {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
 	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 }
 
+// Identify the browser a request comes from by a long lived cookie, issuing
+// one to browsers that have not been seen before
+func deviceFromRequest(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie("device_id"); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	deviceID := uuid.New().String()
+	http.SetCookie(w, &http.Cookie{
+		Name:     "device_id",
+		Value:    deviceID,
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		Path:     "/",
+	})
+	return deviceID
+}
+
+// Record a login attempt for the fraud rules
+func recordLogin(userID, deviceID string, r *http.Request, success bool) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	_, err = config.DB.Exec("INSERT INTO logins (user_id, device_id, ip, success, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, deviceID, ip, success, time.Now().UTC().Format(dbTime))
+	if err != nil {
+		log.Printf("recording login for %s: %v", userID, err)
+	}
+}
+
 // Logout User (Clear Cookie)
 func Logout(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &http.Cookie{
@@ -148,8 +206,44 @@ func Dashboard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := ensureDefaultAccount(userID); err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	accounts, err := getUserAccounts(userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	failedOrders, err := failedStandingOrders(userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	unread, err := unreadNotifications(userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
 	tmpl := template.Must(template.ParseFiles("templates/dashboard.html"))
-	tmpl.Execute(w, nil)
+	tmpl.Execute(w, map[string]interface{}{
+		"Accounts":       accounts,
+		"FailedOrders":   failedOrders,
+		"Unread":         unread,
+		"Currencies":     money.Currencies(),
+		"IsAdmin":        isAdmin(userID),
+		"IdempotencyKey": uuid.New().String(),
+	})
 }
 
 // Middleware: Get user ID from session
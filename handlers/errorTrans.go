@@ -6,6 +6,11 @@ import (
 )
 
 func ErrorPageTrans(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
+	if isAPIRequest(r) {
+		writeAPIError(w, statusCode, message)
+		return
+	}
+
 	if statusCode != http.StatusOK {
 		w.WriteHeader(statusCode)
 	}
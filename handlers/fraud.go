@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// What a fraud rule does with a payment it flags
+var fraudActions = map[string]int{
+	"allow": 0,
+	"hold":  1,
+	"block": 2,
+}
+
+// payment is a customer's payment being screened: money leaving an
+// account, or a deposit into one
+type payment struct {
+	Kind string
+
+	// The customer's account: the one paid from, or paid into by a deposit
+	From Account
+
+	// Where the money goes: the account a transfer credits, the loan a
+	// repayment pays or the hold a capture takes from
+	ToAccount string
+	Amount    money.Money
+	Channel   string
+}
+
+// Report whether a payment brings money in rather than taking it out
+func (p payment) credit() bool {
+	return p.Kind == "deposit"
+}
+
+// A fraud rule reports whether it flags a payment
+type fraudRule func(tx *sql.Tx, p payment, now time.Time) (bool, error)
+
+// Fraud rules by code; their actions are kept in the fraud_rules table
+var fraudRules = map[string]fraudRule{
+	"unusual_amount":             unusualAmount,
+	"deposit_then_withdraw":      depositThenWithdraw,
+	"new_device_large_payment":   newDeviceLargePayment,
+	"failed_logins_then_success": failedLoginsThenSuccess,
+}
+
+// fraudError stops a payment the fraud rules held or blocked. The payment
+// is recorded as a fraud case once its transaction has rolled back.
+type fraudError struct {
+	bankError
+	Decision string
+	Rules    []string
+	Payment  payment
+}
+
+// Flags a payment much larger than the account's average payment in the
+// same direction over the last 90 days. Accounts with too little history
+// are not judged.
+func unusualAmount(tx *sql.Tx, p payment, now time.Time) (bool, error) {
+	types := limitedTypes
+	if p.credit() {
+		types = []string{"deposit", "transfer_in"}
+	}
+	var count int
+	var average float64
+	err := tx.QueryRow(`
+		SELECT COUNT(*), COALESCE(AVG(amount), 0) FROM transactions
+		WHERE account_number=? AND created_at >= ? AND type IN ('`+strings.Join(types, "', '")+`')`,
+		p.From.Number, now.AddDate(0, 0, -90).Format(dbTime)).Scan(&count, &average)
+	if err != nil || count < 3 {
+		return false, err
+	}
+	return float64(p.Amount.Amount) > average*float64(config.FraudAmountMultiplier), nil
+}
+
+// Flags a payment taking out most of what was paid into the account within
+// config.FraudRapidWindow. A deposit is flagged when the account has
+// already passed most of the money paid in during the window straight back
+// out, so money moving through an account is caught from both sides.
+func depositThenWithdraw(tx *sql.Tx, p payment, now time.Time) (bool, error) {
+	var deposited, paidOut int64
+	err := tx.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN type IN ('deposit', 'transfer_in') THEN amount END), 0),
+			COALESCE(SUM(CASE WHEN type IN ('`+strings.Join(limitedTypes, "', '")+`') THEN amount END), 0)
+		FROM transactions WHERE account_number=? AND created_at >= ?`,
+		p.From.Number, now.Add(-config.FraudRapidWindow).Format(dbTime)).Scan(&deposited, &paidOut)
+	if err != nil || deposited == 0 {
+		return false, err
+	}
+	if p.credit() {
+		return paidOut*10 >= deposited*8, nil
+	}
+	return p.Amount.Amount*10 >= deposited*8, nil
+}
+
+// The user's latest successful login within config.FraudLoginWindow
+func recentLogin(tx *sql.Tx, userID string, now time.Time) (id int64, deviceID string, ok bool, err error) {
+	err = tx.QueryRow("SELECT id, device_id FROM logins WHERE user_id=? AND success=1 AND created_at >= ? ORDER BY id DESC LIMIT 1",
+		userID, now.Add(-config.FraudLoginWindow).Format(dbTime)).Scan(&id, &deviceID)
+	if err == sql.ErrNoRows {
+		return 0, "", false, nil
+	}
+	return id, deviceID, err == nil, err
+}
+
+// Flags a payment of a large share of the balance after the customer
+// recently logged in from a device they had never used before. A
+// customer's very first login does not count as a new device. Deposits are
+// not flagged.
+func newDeviceLargePayment(tx *sql.Tx, p payment, now time.Time) (bool, error) {
+	if p.credit() {
+		return false, nil
+	}
+	loginID, deviceID, ok, err := recentLogin(tx, p.From.UserID, now)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	var earlier, sameDevice int
+	err = tx.QueryRow("SELECT COUNT(*), COALESCE(SUM(device_id = ?), 0) FROM logins WHERE user_id=? AND success=1 AND id < ?",
+		deviceID, p.From.UserID, loginID).Scan(&earlier, &sameDevice)
+	if err != nil || earlier == 0 || sameDevice > 0 {
+		return false, err
+	}
+
+	balance, err := freeBalance(tx, p.From.Number)
+	if err != nil {
+		return false, err
+	}
+	return p.Amount.Amount*10000 >= balance*config.FraudLargeShareBps, nil
+}
+
+// Flags any payment out after the customer's latest login came at the end
+// of a run of failed attempts
+func failedLoginsThenSuccess(tx *sql.Tx, p payment, now time.Time) (bool, error) {
+	if p.credit() {
+		return false, nil
+	}
+	loginID, _, ok, err := recentLogin(tx, p.From.UserID, now)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	var failed int64
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM logins
+		WHERE user_id=? AND success=0 AND id < ?
+			AND id > COALESCE((SELECT MAX(id) FROM logins WHERE user_id=? AND success=1 AND id < ?), 0)`,
+		p.From.UserID, loginID, p.From.UserID, loginID).Scan(&failed)
+	return failed >= config.FraudFailedLogins, err
+}
+
+// Run a payment through every fraud rule that is not set to allow. Returns
+// a fraudError if any of them holds or blocks it; block wins over hold. A
+// payment an admin is approving in tx is let through without the rules
+// being run again.
+func screenPayment(tx *sql.Tx, p payment) error {
+	var approved int
+	err := tx.QueryRow(`
+		SELECT COUNT(*) FROM fraud_cases
+		WHERE status='approved' AND reference IS NULL AND kind=? AND from_account=? AND COALESCE(to_account, '')=? AND amount=? AND currency=?`,
+		p.Kind, p.From.Number, p.ToAccount, p.Amount.Amount, p.Amount.Currency).Scan(&approved)
+	if err != nil || approved > 0 {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT code, action FROM fraud_rules WHERE action != 'allow' ORDER BY code")
+	if err != nil {
+		return err
+	}
+	type active struct{ code, action string }
+	var rules []active
+	for rows.Next() {
+		var ru active
+		if err := rows.Scan(&ru.code, &ru.action); err != nil {
+			rows.Close()
+			return err
+		}
+		rules = append(rules, ru)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	decision := "allow"
+	var flagged []string
+	for _, ru := range rules {
+		rule, ok := fraudRules[ru.code]
+		if !ok {
+			continue
+		}
+		hit, err := rule(tx, p, now)
+		if err != nil {
+			return err
+		}
+		if hit {
+			flagged = append(flagged, ru.code)
+			if fraudActions[ru.action] > fraudActions[decision] {
+				decision = ru.action
+			}
+		}
+	}
+
+	switch decision {
+	case "block":
+		return &fraudError{bankError{http.StatusForbidden, "This payment was blocked for your security. Please contact the bank."}, decision, flagged, p}
+	case "hold":
+		return &fraudError{bankError{http.StatusAccepted, "This payment has been held for review and will be made once it is approved."}, decision, flagged, p}
+	}
+	return nil
+}
+
+// Record a held or blocked payment for review inside tx. Held payments wait
+// for an admin to approve or reject them; blocked ones are kept for the
+// record.
+func recordFraudCase(tx *sql.Tx, fe *fraudError) error {
+	status := "pending"
+	if fe.Decision == "block" {
+		status = "blocked"
+	}
+	var toAccount interface{}
+	if fe.Payment.ToAccount != "" {
+		toAccount = fe.Payment.ToAccount
+	}
+
+	p := fe.Payment
+	caseID := uuid.New().String()
+	_, err := tx.Exec(`
+		INSERT INTO fraud_cases (case_id, user_id, decision, rules, kind, from_account, to_account, amount, currency, channel, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		caseID, p.From.UserID, fe.Decision, strings.Join(fe.Rules, ","), p.Kind, p.From.Number, toAccount,
+		p.Amount.Amount, p.Amount.Currency, p.Channel, status, time.Now().UTC().Format(dbTime))
+	if err != nil || status != "pending" || p.credit() || p.Kind == "capture" {
+		return err
+	}
+
+	// Keep the money for the payment reserved while it waits for review. A
+	// capture's money is already reserved by the hold it captures, and a
+	// deposit has none to reserve. The case is kept even if the money can
+	// no longer be reserved; approving it checks the balance again.
+	err = withSavepoint(tx, "fraud_hold", func() error {
+		_, err := placeHold(tx, p.From, p.Amount, "Payment held for fraud review", caseID)
+		return err
+	})
+	if err != nil {
+		log.Printf("fraud case %s: could not reserve %s: %v", caseID, p.Amount, err)
+	}
+	return nil
+}
+
+// Record the fraud case behind err, if there is one, once the payment's
+// transaction has rolled back, and pass err on. The customer is still told
+// the payment was held or blocked if the case cannot be recorded.
+func fraudCaseFor(err error) error {
+	if fe, ok := err.(*fraudError); ok {
+		recordErr := withTx(func(tx *sql.Tx) error {
+			return recordFraudCase(tx, fe)
+		})
+		if recordErr != nil {
+			log.Printf("recording fraud case for %s from %s: %v", fe.Payment.Kind, fe.Payment.From.Number, recordErr)
+		}
+	}
+	return err
+}
+
+// FraudCase is a payment the fraud rules held or blocked
+type FraudCase struct {
+	ID          string
+	Username    string
+	Decision    string
+	Rules       string
+	Kind        string
+	FromAccount string
+	ToAccount   string
+	Amount      money.Money
+	Channel     string
+	Status      string
+	CreatedAt   string
+}
+
+// Fetch the fraud cases with a status, newest first
+func getFraudCases(status string, limit int) ([]FraudCase, error) {
+	rows, err := config.DB.Query(`
+		SELECT f.case_id, u.user_name, f.decision, f.rules, f.kind, f.from_account, COALESCE(f.to_account, ''), f.amount, f.currency, f.channel, f.status, f.created_at
+		FROM fraud_cases f JOIN users u ON u.user_id = f.user_id
+		WHERE f.status=? ORDER BY f.id DESC LIMIT ?`, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cases []FraudCase
+	for rows.Next() {
+		var c FraudCase
+		err := rows.Scan(&c.ID, &c.Username, &c.Decision, &c.Rules, &c.Kind, &c.FromAccount, &c.ToAccount,
+			&c.Amount.Amount, &c.Amount.Currency, &c.Channel, &c.Status, &c.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		cases = append(cases, c)
+	}
+	return cases, rows.Err()
+}
+
+// Make a held payment now that an admin has approved it. The usual limit
+// and balance checks still apply, but the fraud rules are not run again:
+// the case is marked approved before the payment is made so screenPayment
+// lets it through.
+func approveFraudCase(caseID, reviewedBy string) error {
+	return withTx(func(tx *sql.Tx) error {
+		var userID, kind, fromAccount, channel string
+		var toAccount sql.NullString
+		var amount money.Money
+		err := tx.QueryRow("SELECT user_id, kind, from_account, to_account, amount, currency, channel FROM fraud_cases WHERE case_id=? AND status='pending'", caseID).
+			Scan(&userID, &kind, &fromAccount, &toAccount, &amount.Amount, &amount.Currency, &channel)
+		if err == sql.ErrNoRows {
+			return &bankError{http.StatusNotFound, "No held payment with that ID"}
+		} else if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE fraud_cases SET status='approved', reviewed_by=?, reviewed_at=? WHERE case_id=?",
+			reviewedBy, time.Now().UTC().Format(dbTime), caseID)
+		if err != nil {
+			return err
+		}
+		if err := releaseHoldsFor(tx, caseID); err != nil {
+			return err
+		}
+		from, err := getAccount(tx, fromAccount)
+		if err != nil {
+			return err
+		}
+
+		reference := uuid.New().String()
+		switch kind {
+		case "deposit":
+			err = postDeposit(tx, from, amount, channel, reference)
+		case "withdraw":
+			err = postWithdrawal(tx, from, amount, channel, reference)
+		case "transfer":
+			var to Account
+			to, err = getAccount(tx, toAccount.String)
+			if err == nil {
+				err = postTransfer(tx, from, to, amount, reference, channel)
+			}
+		case "repayment":
+			reference = toAccount.String
+			_, err = repayLoan(tx, from, reference, amount, channel)
+		case "capture":
+			reference = toAccount.String
+			err = captureHold(tx, reference, amount, false)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE fraud_cases SET reference=? WHERE case_id=?", reference, caseID)
+		return err
+	})
+}
+
+// AdminFraud shows the review queue of held payments, recent blocks and the
+// action each rule takes
+func AdminFraud(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	held, err := getFraudCases("pending", 100)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	blocked, err := getFraudCases("blocked", 20)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	rows, err := config.DB.Query("SELECT code, description, action FROM fraud_rules ORDER BY code")
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	type rule struct{ Code, Description, Action string }
+	var rules []rule
+	for rows.Next() {
+		var ru rule
+		if err := rows.Scan(&ru.Code, &ru.Description, &ru.Action); err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		rules = append(rules, ru)
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/admin_fraud.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Held":    held,
+		"Blocked": blocked,
+		"Rules":   rules,
+		"Actions": []string{"allow", "hold", "block"},
+	})
+}
+
+// ApproveFraudCase releases a held payment
+func ApproveFraudCase(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if err := approveFraudCase(mux.Vars(r)["id"], userID); err != nil {
+		adminError(w, r, err, "Failed to make the held payment")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/fraud", http.StatusSeeOther)
+}
+
+// RejectFraudCase drops a held payment without making it
+func RejectFraudCase(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		caseID := mux.Vars(r)["id"]
+		result, err := tx.Exec("UPDATE fraud_cases SET status='rejected', reviewed_by=?, reviewed_at=? WHERE case_id=? AND status='pending'",
+			userID, time.Now().UTC().Format(dbTime), caseID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return &bankError{http.StatusNotFound, "No held payment with that ID"}
+		}
+		return releaseHoldsFor(tx, caseID)
+	})
+	if err != nil {
+		adminError(w, r, err, "Failed to reject payment")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/fraud", http.StatusSeeOther)
+}
+
+// SetFraudRule changes what a fraud rule does with the payments it flags
+func SetFraudRule(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	action := r.FormValue("action")
+	if _, ok := fraudActions[action]; !ok {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid action")
+		return
+	}
+
+	_, err := config.DB.Exec("UPDATE fraud_rules SET action=? WHERE code=?", action, r.FormValue("code"))
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Failed to save rule")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/fraud", http.StatusSeeOther)
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Post a ledger entry directly, to give an account some history
+func testPosting(t *testing.T, account Account, transactionType, amount string) {
+	t.Helper()
+	m, err := money.Parse(amount, account.Currency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = withTx(func(tx *sql.Tx) error {
+		return postTransaction(tx, Posting{UserID: account.UserID, AccountNumber: account.Number, Type: transactionType, Amount: m, Channel: "web"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Record a login for the account's owner some time ago
+func testLogin(t *testing.T, account Account, device string, success bool, ago time.Duration) {
+	t.Helper()
+	_, err := config.DB.Exec("INSERT INTO logins (user_id, device_id, success, created_at) VALUES (?, ?, ?, ?)",
+		account.UserID, device, success, time.Now().UTC().Add(-ago).Format(dbTime))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFraudRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		funds   string
+		setup   func(t *testing.T, account Account)
+		kind    string
+		amount  string
+		flagged bool
+	}{
+		{
+			name: "unusual amount", rule: "unusual_amount", funds: "10000",
+			setup: func(t *testing.T, a Account) {
+				for i := 0; i < 3; i++ {
+					testPosting(t, a, "withdraw", "100")
+				}
+			},
+			kind: "withdraw", amount: "1000", flagged: true,
+		},
+		{
+			name: "usual amount", rule: "unusual_amount", funds: "10000",
+			setup: func(t *testing.T, a Account) {
+				for i := 0; i < 3; i++ {
+					testPosting(t, a, "withdraw", "100")
+				}
+			},
+			kind: "withdraw", amount: "400",
+		},
+		{
+			name: "unusual amount without history", rule: "unusual_amount", funds: "10000",
+			kind: "withdraw", amount: "5000",
+		},
+		{
+			name: "unusual deposit", rule: "unusual_amount", funds: "100",
+			setup: func(t *testing.T, a Account) {
+				testPosting(t, a, "deposit", "100")
+				testPosting(t, a, "deposit", "100")
+			},
+			kind: "deposit", amount: "1000", flagged: true,
+		},
+		{
+			name: "most of a deposit paid out", rule: "deposit_then_withdraw", funds: "1000",
+			kind: "withdraw", amount: "900", flagged: true,
+		},
+		{
+			name: "some of a deposit paid out", rule: "deposit_then_withdraw", funds: "1000",
+			kind: "withdraw", amount: "100",
+		},
+		{
+			name: "deposit after money passed through", rule: "deposit_then_withdraw", funds: "1000",
+			setup: func(t *testing.T, a Account) {
+				testPosting(t, a, "withdraw", "900")
+			},
+			kind: "deposit", amount: "1000", flagged: true,
+		},
+		{
+			name: "deposit into a settled account", rule: "deposit_then_withdraw", funds: "1000",
+			kind: "deposit", amount: "1000",
+		},
+		{
+			name: "large payment from a new device", rule: "new_device_large_payment", funds: "1000",
+			setup: func(t *testing.T, a Account) {
+				testLogin(t, a, "laptop", true, 48*time.Hour)
+				testLogin(t, a, "phone", true, time.Hour)
+			},
+			kind: "withdraw", amount: "600", flagged: true,
+		},
+		{
+			name: "small payment from a new device", rule: "new_device_large_payment", funds: "1000",
+			setup: func(t *testing.T, a Account) {
+				testLogin(t, a, "laptop", true, 48*time.Hour)
+				testLogin(t, a, "phone", true, time.Hour)
+			},
+			kind: "withdraw", amount: "100",
+		},
+		{
+			name: "large payment from a known device", rule: "new_device_large_payment", funds: "1000",
+			setup: func(t *testing.T, a Account) {
+				testLogin(t, a, "laptop", true, 48*time.Hour)
+				testLogin(t, a, "laptop", true, time.Hour)
+			},
+			kind: "withdraw", amount: "600",
+		},
+		{
+			name: "payment after failed logins", rule: "failed_logins_then_success", funds: "1000",
+			setup: func(t *testing.T, a Account) {
+				testLogin(t, a, "laptop", true, 48*time.Hour)
+				for i := 0; i < int(config.FraudFailedLogins); i++ {
+					testLogin(t, a, "laptop", false, 2*time.Hour)
+				}
+				testLogin(t, a, "laptop", true, time.Hour)
+			},
+			kind: "withdraw", amount: "10", flagged: true,
+		},
+		{
+			name: "payment after a few failed logins", rule: "failed_logins_then_success", funds: "1000",
+			setup: func(t *testing.T, a Account) {
+				for i := 0; i < int(config.FraudFailedLogins)-1; i++ {
+					testLogin(t, a, "laptop", false, 2*time.Hour)
+				}
+				testLogin(t, a, "laptop", true, time.Hour)
+			},
+			kind: "withdraw", amount: "10",
+		},
+		{
+			name: "deposit after failed logins", rule: "failed_logins_then_success", funds: "1000",
+			setup: func(t *testing.T, a Account) {
+				for i := 0; i < int(config.FraudFailedLogins); i++ {
+					testLogin(t, a, "laptop", false, 2*time.Hour)
+				}
+				testLogin(t, a, "laptop", true, time.Hour)
+			},
+			kind: "deposit", amount: "10",
+		},
+	}
+
+	for _, tt := range tests {
+		for _, action := range []string{"allow", "hold", "block"} {
+			t.Run(tt.name+"/"+action, func(t *testing.T) {
+				openTestDB(t)
+				if _, err := config.DB.Exec("UPDATE fraud_rules SET action='allow'"); err != nil {
+					t.Fatal(err)
+				}
+				account := testAccount(t, "alice", "current", tt.funds)
+				if tt.setup != nil {
+					tt.setup(t, account)
+				}
+				if _, err := config.DB.Exec("UPDATE fraud_rules SET action=? WHERE code=?", action, tt.rule); err != nil {
+					t.Fatal(err)
+				}
+				account, err := getAccount(config.DB, account.Number)
+				if err != nil {
+					t.Fatal(err)
+				}
+				amount, err := money.Parse(tt.amount, account.Currency)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				tx, err := config.DB.Begin()
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = screenPayment(tx, payment{Kind: tt.kind, From: account, Amount: amount, Channel: "web"})
+				tx.Rollback()
+
+				want := "allow"
+				if tt.flagged {
+					want = action
+				}
+				var fe *fraudError
+				switch {
+				case want == "allow" && err != nil:
+					t.Fatalf("payment stopped: %v", err)
+				case want != "allow" && !errors.As(err, &fe):
+					t.Fatalf("got %v, want the payment to be %sed", err, want)
+				case want != "allow" && (fe.Decision != want || len(fe.Rules) != 1 || fe.Rules[0] != tt.rule):
+					t.Fatalf("decision %s by %v, want %s by %s", fe.Decision, fe.Rules, want, tt.rule)
+				}
+			})
+		}
+	}
+}
+
+func TestHeldPaymentIsRecordedWhenFundsCannotBeReserved(t *testing.T) {
+	openTestDB(t)
+	if _, err := config.DB.Exec("UPDATE fraud_rules SET action='allow'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.DB.Exec("UPDATE fraud_rules SET action='hold' WHERE code='deposit_then_withdraw'"); err != nil {
+		t.Fatal(err)
+	}
+	account := testAccount(t, "alice", "current", "1000")
+
+	// The payment is held, but the money is spent before the case is
+	// recorded, so there is nothing left to reserve
+	held := &fraudError{
+		bankError: bankError{Status: 202, Message: "held"},
+		Decision:  "hold",
+		Rules:     []string{"deposit_then_withdraw"},
+		Payment:   payment{Kind: "withdraw", From: account, Amount: money.New(90000, account.Currency), Channel: "web"},
+	}
+	testPosting(t, account, "withdraw", "1000")
+
+	if err := fraudCaseFor(held); err != held {
+		t.Fatalf("got %v, want the held payment error passed on", err)
+	}
+	var cases, holds int
+	config.DB.QueryRow("SELECT COUNT(*) FROM fraud_cases WHERE status='pending'").Scan(&cases)
+	config.DB.QueryRow("SELECT COUNT(*) FROM holds").Scan(&holds)
+	if cases != 1 || holds != 0 {
+		t.Fatalf("%d case(s) and %d hold(s) recorded, want 1 and 0", cases, holds)
+	}
+}
+
+func TestApprovingHeldPaymentMakesIt(t *testing.T) {
+	openTestDB(t)
+	if _, err := config.DB.Exec("UPDATE fraud_rules SET action='allow'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.DB.Exec("UPDATE fraud_rules SET action='hold' WHERE code='deposit_then_withdraw'"); err != nil {
+		t.Fatal(err)
+	}
+	account := testAccount(t, "alice", "current", "1000")
+	amount := money.New(90000, account.Currency)
+
+	var fe *fraudError
+	if err := withdrawFunds(account, amount, "web"); !errors.As(err, &fe) || fe.Decision != "hold" {
+		t.Fatalf("got %v, want the withdrawal held", err)
+	}
+	if a, _ := getAccount(config.DB, account.Number); a.Balance.Amount != 100000 || a.Available().Amount != 10000 {
+		t.Fatalf("balance %s with %s available, want the held amount reserved", a.Balance, a.Available())
+	}
+
+	var caseID string
+	if err := config.DB.QueryRow("SELECT case_id FROM fraud_cases WHERE status='pending'").Scan(&caseID); err != nil {
+		t.Fatal(err)
+	}
+	if err := approveFraudCase(caseID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := getAccount(config.DB, account.Number); a.Balance.Amount != 10000 || a.Available().Amount != 10000 {
+		t.Fatalf("balance %s with %s available after approval, want KES 100.00", a.Balance, a.Available())
+	}
+	if err := approveFraudCase(caseID, "admin"); err == nil {
+		t.Fatal("approved the same case twice")
+	}
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// FXRate is the price of one unit of Base in Quote
+type FXRate struct {
+	Base      string
+	Quote     string
+	Rate      int64
+	Source    string
+	UpdatedAt string
+}
+
+// Display the rate as a decimal
+func (r FXRate) Display() string {
+	return money.FormatExchangeRate(r.Rate)
+}
+
+// Look up the rate for converting from one currency to another. A rate
+// stored for the opposite direction is inverted.
+func exchangeRate(q querier, from, to string) (int64, error) {
+	var rate int64
+	err := q.QueryRow("SELECT rate FROM fx_rates WHERE base_currency=? AND quote_currency=?", from, to).Scan(&rate)
+	if err != sql.ErrNoRows {
+		return rate, err
+	}
+
+	err = q.QueryRow("SELECT rate FROM fx_rates WHERE base_currency=? AND quote_currency=?", to, from).Scan(&rate)
+	if err == sql.ErrNoRows {
+		return 0, &bankError{http.StatusBadRequest, fmt.Sprintf("No exchange rate available from %s to %s", from, to)}
+	} else if err != nil {
+		return 0, err
+	}
+	return money.InvertRate(rate), nil
+}
+
+// Check a currency pair can be given a rate
+func validCurrencyPair(base, quote string) error {
+	if !money.ValidCurrency(base) || !money.ValidCurrency(quote) || base == quote {
+		return &bankError{http.StatusBadRequest, "Invalid currency pair"}
+	}
+	return nil
+}
+
+// Store the rate for a currency pair inside tx, replacing any earlier one
+func setExchangeRate(tx *sql.Tx, base, quote string, rate int64, source string) error {
+	if err := validCurrencyPair(base, quote); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO fx_rates (base_currency, quote_currency, rate, source, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(base_currency, quote_currency) DO UPDATE SET rate=excluded.rate, source=excluded.source, updated_at=excluded.updated_at`,
+		base, quote, rate, source, time.Now().UTC().Format(dbTime))
+	return err
+}
+
+// ImportExchangeRates reads "base,quote,rate" lines, such as "USD,KES,129.45",
+// and stores every rate. Blank lines and lines starting with # are skipped.
+// The whole file is checked before anything is stored, so a bad line leaves
+// the existing rates as they were.
+func ImportExchangeRates(input io.Reader, source string) (int, error) {
+	reader := csv.NewReader(input)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return 0, &bankError{http.StatusBadRequest, "Invalid rates file: " + err.Error()}
+	}
+
+	rates := make([]FXRate, len(records))
+	for i, record := range records {
+		base, quote := strings.ToUpper(record[0]), strings.ToUpper(record[1])
+		if err := validCurrencyPair(base, quote); err != nil {
+			return 0, &bankError{http.StatusBadRequest, fmt.Sprintf("Invalid currency pair on line %d", i+1)}
+		}
+		rate, err := money.ParseExchangeRate(record[2])
+		if err != nil {
+			return 0, &bankError{http.StatusBadRequest, fmt.Sprintf("Invalid rate on line %d", i+1)}
+		}
+		rates[i] = FXRate{Base: base, Quote: quote, Rate: rate}
+	}
+
+	err = withTx(func(tx *sql.Tx) error {
+		for _, rate := range rates {
+			if err := setExchangeRate(tx, rate.Base, rate.Quote, rate.Rate, source); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(rates), nil
+}
+
+// Fetch every stored rate
+func getExchangeRates() ([]FXRate, error) {
+	rows, err := config.DB.Query("SELECT base_currency, quote_currency, rate, source, updated_at FROM fx_rates ORDER BY base_currency, quote_currency")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []FXRate
+	for rows.Next() {
+		var rate FXRate
+		var updatedAt time.Time
+		if err := rows.Scan(&rate.Base, &rate.Quote, &rate.Rate, &rate.Source, &updatedAt); err != nil {
+			return nil, err
+		}
+		rate.UpdatedAt = updatedAt.Format(dbTime)
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
+
+// AdminFXRates lists exchange rates with forms to change them
+func AdminFXRates(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	rates, err := getExchangeRates()
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/admin_fx_rates.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Rates":      rates,
+		"Currencies": money.Currencies(),
+		"SpreadBps":  config.FXSpreadBps,
+	})
+}
+
+// SetFXRate stores a rate entered by an admin
+func SetFXRate(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	rate, err := money.ParseExchangeRate(r.FormValue("rate"))
+	if err != nil {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid exchange rate")
+		return
+	}
+
+	err = withTx(func(tx *sql.Tx) error {
+		return setExchangeRate(tx, r.FormValue("base"), r.FormValue("quote"), rate, "admin:"+userID)
+	})
+	if err != nil {
+		adminError(w, r, err, "Failed to save exchange rate")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/fx-rates", http.StatusSeeOther)
+}
+
+// ImportFXRates stores the rates in an uploaded CSV file
+func ImportFXRates(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	file, _, err := r.FormFile("rates")
+	if err != nil {
+		ErrorPage(w, r, http.StatusBadRequest, "Please choose a rates file")
+		return
+	}
+	defer file.Close()
+
+	if _, err := ImportExchangeRates(file, "import:"+userID); err != nil {
+		adminError(w, r, err, "Failed to import exchange rates")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/fx-rates", http.StatusSeeOther)
+}
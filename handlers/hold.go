@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Hold reserves funds on an account until they are captured, released or
+// the hold expires
+type Hold struct {
+	ID            string      `json:"hold_id"`
+	UserID        string      `json:"-"`
+	AccountNumber string      `json:"account_number"`
+	Amount        money.Money `json:"amount"`
+	Captured      money.Money `json:"captured"`
+	Reason        string      `json:"reason"`
+	Reference     string      `json:"reference,omitempty"`
+	Status        string      `json:"status"`
+	ExpiresAt     time.Time   `json:"expires_at"`
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+// Remaining is the part of the hold still reserved
+func (h Hold) Remaining() money.Money {
+	return h.Amount.Sub(h.Captured)
+}
+
+const holdColumns = "hold_id, user_id, account_number, amount, captured, currency, reason, COALESCE(reference, ''), status, expires_at, created_at"
+
+// Read a hold selected with holdColumns
+func scanHold(row scanner) (Hold, error) {
+	var h Hold
+	err := row.Scan(&h.ID, &h.UserID, &h.AccountNumber, &h.Amount.Amount, &h.Captured.Amount, &h.Amount.Currency,
+		&h.Reason, &h.Reference, &h.Status, &h.ExpiresAt, &h.CreatedAt)
+	h.Captured.Currency = h.Amount.Currency
+	return h, err
+}
+
+// Reserve funds on an account. The hold reduces the available balance
+// straight away and lapses after config.HoldExpiry unless captured or
+// released first.
+func placeHold(tx *sql.Tx, account Account, amount money.Money, reason, reference string) (string, error) {
+	if err := checkDebit(account); err != nil {
+		return "", err
+	}
+	if err := ensureFunds(tx, account.Number, amount); err != nil {
+		return "", err
+	}
+
+	var ref interface{}
+	if reference != "" {
+		ref = reference
+	}
+	holdID := uuid.New().String()
+	now := time.Now().UTC()
+	_, err := tx.Exec(`
+		INSERT INTO holds (hold_id, user_id, account_number, amount, currency, reason, reference, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		holdID, account.UserID, account.Number, amount.Amount, amount.Currency, reason, ref,
+		now.Add(config.HoldExpiry).Format(dbTime), now.Format(dbTime))
+	if err != nil {
+		return "", err
+	}
+	return holdID, nil
+}
+
+// Fetch an active hold for update
+func activeHold(tx *sql.Tx, holdID string) (Hold, error) {
+	h, err := scanHold(tx.QueryRow("SELECT "+holdColumns+" FROM holds WHERE hold_id=?", holdID))
+	if err == sql.ErrNoRows {
+		return h, &bankError{http.StatusNotFound, "Hold not found"}
+	} else if err != nil {
+		return h, err
+	}
+	if h.Status != "active" {
+		return h, &bankError{http.StatusBadRequest, "Hold is already " + h.Status}
+	}
+	return h, nil
+}
+
+// Take some or all of a hold's reserved funds off the account once the
+// capture passes the fraud rules. With final set whatever is left of the
+// hold is released, otherwise it stays reserved for later captures.
+func captureHold(tx *sql.Tx, holdID string, amount money.Money, final bool) error {
+	h, err := activeHold(tx, holdID)
+	if err != nil {
+		return err
+	}
+	if amount.Currency != h.Amount.Currency || amount.Amount <= 0 || amount.Amount > h.Remaining().Amount {
+		return &bankError{http.StatusBadRequest, fmt.Sprintf("Capture must be between 0 and the %s still held", h.Remaining())}
+	}
+	account, err := getAccount(tx, h.AccountNumber)
+	if err != nil {
+		return err
+	}
+	if err := screenPayment(tx, payment{Kind: "capture", From: account, ToAccount: h.ID, Amount: amount, Channel: "admin"}); err != nil {
+		return err
+	}
+
+	err = postTransaction(tx, Posting{UserID: h.UserID, AccountNumber: h.AccountNumber, Type: "capture", Amount: amount, Reference: h.ID})
+	if err != nil {
+		return err
+	}
+
+	status := "active"
+	if final || amount.Amount == h.Remaining().Amount {
+		status = "captured"
+	}
+	return closeHold(tx, h.ID, status, amount.Amount)
+}
+
+// Give the funds reserved by a hold back to the account
+func releaseHold(tx *sql.Tx, holdID string) error {
+	if _, err := activeHold(tx, holdID); err != nil {
+		return err
+	}
+	return closeHold(tx, holdID, "released", 0)
+}
+
+// Release the active holds placed with a reference
+func releaseHoldsFor(tx *sql.Tx, reference string) error {
+	_, err := tx.Exec("UPDATE holds SET status='released', closed_at=? WHERE reference=? AND status='active'",
+		time.Now().UTC().Format(dbTime), reference)
+	return err
+}
+
+// Record a capture against a hold and move it to status
+func closeHold(tx *sql.Tx, holdID, status string, captured int64) error {
+	var closedAt interface{}
+	if status != "active" {
+		closedAt = time.Now().UTC().Format(dbTime)
+	}
+	_, err := tx.Exec("UPDATE holds SET captured=captured+?, status=?, closed_at=? WHERE hold_id=?", captured, status, closedAt, holdID)
+	return err
+}
+
+// expireHolds releases every hold that has passed its expiry time
+func expireHolds(tx *sql.Tx, now time.Time) (string, error) {
+	result, err := tx.Exec("UPDATE holds SET status='expired', closed_at=? WHERE status='active' AND expires_at <= ?",
+		now.Format(dbTime), now.Format(dbTime))
+	if err != nil {
+		return "", err
+	}
+	n, err := result.RowsAffected()
+	return fmt.Sprintf("expired %d hold(s)", n), err
+}
+
+// AdminHolds lists the active holds with forms to place, capture and
+// release them
+func AdminHolds(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	rows, err := config.DB.Query("SELECT " + holdColumns + " FROM holds WHERE status='active' ORDER BY id DESC")
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var holds []Hold
+	for rows.Next() {
+		h, err := scanHold(rows)
+		if err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		holds = append(holds, h)
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/admin_holds.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Holds":  holds,
+		"Expiry": config.HoldExpiry,
+	})
+}
+
+// PlaceHold reserves funds on any account
+func PlaceHold(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	account, err := getAccount(config.DB, r.FormValue("account_number"))
+	if err == sql.ErrNoRows {
+		ErrorPage(w, r, http.StatusNotFound, "Account not found")
+		return
+	} else if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	amount, err := amountFromRequest(r, account)
+	if err != nil {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid amount")
+		return
+	}
+
+	reason := r.FormValue("reason")
+	if reason == "" {
+		ErrorPage(w, r, http.StatusBadRequest, "A reason is required")
+		return
+	}
+
+	err = withTx(func(tx *sql.Tx) error {
+		_, err := placeHold(tx, account, amount, reason, r.FormValue("reference"))
+		return err
+	})
+	if err != nil {
+		adminError(w, r, err, "Failed to place hold")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/holds", http.StatusSeeOther)
+}
+
+// CaptureHold takes all or part of a hold's funds. A partial capture keeps
+// the rest reserved unless release_remaining is ticked.
+func CaptureHold(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	holdID := mux.Vars(r)["id"]
+	err := withTx(func(tx *sql.Tx) error {
+		h, err := activeHold(tx, holdID)
+		if err != nil {
+			return err
+		}
+		amount := h.Remaining()
+		if value := r.FormValue("amount"); value != "" {
+			if amount, err = money.Parse(value, h.Amount.Currency); err != nil {
+				return &bankError{http.StatusBadRequest, "Invalid amount"}
+			}
+		}
+		return captureHold(tx, holdID, amount, r.FormValue("release_remaining") == "on")
+	})
+	if err = fraudCaseFor(err); err != nil {
+		adminError(w, r, err, "Failed to capture hold")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/holds", http.StatusSeeOther)
+}
+
+// ReleaseHold frees a hold's reserved funds
+func ReleaseHold(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		return releaseHold(tx, mux.Vars(r)["id"])
+	})
+	if err != nil {
+		adminError(w, r, err, "Failed to release hold")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/holds", http.StatusSeeOther)
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// idempotencyRecorder passes a response through while keeping a copy of it
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Read the idempotency key from the Idempotency-Key header or the
+// idempotency_key form field
+func idempotencyKey(r *http.Request) string {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	return r.FormValue("idempotency_key")
+}
+
+// The user a request is made by: the one APIAuth found for API requests,
+// which may have come from a token, or else the session's
+func requestUserID(r *http.Request) (string, error) {
+	if userID := apiUserID(r); userID != "" {
+		return userID, nil
+	}
+	return getUserIDFromSession(r)
+}
+
+// Fingerprint a request by its method, path and body, so a key reused for
+// a different request can be told apart from a retry
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Claim an idempotency key for a request. Reports false if the key is
+// already held, unless the request holding it has not finished within
+// config.IdempotencyLease and the same request may take it over.
+func claimIdempotencyKey(userID, path, key, hash string, now time.Time) (bool, error) {
+	_, err := config.DB.Exec("INSERT INTO idempotency_keys (user_id, path, idempotency_key, request_hash, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, path, key, hash, now.Format(dbTime))
+	sqliteErr, ok := err.(sqlite3.Error)
+	if !ok || sqliteErr.ExtendedCode != sqlite3.ErrConstraintPrimaryKey {
+		return err == nil, err
+	}
+
+	result, err := config.DB.Exec(`
+		UPDATE idempotency_keys SET created_at=?
+		WHERE user_id=? AND path=? AND idempotency_key=? AND status_code=0 AND created_at < ? AND COALESCE(request_hash, ?)=?`,
+		now.Format(dbTime), userID, path, key, now.Add(-config.IdempotencyLease).Format(dbTime), hash, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// Idempotent makes a money-moving handler safe to retry. The first request
+// with a given key runs the handler and stores its response; later requests
+// from the same user to the same endpoint with that key get the stored
+// response replayed instead of moving money again. Reusing a key for a
+// different request is refused. Requests without a key are passed straight
+// through.
+func Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		key := idempotencyKey(r)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		userID, err := requestUserID(r)
+		if key == "" || err != nil || userID == "" {
+			next(w, r)
+			return
+		}
+
+		now := time.Now().UTC()
+		config.DB.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", now.Add(-config.IdempotencyRetention).Format(dbTime))
+
+		hash := requestHash(r, body)
+		claimed, err := claimIdempotencyKey(userID, r.URL.Path, key, hash, now)
+		if err != nil {
+			ErrorPageTrans(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if !claimed {
+			replayIdempotent(w, r, userID, key, hash)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		// Server errors are not remembered so that the retry can succeed
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			config.DB.Exec("DELETE FROM idempotency_keys WHERE user_id=? AND path=? AND idempotency_key=?", userID, r.URL.Path, key)
+			return
+		}
+
+		config.DB.Exec(`
+			UPDATE idempotency_keys SET status_code=?, location=?, content_type=?, body=?
+			WHERE user_id=? AND path=? AND idempotency_key=?`,
+			rec.status, w.Header().Get("Location"), w.Header().Get("Content-Type"), rec.body.Bytes(),
+			userID, r.URL.Path, key)
+	}
+}
+
+// Write out the response stored for an idempotency key
+func replayIdempotent(w http.ResponseWriter, r *http.Request, userID, key, hash string) {
+	var status int
+	var location, contentType, storedHash string
+	var body []byte
+	err := config.DB.QueryRow(`
+		SELECT status_code, COALESCE(location, ''), COALESCE(content_type, ''), body, COALESCE(request_hash, ?)
+		FROM idempotency_keys WHERE user_id=? AND path=? AND idempotency_key=?`,
+		hash, userID, r.URL.Path, key).Scan(&status, &location, &contentType, &body, &storedHash)
+	if err == sql.ErrNoRows {
+		// The original request failed and released the key in the meantime
+		ErrorPageTrans(w, r, http.StatusConflict, "Request is being retried, please check your balance before trying again")
+		return
+	} else if err != nil {
+		ErrorPageTrans(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	if storedHash != hash {
+		ErrorPageTrans(w, r, http.StatusUnprocessableEntity, "This idempotency key was already used for a different request")
+		return
+	}
+	if status == 0 {
+		ErrorPageTrans(w, r, http.StatusConflict, "This request is already being processed")
+		return
+	}
+
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"Bank-Management-System/money"
+	"database/sql"
+	"time"
+)
+
+// dbDate is the layout of accrual dates
+const dbDate = "2006-01-02"
+
+// Record one day of interest on an account. Returns false if that day was
+// already accrued, so a job may run several times a day.
+func accrueInterest(tx *sql.Tx, accountNumber, kind string, day time.Time, balance money.Money, rateBps int64) (bool, error) {
+	interest := balance.Interest(rateBps, 1)
+	result, err := tx.Exec(`
+		INSERT OR IGNORE INTO interest_accruals (account_number, kind, accrual_date, balance, rate_bps, amount)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		accountNumber, kind, day.Format(dbDate), balance.Amount, rateBps, interest.Amount)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// An account's ledger balance at the start of a day
+func balanceAt(tx *sql.Tx, accountNumber string, day time.Time) (int64, error) {
+	var balance int64
+	err := tx.QueryRow("SELECT COALESCE(SUM("+signedAmount+"), 0) FROM transactions WHERE account_number=? AND (created_at IS NULL OR created_at < ?)",
+		accountNumber, day.Format(dbTime)).Scan(&balance)
+	return balance, err
+}
+
+// The days an account has yet to accrue interest of a kind for, from the
+// day after it last accrued up to and including today, oldest first. An
+// account accruing for the first time starts today.
+func accrualDays(tx *sql.Tx, accountNumber, kind string, today time.Time) ([]time.Time, error) {
+	var last time.Time
+	err := tx.QueryRow("SELECT last_accrued_on FROM accrual_positions WHERE account_number=? AND kind=?", accountNumber, kind).Scan(&last)
+	if err == sql.ErrNoRows {
+		return []time.Time{today}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var days []time.Time
+	for day := startOfDay(last).AddDate(0, 0, 1); !day.After(today); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// Accrue interest of a kind on an account for every day it has yet to,
+// up to today, so days the scheduler did not run are not lost. Each day
+// earns on the ledger balance at its start; rate gives the balance interest
+// is worked out on for that ledger balance and the annual rate, and nothing
+// accrues on days it gives a zero for either. Returns the number of days
+// accrued.
+func accrueDays(tx *sql.Tx, accountNumber, currency, kind string, today time.Time, rate func(balance int64) (int64, int64, error)) (int, error) {
+	days, err := accrualDays(tx, accountNumber, kind, today)
+	if err != nil || len(days) == 0 {
+		return 0, err
+	}
+
+	accrued := 0
+	for _, day := range days {
+		balance, err := balanceAt(tx, accountNumber, day)
+		if err != nil {
+			return accrued, err
+		}
+		base, rateBps, err := rate(balance)
+		if err != nil {
+			return accrued, err
+		}
+		if base <= 0 || rateBps == 0 {
+			continue
+		}
+		added, err := accrueInterest(tx, accountNumber, kind, day, money.New(base, currency), rateBps)
+		if err != nil {
+			return accrued, err
+		}
+		if added {
+			accrued++
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO accrual_positions (account_number, kind, last_accrued_on) VALUES (?, ?, ?)
+		ON CONFLICT(account_number, kind) DO UPDATE SET last_accrued_on=excluded.last_accrued_on`,
+		accountNumber, kind, today.Format(dbDate))
+	return accrued, err
+}
+
+// Post the interest accrued before the given date as one ledger entry per
+// account and mark those accruals as posted. Returns the number of accounts
+// posted to.
+func capitalizeInterest(tx *sql.Tx, kind, postingType string, before time.Time) (int, error) {
+	rows, err := tx.Query(`
+		SELECT i.account_number, a.user_id, a.currency, SUM(i.amount)
+		FROM interest_accruals i JOIN accounts a ON a.account_number = i.account_number
+		WHERE i.kind=? AND i.posted_at IS NULL AND i.accrual_date < ?
+		GROUP BY i.account_number, a.user_id, a.currency`, kind, before.Format(dbDate))
+	if err != nil {
+		return 0, err
+	}
+
+	var postings []Posting
+	for rows.Next() {
+		var p Posting
+		var amount int64
+		if err := rows.Scan(&p.AccountNumber, &p.UserID, &p.Amount.Currency, &amount); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		p.Type = postingType
+		p.Amount.Amount = amount
+		postings = append(postings, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	posted := 0
+	now := time.Now().UTC().Format(dbTime)
+	for _, p := range postings {
+		if p.Amount.Amount > 0 {
+			if err := postTransaction(tx, p); err != nil {
+				return posted, err
+			}
+			posted++
+		}
+		_, err := tx.Exec("UPDATE interest_accruals SET posted_at=? WHERE account_number=? AND kind=? AND posted_at IS NULL AND accrual_date < ?",
+			now, p.AccountNumber, kind, before.Format(dbDate))
+		if err != nil {
+			return posted, err
+		}
+	}
+	return posted, nil
+}
+
+// Midnight at the start of the day containing t
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// The same day n months after t, or the last day of the month when that
+// month is too short
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, 0, 0, 0, 0, time.UTC)
+	day := t.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// The first day of the month containing t
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
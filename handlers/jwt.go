@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// jwtClaims are the claims in the access and ID tokens the bank issues
+type jwtClaims struct {
+	Issuer            string `json:"iss"`
+	Subject           string `json:"sub"`
+	Audience          string `json:"aud"`
+	ExpiresAt         int64  `json:"exp"`
+	IssuedAt          int64  `json:"iat"`
+	ID                string `json:"jti,omitempty"`
+	ClientID          string `json:"client_id,omitempty"`
+	GrantID           string `json:"grant_id,omitempty"`
+	Scope             string `json:"scope,omitempty"`
+	Nonce             string `json:"nonce,omitempty"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+}
+
+// signingKey is an RSA key tokens are signed with, named by its key ID
+type signingKey struct {
+	ID  string
+	Key *rsa.PrivateKey
+}
+
+// Keys loaded from oauth_keys, newest last. They are created on first use
+// and kept so tokens signed before a restart still verify.
+var (
+	signingKeysMu sync.Mutex
+	signingKeys   []signingKey
+)
+
+// Load the signing keys, creating the first one if there are none yet
+func loadSigningKeys() ([]signingKey, error) {
+	signingKeysMu.Lock()
+	defer signingKeysMu.Unlock()
+	if len(signingKeys) > 0 {
+		return signingKeys, nil
+	}
+
+	rows, err := config.DB.Query("SELECT kid, private_key FROM oauth_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []signingKey
+	for rows.Next() {
+		var kid, encoded string
+		if err := rows.Scan(&kid, &encoded); err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode([]byte(encoded))
+		if block == nil {
+			return nil, errors.New("invalid signing key " + kid)
+		}
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, signingKey{kid, key})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		kid := uuid.New().String()
+		encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		_, err = config.DB.Exec("INSERT INTO oauth_keys (kid, private_key, created_at) VALUES (?, ?, ?)",
+			kid, string(encoded), time.Now().UTC().Format(dbTime))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, signingKey{kid, key})
+	}
+
+	signingKeys = keys
+	return keys, nil
+}
+
+// Sign claims as an RS256 JSON Web Token with the newest key
+func signJWT(claims jwtClaims) (string, error) {
+	keys, err := loadSigningKeys()
+	if err != nil {
+		return "", err
+	}
+	key := keys[len(keys)-1]
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": key.ID})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// errInvalidJWT covers every way a token can fail to verify, so callers
+// cannot tell a forged token from an expired one
+var errInvalidJWT = errors.New("invalid token")
+
+// Verify a token the bank signed for audience and return its claims
+func parseJWT(token, audience string) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errInvalidJWT
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil || header.Alg != "RS256" {
+		return claims, errInvalidJWT
+	}
+
+	keys, err := loadSigningKeys()
+	if err != nil {
+		return claims, err
+	}
+	var key *rsa.PublicKey
+	for _, k := range keys {
+		if k.ID == header.Kid {
+			key = &k.Key.PublicKey
+		}
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if key == nil || err != nil {
+		return claims, errInvalidJWT
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+		return claims, errInvalidJWT
+	}
+
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(data, &claims) != nil {
+		return claims, errInvalidJWT
+	}
+	if claims.Issuer != config.OAuthIssuer || claims.Audience != audience || time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errInvalidJWT
+	}
+	return claims, nil
+}
+
+// The public halves of the signing keys as a JSON Web Key Set
+func jwks() (map[string]interface{}, error) {
+	keys, err := loadSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	var set []map[string]string
+	for _, k := range keys {
+		public := k.Key.PublicKey
+		set = append(set, map[string]string{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": k.ID,
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		})
+	}
+	return map[string]interface{}{"keys": set}, nil
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Transaction types that add to an account's balance; every other type is a debit
+var creditTypes = []string{"deposit", "transfer_in", "interest", "term_deposit_release", "loan_disbursement"}
+
+// signedAmount is the SQL expression giving a transaction's effect on the
+// account balance
+var signedAmount = "CASE WHEN type IN ('" + strings.Join(creditTypes, "', '") + "') THEN amount ELSE -amount END"
+
+// dbTime is the layout SQLite's CURRENT_TIMESTAMP uses, so stored times
+// compare correctly with it and work with SQLite's date functions.
+const dbTime = "2006-01-02 15:04:05"
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// bankError is a business rule failure that is safe to show to the user
+type bankError struct {
+	Status  int
+	Message string
+}
+
+func (e *bankError) Error() string {
+	return e.Message
+}
+
+// Report err on the transaction error page, showing fallback instead of
+// the details of anything that is not a bankError
+func transactionError(w http.ResponseWriter, r *http.Request, err error, fallback string) {
+	if fe, ok := err.(*fraudError); ok {
+		err = &fe.bankError
+	}
+	if be, ok := err.(*bankError); ok {
+		ErrorPageTrans(w, r, be.Status, be.Message)
+		return
+	}
+	ErrorPageTrans(w, r, http.StatusInternalServerError, fallback)
+}
+
+// Posting is a single ledger entry against an account
+type Posting struct {
+	UserID        string
+	AccountNumber string
+	Type          string
+	Amount        money.Money
+	Reference     string
+
+	// Where a customer initiated the posting from, such as "web"
+	Channel string
+
+	// Set on the credit leg of a cross-currency transfer: the amount that
+	// was sent and the exchange rate it was converted at
+	OriginalAmount money.Money
+	FXRate         int64
+}
+
+// Report whether a transaction type adds to the balance
+func isCredit(transactionType string) bool {
+	for _, t := range creditTypes {
+		if t == transactionType {
+			return true
+		}
+	}
+	return false
+}
+
+// Get an account's ledger balance using the given connection or transaction
+func accountBalance(q querier, accountNumber string) (int64, error) {
+	var balance int64
+	err := q.QueryRow("SELECT COALESCE((SELECT balance FROM balances WHERE account_number=?), 0)", accountNumber).Scan(&balance)
+	return balance, err
+}
+
+// heldColumn is the SQL expression for the funds reserved by active holds
+// on the account aliased a
+const heldColumn = "COALESCE((SELECT SUM(h.amount - h.captured) FROM holds h WHERE h.account_number = a.account_number AND h.status = 'active'), 0)"
+
+// Get what can still be spent from an account: its balance plus any
+// approved overdraft limit, less funds reserved by holds
+func availableBalance(q querier, accountNumber string) (int64, error) {
+	var available int64
+	err := q.QueryRow(`
+		SELECT COALESCE((SELECT balance FROM balances WHERE account_number=?), 0) + a.overdraft_limit - `+heldColumn+`
+		FROM accounts a WHERE a.account_number=?`, accountNumber, accountNumber).Scan(&available)
+	return available, err
+}
+
+// Get the part of an account's balance that is not reserved by holds,
+// ignoring any overdraft
+func freeBalance(q querier, accountNumber string) (int64, error) {
+	var free int64
+	err := q.QueryRow(`
+		SELECT COALESCE((SELECT balance FROM balances WHERE account_number=?), 0) - `+heldColumn+`
+		FROM accounts a WHERE a.account_number=?`, accountNumber, accountNumber).Scan(&free)
+	return free, err
+}
+
+// Make sure a debit of amount is covered by the account's available balance
+func ensureFunds(tx *sql.Tx, accountNumber string, amount money.Money) error {
+	available, err := availableBalance(tx, accountNumber)
+	if err != nil {
+		return err
+	}
+	if available < amount.Amount {
+		return &bankError{http.StatusBadRequest, "Insufficient funds"}
+	}
+	return nil
+}
+
+// Sum an account's ledger entries, ignoring the materialized balance
+func ledgerBalance(q querier, accountNumber string) (int64, error) {
+	var balance int64
+	err := q.QueryRow("SELECT COALESCE(SUM("+signedAmount+"), 0) FROM transactions WHERE account_number=?", accountNumber).Scan(&balance)
+	return balance, err
+}
+
+// Overwrite an account's materialized balance with the sum of its ledger
+func recomputeBalance(tx *sql.Tx, accountNumber string) error {
+	balance, err := ledgerBalance(tx, accountNumber)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO balances (account_number, balance, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(account_number) DO UPDATE SET balance=excluded.balance, updated_at=excluded.updated_at`,
+		accountNumber, balance, time.Now().UTC().Format(dbTime))
+	return err
+}
+
+// Write a posting to the ledger and apply it to the account's balance.
+// Both happen inside tx so the balance can never disagree with the ledger.
+// A credit then goes towards any installments its owner has overdue.
+func postTransaction(tx *sql.Tx, p Posting) error {
+	var reference, channel, originalAmount, originalCurrency, fxRate interface{}
+	if p.Reference != "" {
+		reference = p.Reference
+	}
+	if p.Channel != "" {
+		channel = p.Channel
+	}
+	if p.OriginalAmount.Currency != "" {
+		originalAmount, originalCurrency, fxRate = p.OriginalAmount.Amount, p.OriginalAmount.Currency, p.FXRate
+	}
+	now := time.Now().UTC().Format(dbTime)
+
+	result, err := tx.Exec(`
+		INSERT INTO transactions (user_id, account_number, type, amount, currency, original_amount, original_currency, fx_rate, reference, channel, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.UserID, p.AccountNumber, p.Type, p.Amount.Amount, p.Amount.Currency, originalAmount, originalCurrency, fxRate, reference, channel, now)
+	if err != nil {
+		return err
+	}
+
+	delta := -p.Amount.Amount
+	if isCredit(p.Type) {
+		delta = p.Amount.Amount
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO balances (account_number, balance, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(account_number) DO UPDATE SET balance=balance+excluded.balance, updated_at=excluded.updated_at`,
+		p.AccountNumber, delta, now)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	balance := money.Money{Currency: p.Amount.Currency}
+	if err := tx.QueryRow("SELECT balance FROM balances WHERE account_number=?", p.AccountNumber).Scan(&balance.Amount); err != nil {
+		return err
+	}
+	err = publishEvent(tx, "transaction.posted", map[string]interface{}{
+		"id":             id,
+		"account_number": p.AccountNumber,
+		"type":           p.Type,
+		"amount":         p.Amount,
+		"balance":        balance,
+		"reference":      p.Reference,
+		"channel":        p.Channel,
+		"created_at":     now,
+	})
+	if err != nil || !isCredit(p.Type) || p.Type == "loan_disbursement" {
+		return err
+	}
+
+	// Money landing on a customer's account first clears their arrears,
+	// whether it is a deposit, a transfer or interest. A new loan is paid
+	// out in full.
+	_, err = collectArrears(tx, p.UserID, time.Now().UTC())
+	return err
+}
+
+// Run fn inside a database transaction, committing only if it succeeds
+func withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Run fn inside a savepoint of tx. If fn fails only its own changes are
+// undone and the rest of tx carries on.
+func withSavepoint(tx *sql.Tx, name string, fn func() error) error {
+	if _, err := tx.Exec("SAVEPOINT " + name); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		tx.Exec("ROLLBACK TO " + name)
+		tx.Exec("RELEASE " + name)
+		return err
+	}
+	_, err := tx.Exec("RELEASE " + name)
+	return err
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Channels customers move money through
+var channels = map[string]bool{
+	"api":            true,
+	"web":            true,
+	"standing_order": true,
+}
+
+// Account types limits are kept for: those customers can open and the loan
+// accounts some customers opened before that was stopped
+var limitAccountTypes = map[string]bool{
+	"current": true,
+	"savings": true,
+	"loan":    true,
+}
+
+// The keys of a set in alphabetical order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Transaction types that count towards a limit
+var limitedTypes = []string{"withdraw", "transfer_out"}
+
+// TransactionLimit caps the money leaving accounts of one type and currency
+// through a channel. A zero amount or count means no cap.
+type TransactionLimit struct {
+	AccountType    string
+	Channel        string
+	PerTransaction money.Money
+	Daily          money.Money
+	Monthly        money.Money
+	DailyCount     int
+	MonthlyCount   int
+}
+
+// Look up the limit that applies to an account on a channel
+func getTransactionLimit(q querier, accountType, channel, currency string) (TransactionLimit, bool, error) {
+	l := TransactionLimit{AccountType: accountType, Channel: channel}
+	err := q.QueryRow(`
+		SELECT per_transaction, daily_amount, monthly_amount, daily_count, monthly_count
+		FROM transaction_limits WHERE account_type=? AND channel=? AND currency=?`, accountType, channel, currency).
+		Scan(&l.PerTransaction.Amount, &l.Daily.Amount, &l.Monthly.Amount, &l.DailyCount, &l.MonthlyCount)
+	l.PerTransaction.Currency, l.Daily.Currency, l.Monthly.Currency = currency, currency, currency
+	if err == sql.ErrNoRows {
+		return l, false, nil
+	}
+	return l, err == nil, err
+}
+
+// Total and count of an account's limited debits through any channel since
+// a time
+func limitUsage(tx *sql.Tx, accountNumber string, since time.Time) (int64, int, error) {
+	var total int64
+	var count int
+	err := tx.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0), COUNT(*) FROM transactions
+		WHERE account_number=? AND created_at >= ? AND type IN ('`+strings.Join(limitedTypes, "', '")+`')`,
+		accountNumber, since.Format(dbTime)).Scan(&total, &count)
+	return total, count, err
+}
+
+// Make sure a debit of amount from an account through a channel stays
+// within the limits for the account's type on that channel. Daily and
+// monthly caps count what the account has paid out through every channel,
+// so moving to another channel does not reset them. Debits through a
+// channel that is not known, or with no limit set for the account's type
+// and currency, are refused. The error says how much of the limit is left.
+func checkLimits(tx *sql.Tx, account Account, amount money.Money, channel string) error {
+	if !channels[channel] {
+		return &bankError{http.StatusForbidden, "Payments cannot be made through this channel"}
+	}
+	l, ok, err := getTransactionLimit(tx, account.Type, channel, account.Currency)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &bankError{http.StatusForbidden, "No payment limits are set for this account. Please contact the bank."}
+	}
+
+	if l.PerTransaction.Amount > 0 && amount.Amount > l.PerTransaction.Amount {
+		return &bankError{http.StatusBadRequest, fmt.Sprintf("Amount exceeds the limit of %s per transaction", l.PerTransaction)}
+	}
+
+	now := time.Now().UTC()
+	windows := []struct {
+		name  string
+		since time.Time
+		cap   money.Money
+		count int
+	}{
+		{"today", startOfDay(now), l.Daily, l.DailyCount},
+		{"this month", startOfMonth(now), l.Monthly, l.MonthlyCount},
+	}
+	for _, w := range windows {
+		if w.cap.Amount == 0 && w.count == 0 {
+			continue
+		}
+		used, count, err := limitUsage(tx, account.Number, w.since)
+		if err != nil {
+			return err
+		}
+		if w.count > 0 && count >= w.count {
+			return &bankError{http.StatusBadRequest, fmt.Sprintf("You have reached the limit of %d transactions %s", w.count, w.name)}
+		}
+		if w.cap.Amount > 0 && used+amount.Amount > w.cap.Amount {
+			remaining := money.New(w.cap.Amount-used, w.cap.Currency)
+			if remaining.Amount < 0 {
+				remaining.Amount = 0
+			}
+			return &bankError{http.StatusBadRequest, fmt.Sprintf("Amount exceeds your limit: %s remaining %s", remaining, w.name)}
+		}
+	}
+	return nil
+}
+
+// AdminLimits lists the transaction limits with a form to change them
+func AdminLimits(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT account_type, channel, currency, per_transaction, daily_amount, monthly_amount, daily_count, monthly_count
+		FROM transaction_limits ORDER BY currency, account_type, channel`)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var limits []TransactionLimit
+	for rows.Next() {
+		var l TransactionLimit
+		var currency string
+		err := rows.Scan(&l.AccountType, &l.Channel, &currency, &l.PerTransaction.Amount, &l.Daily.Amount, &l.Monthly.Amount, &l.DailyCount, &l.MonthlyCount)
+		if err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		l.PerTransaction.Currency, l.Daily.Currency, l.Monthly.Currency = currency, currency, currency
+		limits = append(limits, l)
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/admin_limits.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Limits":       limits,
+		"AccountTypes": sortedKeys(limitAccountTypes),
+		"Channels":     sortedKeys(channels),
+		"Currencies":   money.Currencies(),
+	})
+}
+
+// SetLimits creates or replaces the limits for an account type, channel
+// and currency. Blank fields mean no cap.
+func SetLimits(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	accountType, channel, currency := r.FormValue("account_type"), r.FormValue("channel"), r.FormValue("currency")
+	if !limitAccountTypes[accountType] || !channels[channel] || !money.ValidCurrency(currency) {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid account type, channel or currency")
+		return
+	}
+
+	var amounts [3]int64
+	for i, field := range []string{"per_transaction", "daily_amount", "monthly_amount"} {
+		if value := r.FormValue(field); value != "" {
+			m, err := money.Parse(value, currency)
+			if err != nil || m.Amount < 0 {
+				ErrorPage(w, r, http.StatusBadRequest, "Invalid limit amount")
+				return
+			}
+			amounts[i] = m.Amount
+		}
+	}
+
+	var counts [2]int
+	for i, field := range []string{"daily_count", "monthly_count"} {
+		if value := r.FormValue(field); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				ErrorPage(w, r, http.StatusBadRequest, "Invalid transaction count")
+				return
+			}
+			counts[i] = n
+		}
+	}
+
+	_, err := config.DB.Exec(`
+		INSERT INTO transaction_limits (account_type, channel, currency, per_transaction, daily_amount, monthly_amount, daily_count, monthly_count)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(account_type, channel, currency) DO UPDATE SET
+			per_transaction=excluded.per_transaction, daily_amount=excluded.daily_amount, monthly_amount=excluded.monthly_amount,
+			daily_count=excluded.daily_count, monthly_count=excluded.monthly_count`,
+		accountType, channel, currency, amounts[0], amounts[1], amounts[2], counts[0], counts[1])
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Failed to save limits")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/limits", http.StatusSeeOther)
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestWithdrawalLimitsInEveryCurrency(t *testing.T) {
+	openTestDB(t)
+	if _, err := config.DB.Exec("UPDATE fraud_rules SET action='allow'"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		accountType string
+		currency    string
+		amount      string
+		status      int
+	}{
+		{"usd within the cap", "current", "USD", "500", 0},
+		{"usd over the per transaction cap", "current", "USD", "1500", http.StatusBadRequest},
+		{"ugx over the per transaction cap", "current", "UGX", "5,000,000", http.StatusBadRequest},
+		{"eur savings over the cap", "savings", "EUR", "500", http.StatusBadRequest},
+		{"gbp within the cap", "savings", "GBP", "100", 0},
+		{"kes over the cap", "current", "KES", "200,000", http.StatusBadRequest},
+		{"loan account over the cap", "loan", "KES", "60,000", http.StatusBadRequest},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			account := testAccountIn(t, fmt.Sprintf("customer%d", i), tt.accountType, tt.currency, "10,000,000")
+			amount, err := money.Parse(tt.amount, tt.currency)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = withdrawFunds(account, amount, "web")
+			var be *bankError
+			switch {
+			case tt.status == 0 && err != nil:
+				t.Fatalf("withdrawal of %s refused: %v", amount, err)
+			case tt.status != 0 && (!errors.As(err, &be) || be.Status != tt.status):
+				t.Fatalf("withdrawal of %s: got %v, want status %d", amount, err, tt.status)
+			}
+		})
+	}
+}
+
+func TestDebitWithoutLimitsIsRefused(t *testing.T) {
+	openTestDB(t)
+	if _, err := config.DB.Exec("UPDATE fraud_rules SET action='allow'"); err != nil {
+		t.Fatal(err)
+	}
+	account := testAccountIn(t, "alice", "current", "USD", "100")
+	if _, err := config.DB.Exec("DELETE FROM transaction_limits WHERE currency='USD'"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		return postWithdrawal(tx, account, money.New(100, "USD"), "web", "")
+	})
+	var be *bankError
+	if !errors.As(err, &be) || be.Status != http.StatusForbidden {
+		t.Fatalf("got %v, want a refusal", err)
+	}
+
+	err = withTx(func(tx *sql.Tx) error {
+		return postWithdrawal(tx, account, money.New(100, "USD"), "branch", "")
+	})
+	if !errors.As(err, &be) || be.Status != http.StatusForbidden {
+		t.Fatalf("unknown channel: got %v, want a refusal", err)
+	}
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"Bank-Management-System/config"
+	"Bank-Management-System/money"
 	"html/template"
 	"net/http"
 	"strconv"
@@ -9,6 +10,72 @@ import (
 	"github.com/google/uuid"
 )
 
+// Loan is a customer's loan with what is still owed on it
+type Loan struct {
+	LoanID          string      `json:"loan_id"`
+	UserID          string      `json:"-"`
+	Borrower        string      `json:"-"`
+	Amount          money.Money `json:"amount"`
+	Outstanding     money.Money `json:"outstanding"`
+	Arrears         money.Money `json:"arrears"`
+	RateBps         int64       `json:"interest_rate_bps"`
+	RepaymentPeriod int         `json:"repayment_period"`
+	Status          string      `json:"status"`
+	CreatedAt       string      `json:"created_at"`
+}
+
+// InterestRate formats the loan's annual rate as a percentage
+func (l Loan) InterestRate() string {
+	return money.FormatRate(l.RateBps)
+}
+
+// TotalInterest is the flat interest charged over the whole repayment period
+func (l Loan) TotalInterest() money.Money {
+	return l.Amount.MulRatio(l.RateBps*int64(l.RepaymentPeriod), 10000*12)
+}
+
+// Columns read by scanLoan, qualified with the loans table alias l. Arrears
+// are the unpaid parts of installments that have fallen due.
+const loanColumns = `l.loan_id, l.user_id, u.user_name, l.amount, COALESCE(l.outstanding, l.amount), l.currency, l.interest_rate_bps, l.repayment_period, l.status, l.created_at,
+	(SELECT COALESCE(SUM(i.amount_due - i.amount_paid), 0) FROM loan_installments i WHERE i.loan_id = l.loan_id AND i.due_date <= DATE('now'))`
+
+// Read a loan selected with loanColumns
+func scanLoan(row scanner) (Loan, error) {
+	var l Loan
+	var currency string
+	err := row.Scan(&l.LoanID, &l.UserID, &l.Borrower, &l.Amount.Amount, &l.Outstanding.Amount, &currency, &l.RateBps,
+		&l.RepaymentPeriod, &l.Status, &l.CreatedAt, &l.Arrears.Amount)
+	l.Amount.Currency, l.Outstanding.Currency, l.Arrears.Currency = currency, currency, currency
+	return l, err
+}
+
+// Fetch the loans matching a condition on the loans table l
+func getLoans(where string, args ...interface{}) ([]Loan, error) {
+	rows, err := config.DB.Query("SELECT "+loanColumns+" FROM loans l JOIN users u ON u.user_id = l.user_id WHERE "+where+" ORDER BY l.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var loans []Loan
+	for rows.Next() {
+		l, err := scanLoan(rows)
+		if err != nil {
+			return nil, err
+		}
+		loans = append(loans, l)
+	}
+	return loans, rows.Err()
+}
+
+// Record a loan application for an admin to approve. Returns the new loan's ID.
+func applyForLoan(userID string, amount money.Money, rateBps int64, repaymentPeriod int) (string, error) {
+	loanID := uuid.New().String()
+	_, err := config.DB.Exec("INSERT INTO loans (user_id, loan_id, amount, outstanding, currency, interest_rate_bps, repayment_period, status) VALUES (?, ?, ?, ?, ?, ?, ?, 'pending')",
+		userID, loanID, amount.Amount, amount.Amount, amount.Currency, rateBps, repaymentPeriod)
+	return loanID, err
+}
+
 // LoanPage renders the loan application form
 func LoanPage(w http.ResponseWriter, r *http.Request) {
 	if !isAuthenticated(r) {
@@ -17,7 +84,9 @@ func LoanPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tmpl := template.Must(template.ParseFiles("templates/loan.html"))
-	tmpl.Execute(w, nil)
+	tmpl.Execute(w, map[string]interface{}{
+		"IdempotencyKey": uuid.New().String(),
+	})
 }
 
 // ApplyLoan allows users to request a loan
@@ -33,14 +102,14 @@ func ApplyLoan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	amount, err := strconv.Atoi(r.FormValue("amount"))
-	if err != nil || amount <= 0 {
+	amount, err := money.Parse(r.FormValue("amount"), money.DefaultCurrency)
+	if err != nil || amount.Amount <= 0 {
 		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid loan amount")
 		return
 	}
 
-	interestRate, err := strconv.ParseFloat(r.FormValue("interest_rate"), 64)
-	if err != nil || interestRate < 0 {
+	interestRate, err := money.ParseRate(r.FormValue("interest_rate"))
+	if err != nil {
 		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid interest rate")
 		return
 	}
@@ -51,17 +120,7 @@ func ApplyLoan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	loanID := uuid.New().String()
-
-	stmt, err := config.DB.Prepare("INSERT INTO loans (user_id, loan_id, amount, interest_rate, repayment_period, status) VALUES (?, ?, ?, ?, ?, 'pending')")
-	if err != nil {
-		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
-		return
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(userID, loanID, amount, interestRate, repaymentPeriod)
-	if err != nil {
+	if _, err := applyForLoan(userID, amount, interestRate, repaymentPeriod); err != nil {
 		ErrorPage(w, r, http.StatusInternalServerError, "Failed to apply for loan")
 		return
 	}
@@ -82,36 +141,29 @@ func ViewLoans(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := config.DB.Query("SELECT loan_id, amount, interest_rate, repayment_period, status, created_at FROM loans WHERE user_id=?", userID)
+	loans, err := getLoans("l.user_id=?", userID)
 	if err != nil {
 		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
 		return
 	}
-	defer rows.Close()
 
-	var loans []map[string]interface{}
-	for rows.Next() {
-		var loanID, status, createdAt string
-		var amount int
-		var interestRate float64
-		var repaymentPeriod int
-
-		err := rows.Scan(&loanID, &amount, &interestRate, &repaymentPeriod, &status, &createdAt)
-		if err != nil {
-			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
-			return
-		}
+	accounts, err := getUserAccounts(userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
 
-		loans = append(loans, map[string]interface{}{
-			"LoanID":          loanID,
-			"Amount":          amount,
-			"InterestRate":    interestRate,
-			"RepaymentPeriod": repaymentPeriod,
-			"Status":          status,
-			"CreatedAt":       createdAt,
-		})
+	var autoCollect bool
+	if err := config.DB.QueryRow("SELECT auto_collect FROM users WHERE user_id=?", userID).Scan(&autoCollect); err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
 	}
 
 	tmpl := template.Must(template.ParseFiles("templates/view_loans.html"))
-	tmpl.Execute(w, loans)
+	tmpl.Execute(w, map[string]interface{}{
+		"Loans":          loans,
+		"Accounts":       accounts,
+		"AutoCollect":    autoCollect,
+		"IdempotencyKey": uuid.New().String(),
+	})
 }
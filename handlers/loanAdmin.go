@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"database/sql"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Approve a pending loan: pay the principal into the borrower's first
+// active current or savings account in the loan's currency and set up
+// equal monthly installments of principal plus flat interest, the first
+// due a month from today.
+func approveLoan(loanID, approvedBy string) error {
+	return withTx(func(tx *sql.Tx) error {
+		l, err := scanLoan(tx.QueryRow("SELECT "+loanColumns+" FROM loans l JOIN users u ON u.user_id = l.user_id WHERE l.loan_id=?", loanID))
+		if err == sql.ErrNoRows {
+			return &bankError{http.StatusNotFound, "Loan not found"}
+		} else if err != nil {
+			return err
+		}
+		if l.Status != "pending" {
+			return &bankError{http.StatusBadRequest, "Loan is already " + l.Status}
+		}
+
+		account, err := scanAccount(tx.QueryRow(`
+			SELECT `+accountColumns+` FROM `+accountsWithBalances+`
+			WHERE a.user_id=? AND a.currency=? AND a.status='active' AND a.type IN ('current', 'savings')
+			ORDER BY a.type='current' DESC, a.id LIMIT 1`, l.UserID, l.Amount.Currency))
+		if err == sql.ErrNoRows {
+			return &bankError{http.StatusBadRequest, "Borrower has no active " + l.Amount.Currency + " account to pay the loan into"}
+		} else if err != nil {
+			return err
+		}
+
+		err = postTransaction(tx, Posting{UserID: l.UserID, AccountNumber: account.Number, Type: "loan_disbursement", Amount: l.Amount, Reference: l.LoanID})
+		if err != nil {
+			return err
+		}
+
+		total := l.Amount.Add(l.TotalInterest()).Amount
+		installment := total / int64(l.RepaymentPeriod)
+		today := startOfDay(time.Now().UTC())
+		for seq := 1; seq <= l.RepaymentPeriod; seq++ {
+			due := installment
+			if seq == l.RepaymentPeriod {
+				due = total - installment*int64(l.RepaymentPeriod-1)
+			}
+			_, err := tx.Exec("INSERT INTO loan_installments (loan_id, seq, due_date, amount_due) VALUES (?, ?, ?, ?)",
+				l.LoanID, seq, addMonths(today, seq).Format(dbDate), due)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec("UPDATE loans SET status='active', outstanding=?, approved_by=?, approved_at=?, disbursed_to=? WHERE loan_id=?",
+			total, approvedBy, time.Now().UTC().Format(dbTime), account.Number, l.LoanID)
+		if err != nil {
+			return err
+		}
+		return publishLoanEvent(tx, "loan.approved", l.LoanID)
+	})
+}
+
+// AdminLoans lists pending loans for approval and active loans in arrears
+func AdminLoans(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	pending, err := getLoans("l.status='pending'")
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	active, err := getLoans("l.status='active'")
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/admin_loans.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Pending": pending,
+		"Active":  active,
+	})
+}
+
+// ApproveLoan disburses a pending loan
+func ApproveLoan(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if err := approveLoan(mux.Vars(r)["id"], userID); err != nil {
+		adminError(w, r, err, "Failed to approve loan")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/loans", http.StatusSeeOther)
+}
+
+// RejectLoan turns down a pending loan
+func RejectLoan(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	loanID := mux.Vars(r)["id"]
+	err := withTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE loans SET status='rejected', approved_by=?, approved_at=? WHERE loan_id=? AND status='pending'",
+			userID, time.Now().UTC().Format(dbTime), loanID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return &bankError{http.StatusBadRequest, "No pending loan with that ID"}
+		}
+		return publishLoanEvent(tx, "loan.rejected", loanID)
+	})
+	if err != nil {
+		adminError(w, r, err, "Failed to reject loan")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/loans", http.StatusSeeOther)
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The order overdue installments are collected in for each
+// config.CollectionPriority
+var collectionOrders = map[string]string{
+	"oldest":       "i.due_date, l.id, i.seq",
+	"highest-rate": "l.interest_rate_bps DESC, i.due_date, l.id, i.seq",
+}
+
+// Collect what a customer owes on overdue installments from the balances of
+// their accounts, drawing on account types in config.CollectionAccountTypes
+// order. Only money actually in an account and not reserved by a hold is
+// taken; collection never uses an overdraft. Customers who opted out are
+// left alone. The bank makes these repayments itself, so they are not
+// screened by the fraud rules. Returns the number of repayments made.
+func collectArrears(tx *sql.Tx, userID string, now time.Time) (int, error) {
+	var autoCollect bool
+	if err := tx.QueryRow("SELECT auto_collect FROM users WHERE user_id=?", userID).Scan(&autoCollect); err != nil || !autoCollect {
+		return 0, err
+	}
+
+	order, ok := collectionOrders[config.CollectionPriority]
+	if !ok {
+		return 0, fmt.Errorf("unknown collection priority %q", config.CollectionPriority)
+	}
+
+	rows, err := tx.Query(`
+		SELECT i.loan_id, i.amount_due - i.amount_paid, l.currency
+		FROM loan_installments i JOIN loans l ON l.loan_id = i.loan_id
+		WHERE l.user_id=? AND l.status='active' AND i.due_date <= ? AND i.amount_paid < i.amount_due
+		ORDER BY `+order, userID, now.Format(dbDate))
+	if err != nil {
+		return 0, err
+	}
+
+	type arrear struct {
+		loanID string
+		owed   money.Money
+	}
+	var arrears []arrear
+	for rows.Next() {
+		var a arrear
+		if err := rows.Scan(&a.loanID, &a.owed.Amount, &a.owed.Currency); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		arrears = append(arrears, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	repayments := 0
+	for _, a := range arrears {
+		for _, accountType := range config.CollectionAccountTypes {
+			if a.owed.Amount <= 0 {
+				break
+			}
+			accounts, err := collectionAccounts(tx, userID, accountType, a.owed.Currency)
+			if err != nil {
+				return repayments, err
+			}
+			for _, account := range accounts {
+				if a.owed.Amount <= 0 {
+					break
+				}
+				balance, err := freeBalance(tx, account.Number)
+				if err != nil {
+					return repayments, err
+				}
+				take := a.owed
+				if balance < take.Amount {
+					take.Amount = balance
+				}
+				if take.Amount <= 0 {
+					continue
+				}
+				take, err = checkRepayment(tx, account, a.loanID, take)
+				if err != nil {
+					return repayments, err
+				}
+				if err := postRepayment(tx, account, a.loanID, take); err != nil {
+					return repayments, err
+				}
+				a.owed.Amount -= take.Amount
+				repayments++
+			}
+		}
+	}
+	return repayments, nil
+}
+
+// Fetch a customer's active accounts of one type in a currency
+func collectionAccounts(tx *sql.Tx, userID, accountType, currency string) ([]Account, error) {
+	rows, err := tx.Query("SELECT "+accountColumns+" FROM "+accountsWithBalances+" WHERE a.user_id=? AND a.type=? AND a.currency=? AND a.status='active' ORDER BY a.id",
+		userID, accountType, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// collectLoanInstallments collects from every customer with overdue
+// installments
+func collectLoanInstallments(tx *sql.Tx, now time.Time) (string, error) {
+	rows, err := tx.Query(`
+		SELECT DISTINCT l.user_id
+		FROM loan_installments i
+		JOIN loans l ON l.loan_id = i.loan_id
+		JOIN users u ON u.user_id = l.user_id
+		WHERE l.status='active' AND i.due_date <= ? AND i.amount_paid < i.amount_due AND u.auto_collect = 1`, now.Format(dbDate))
+	if err != nil {
+		return "", err
+	}
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return "", err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	collected := 0
+	for _, userID := range userIDs {
+		n, err := collectArrears(tx, userID, now)
+		if err != nil {
+			return "", err
+		}
+		collected += n
+	}
+	return fmt.Sprintf("collected %d repayment(s) from %d customer(s) in arrears", collected, len(userIDs)), nil
+}
+
+// markOverdueInstallments raises loan.overdue once for each installment of
+// an active loan that has passed its due date without being paid in full.
+// The scheduler runs it after loan-collections, so installments collected
+// today are not reported.
+func markOverdueInstallments(tx *sql.Tx, now time.Time) (string, error) {
+	n, err := publishInstallmentEvents(tx, now, "loan.overdue", "overdue_at", "i.due_date < ?", now.Format(dbDate))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d installment(s) newly overdue", n), nil
+}
+
+// Raise eventType for each unpaid installment of an active loan that
+// matches where and has no marker set, then set marker so it is only
+// raised once. Returns how many installments it was raised for.
+func publishInstallmentEvents(tx *sql.Tx, now time.Time, eventType, marker, where string, args ...interface{}) (int, error) {
+	rows, err := tx.Query(`
+		SELECT i.loan_id, i.seq, i.due_date, i.amount_due, i.amount_paid, l.currency
+		FROM loan_installments i JOIN loans l ON l.loan_id = i.loan_id
+		WHERE l.status='active' AND i.amount_paid < i.amount_due AND i.`+marker+` IS NULL AND `+where+`
+		ORDER BY i.due_date, l.id, i.seq`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	type unpaid struct {
+		loanID, dueDate, currency string
+		seq                       int
+		amountDue, amountPaid     int64
+	}
+	var installments []unpaid
+	for rows.Next() {
+		var i unpaid
+		var due time.Time
+		if err := rows.Scan(&i.loanID, &i.seq, &due, &i.amountDue, &i.amountPaid, &i.currency); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		i.dueDate = due.Format(dbDate)
+		installments = append(installments, i)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, i := range installments {
+		l, err := scanLoan(tx.QueryRow("SELECT "+loanColumns+" FROM loans l JOIN users u ON u.user_id = l.user_id WHERE l.loan_id=?", i.loanID))
+		if err != nil {
+			return 0, err
+		}
+		err = publishEvent(tx, eventType, map[string]interface{}{
+			"loan":        l,
+			"installment": i.seq,
+			"due_date":    i.dueDate,
+			"amount_due":  money.New(i.amountDue, i.currency),
+			"amount_paid": money.New(i.amountPaid, i.currency),
+		})
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec("UPDATE loan_installments SET "+marker+"=? WHERE loan_id=? AND seq=?", now.Format(dbTime), i.loanID, i.seq)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(installments), nil
+}
+
+// SetAutoCollect lets a customer opt in or out of automatic collection of
+// overdue installments
+func SetAutoCollect(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	_, err = config.DB.Exec("UPDATE users SET auto_collect=? WHERE user_id=?", r.FormValue("auto_collect") == "on", userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Failed to update collection preference")
+		return
+	}
+
+	http.Redirect(w, r, "/view-loans", http.StatusSeeOther)
+}
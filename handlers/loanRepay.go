@@ -1,179 +1,156 @@
 package handlers
 
 import (
-	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
 	"net/http"
-	"strconv"
+	"time"
 )
 
-// RepayLoan allows a user to repay a loan using available deposit balance
-func RepayLoan(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
-		return
+// Apply a repayment made through a channel from an account to one of its
+// owner's loans, once it passes the fraud rules. Never takes more than is
+// still owed; returns the amount actually repaid.
+func repayLoan(tx *sql.Tx, account Account, loanID string, amount money.Money, channel string) (money.Money, error) {
+	amount, err := checkRepayment(tx, account, loanID, amount)
+	if err != nil {
+		return money.Money{}, err
 	}
-
-	userID, err := getUserIDFromSession(r)
-	if err != nil || userID == "" {
-		ErrorPage(w, r, http.StatusUnauthorized, "You must be logged in to repay a loan")
-		return
+	if err := screenPayment(tx, payment{Kind: "repayment", From: account, ToAccount: loanID, Amount: amount, Channel: channel}); err != nil {
+		return money.Money{}, err
 	}
+	return amount, postRepayment(tx, account, loanID, amount)
+}
 
-	repaymentAmount, err := strconv.Atoi(r.FormValue("amount"))
-	if err != nil || repaymentAmount <= 0 {
-		ErrorPage(w, r, http.StatusBadRequest, "Invalid repayment amount")
-		return
+// Check that an account can repay a loan and cap the amount at what is
+// still owed
+func checkRepayment(tx *sql.Tx, account Account, loanID string, amount money.Money) (money.Money, error) {
+	var outstanding int64
+	var currency, status string
+	err := tx.QueryRow("SELECT outstanding, currency, status FROM loans WHERE loan_id=? AND user_id=?", loanID, account.UserID).
+		Scan(&outstanding, &currency, &status)
+	if err == sql.ErrNoRows {
+		return money.Money{}, &bankError{http.StatusNotFound, "Loan not found"}
+	} else if err != nil {
+		return money.Money{}, err
 	}
-
-	// Get user's deposit balance
-	var depositBalance int
-	err = config.DB.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id=? AND type='deposit'", userID).Scan(&depositBalance)
-	if err != nil {
-		ErrorPage(w, r, http.StatusInternalServerError, "Failed to fetch balance")
-		return
+	if status == "repaid" || outstanding <= 0 {
+		return money.Money{}, &bankError{http.StatusBadRequest, "No outstanding loan balance"}
 	}
-
-	// Get user's outstanding loan balance
-	var loanBalance int
-	err = config.DB.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM loans WHERE user_id=? AND status='pending'", userID).Scan(&loanBalance)
-	if err != nil {
-		ErrorPage(w, r, http.StatusInternalServerError, "Failed to fetch loan balance")
-		return
-	}
-
-	if loanBalance <= 0 {
-		ErrorPage(w, r, http.StatusBadRequest, "No outstanding loan balance")
-		return
+	if status != "active" {
+		return money.Money{}, &bankError{http.StatusBadRequest, "Loan has not been approved"}
 	}
-
-	tx, err := config.DB.Begin()
-	if err != nil {
-		ErrorPage(w, r, http.StatusInternalServerError, "Failed to start transaction")
-		return
+	if currency != account.Currency {
+		return money.Money{}, &bankError{http.StatusBadRequest, "Loans must be repaid from an account in the loan's currency"}
 	}
-
-	// Deduct from deposit if available
-	if depositBalance >= repaymentAmount {
-		_, err = tx.Exec("INSERT INTO transactions (user_id, type, amount) VALUES (?, 'repayment', ?)", userID, -repaymentAmount)
-		if err != nil {
-			tx.Rollback()
-			ErrorPage(w, r, http.StatusInternalServerError, "Failed to process repayment")
-			return
-		}
-
-		// Update deposit balance after repayment
-		_, err = tx.Exec("UPDATE transactions SET amount = amount - ? WHERE user_id=? AND type='deposit'", repaymentAmount, userID)
-		if err != nil {
-			tx.Rollback()
-			ErrorPage(w, r, http.StatusInternalServerError, "Failed to update deposit balance")
-			return
-		}
-	} else {
-		ErrorPage(w, r, http.StatusBadRequest, "Insufficient deposit balance")
-		tx.Rollback()
-		return
+	if err := checkDebit(account); err != nil {
+		return money.Money{}, err
 	}
 
-	// Reduce the loan balance
-	_, err = tx.Exec("UPDATE loans SET amount = amount - ? WHERE user_id=? AND status='pending'", repaymentAmount, userID)
-	if err != nil {
-		tx.Rollback()
-		ErrorPage(w, r, http.StatusInternalServerError, "Failed to update loan balance")
-		return
+	if amount.Amount > outstanding {
+		amount.Amount = outstanding
 	}
-
-	tx.Commit()
-	http.Redirect(w, r, "/view_loans", http.StatusSeeOther)
+	return amount, ensureFunds(tx, account.Number, amount)
 }
 
-// AutoDeductLoan automatically deducts from deposits when a user deposits money
-func AutoDeductLoan(userID string) error {
-	var depositBalance, outstandingDebt int
-
-	// Check user's deposit balance
-	err := config.DB.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id=? AND type='deposit'", userID).Scan(&depositBalance)
+// Post a checked repayment and apply it to the loan and its installments
+func postRepayment(tx *sql.Tx, account Account, loanID string, amount money.Money) error {
+	err := postTransaction(tx, Posting{UserID: account.UserID, AccountNumber: account.Number, Type: "repayment", Amount: amount, Reference: loanID})
 	if err != nil {
 		return err
 	}
 
-	// Check if the user has an outstanding negative balance
-	err = config.DB.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id=? AND type='debt'", userID).Scan(&outstandingDebt)
+	_, err = tx.Exec("UPDATE loans SET outstanding = outstanding - ?, status = CASE WHEN outstanding - ? <= 0 THEN 'repaid' ELSE status END WHERE loan_id=?",
+		amount.Amount, amount.Amount, loanID)
 	if err != nil {
 		return err
 	}
-
-	if outstandingDebt >= 0 {
-		return nil // No debt to auto-deduct
+	var status string
+	if err := tx.QueryRow("SELECT status FROM loans WHERE loan_id=?", loanID).Scan(&status); err != nil {
+		return err
 	}
+	if status == "repaid" {
+		if err := publishLoanEvent(tx, "loan.repaid", loanID); err != nil {
+			return err
+		}
+	}
+	return allocateRepayment(tx, loanID, amount.Amount)
+}
 
-	tx, err := config.DB.Begin()
+// Spread a repayment over a loan's unpaid installments, oldest first. Any
+// excess pays installments ahead of their due date.
+func allocateRepayment(tx *sql.Tx, loanID string, amount int64) error {
+	rows, err := tx.Query("SELECT seq, amount_due - amount_paid FROM loan_installments WHERE loan_id=? AND amount_paid < amount_due ORDER BY seq", loanID)
 	if err != nil {
 		return err
 	}
 
-	// Deduct outstanding debt from deposits if possible
-	if depositBalance >= -outstandingDebt {
-		_, err = tx.Exec("INSERT INTO transactions (user_id, type, amount) VALUES (?, 'debt_payment', ?)", userID, outstandingDebt)
-		if err != nil {
-			tx.Rollback()
+	type unpaid struct {
+		seq  int
+		owed int64
+	}
+	var installments []unpaid
+	for rows.Next() {
+		var i unpaid
+		if err := rows.Scan(&i.seq, &i.owed); err != nil {
+			rows.Close()
 			return err
 		}
+		installments = append(installments, i)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
-		_, err = tx.Exec("DELETE FROM transactions WHERE user_id=? AND type='debt'", userID)
-		if err != nil {
-			tx.Rollback()
-			return err
+	now := time.Now().UTC().Format(dbTime)
+	for _, i := range installments {
+		if amount <= 0 {
+			break
 		}
-	} else {
-		// Deduct whatever is available and update the remaining debt
-		_, err = tx.Exec("INSERT INTO transactions (user_id, type, amount) VALUES (?, 'debt_payment', ?)", userID, -depositBalance)
-		if err != nil {
-			tx.Rollback()
-			return err
+		pay := i.owed
+		if pay > amount {
+			pay = amount
 		}
-
-		_, err = tx.Exec("UPDATE transactions SET amount = amount + ? WHERE user_id=? AND type='debt'", depositBalance, userID)
+		_, err := tx.Exec(`
+			UPDATE loan_installments SET amount_paid = amount_paid + ?, paid_at = CASE WHEN amount_paid + ? >= amount_due THEN ? ELSE paid_at END
+			WHERE loan_id=? AND seq=?`,
+			pay, pay, now, loanID, i.seq)
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
+		amount -= pay
 	}
-
-	tx.Commit()
 	return nil
 }
 
-// Hook into deposit processing to trigger auto-loan deduction
-func ProcessDeposit(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
-		return
-	}
-
+// RepayLoan pays towards a loan from one of the user's accounts
+func RepayLoan(w http.ResponseWriter, r *http.Request) {
 	userID, err := getUserIDFromSession(r)
 	if err != nil || userID == "" {
-		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		ErrorPage(w, r, http.StatusUnauthorized, "You must be logged in to repay a loan")
 		return
 	}
 
-	depositAmount, err := strconv.Atoi(r.FormValue("amount"))
-	if err != nil || depositAmount <= 0 {
-		ErrorPage(w, r, http.StatusBadRequest, "Invalid deposit amount")
+	account, err := accountFromRequest(r, userID)
+	if err != nil {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid account")
 		return
 	}
 
-	_, err = config.DB.Exec("INSERT INTO transactions (user_id, type, amount) VALUES (?, 'deposit', ?)", userID, depositAmount)
+	amount, err := amountFromRequest(r, account)
 	if err != nil {
-		ErrorPage(w, r, http.StatusInternalServerError, "Failed to process deposit")
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid repayment amount")
 		return
 	}
 
-	// Check if auto-deduction is needed
-	err = AutoDeductLoan(userID)
-	if err != nil {
-		ErrorPage(w, r, http.StatusInternalServerError, "Auto deduction failed")
+	err = withTx(func(tx *sql.Tx) error {
+		_, err := repayLoan(tx, account, r.FormValue("loan_id"), amount, "web")
+		return err
+	})
+	if err = fraudCaseFor(err); err != nil {
+		transactionError(w, r, err, "Failed to process repayment")
 		return
 	}
 
-	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+	http.Redirect(w, r, "/view-loans", http.StatusSeeOther)
 }
@@ -0,0 +1,454 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"Bank-Management-System/notify"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"path/filepath"
+	"regexp"
+	"strings"
+	txttemplate "text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of message customers can choose how to receive
+var notificationKinds = map[string]string{
+	"deposit":        "Money paid into your accounts",
+	"withdrawal":     "Withdrawals from your accounts",
+	"loan_decision":  "Decisions on your loan applications",
+	"standing_order": "Standing order payments that fail",
+}
+
+// Channels messages go out on, and whether a customer gets each one for a
+// kind of message they have not made a choice about
+var notificationChannels = []string{notify.Email, notify.SMS}
+var defaultChannels = map[string]bool{notify.Email: true, notify.SMS: false}
+
+// A message due to a customer because of an event. Template names the
+// file in templates/notifications it is rendered from.
+type notification struct {
+	userID   string
+	kind     string
+	template string
+	data     map[string]interface{}
+}
+
+// Work out which customer, if any, should hear about an event
+func notificationFor(tx *sql.Tx, e Event) (*notification, error) {
+	switch e.Type {
+	case "transaction.posted":
+		var t struct {
+			AccountNumber string      `json:"account_number"`
+			Type          string      `json:"type"`
+			Amount        money.Money `json:"amount"`
+		}
+		if err := json.Unmarshal(e.Data, &t); err != nil {
+			return nil, err
+		}
+		kind := map[string]string{"deposit": "deposit", "withdraw": "withdrawal"}[t.Type]
+		if kind == "" {
+			return nil, nil
+		}
+		var userID string
+		if err := tx.QueryRow("SELECT user_id FROM accounts WHERE account_number=?", t.AccountNumber).Scan(&userID); err != nil {
+			return nil, err
+		}
+		return &notification{userID, kind, kind, map[string]interface{}{
+			"Amount":        t.Amount,
+			"AccountNumber": t.AccountNumber,
+			"MaskedAccount": maskAccount(t.AccountNumber),
+			"Date":          e.CreatedAt.Format("02 Jan 2006 15:04 MST"),
+		}}, nil
+
+	case "loan.approved", "loan.rejected":
+		var l Loan
+		if err := json.Unmarshal(e.Data, &l); err != nil {
+			return nil, err
+		}
+		if err := tx.QueryRow("SELECT user_id FROM loans WHERE loan_id=?", l.LoanID).Scan(&l.UserID); err != nil {
+			return nil, err
+		}
+		return &notification{l.UserID, "loan_decision", strings.Replace(e.Type, ".", "_", 1), map[string]interface{}{
+			"LoanID":          l.LoanID,
+			"Amount":          l.Amount,
+			"Outstanding":     l.Outstanding,
+			"RepaymentPeriod": l.RepaymentPeriod,
+			"InterestRate":    l.InterestRate(),
+		}}, nil
+
+	case "standing_order.failed":
+		var f standingOrderFailure
+		if err := json.Unmarshal(e.Data, &f); err != nil {
+			return nil, err
+		}
+		var userID string
+		if err := tx.QueryRow("SELECT user_id FROM standing_orders WHERE order_id=?", f.OrderID).Scan(&userID); err != nil {
+			return nil, err
+		}
+		return &notification{userID, "standing_order", "standing_order_failed", map[string]interface{}{
+			"Amount":        f.Amount,
+			"MaskedAccount": maskAccount(f.FromAccount),
+			"Payee":         f.Payee,
+			"DueDate":       f.DueDate,
+			"Error":         f.Error,
+			"WillRetry":     f.WillRetry,
+		}}, nil
+	}
+	return nil, nil
+}
+
+// The channels a customer wants a kind of message on
+func notificationChannelsFor(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, userID, kind string) (map[string]bool, error) {
+	enabled := make(map[string]bool, len(defaultChannels))
+	for channel, on := range defaultChannels {
+		enabled[channel] = on
+	}
+	rows, err := q.Query("SELECT channel, enabled FROM notification_preferences WHERE user_id=? AND kind=?", userID, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel string
+		var on bool
+		if err := rows.Scan(&channel, &on); err != nil {
+			return nil, err
+		}
+		enabled[channel] = on
+	}
+	return enabled, rows.Err()
+}
+
+// The templates messages are rendered from, one file per name in
+// templates/notifications, each defining a subject and a body for every
+// channel
+var notificationTemplateNames = []string{"deposit", "withdrawal", "loan_approved", "loan_rejected", "standing_order_failed"}
+
+// Parsed notification templates by name, filled in by
+// LoadNotificationTemplates
+var notificationTemplates map[string]*txttemplate.Template
+
+// LoadNotificationTemplates parses the notification templates in dir once,
+// so a missing or broken template stops the bank at startup rather than
+// failing every message that needs it
+func LoadNotificationTemplates(dir string) error {
+	templates := make(map[string]*txttemplate.Template, len(notificationTemplateNames))
+	for _, name := range notificationTemplateNames {
+		tmpl, err := txttemplate.ParseFiles(filepath.Join(dir, name+".tmpl"))
+		if err != nil {
+			return err
+		}
+		for _, part := range append([]string{"subject"}, notificationChannels...) {
+			if tmpl.Lookup(part) == nil {
+				return fmt.Errorf("notification template %s does not define %q", name, part)
+			}
+		}
+		templates[name] = tmpl
+	}
+	notificationTemplates = templates
+	return nil
+}
+
+// Render a message for one channel. Email has a subject; SMS does not.
+func renderNotification(name, channel string, data map[string]interface{}) (string, string, error) {
+	tmpl, ok := notificationTemplates[name]
+	if !ok {
+		return "", "", fmt.Errorf("no notification template %q", name)
+	}
+	var subject, body bytes.Buffer
+	if channel == notify.Email {
+		if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+			return "", "", err
+		}
+	}
+	if err := tmpl.ExecuteTemplate(&body, channel, data); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(subject.String()), strings.TrimSpace(body.String()), nil
+}
+
+// queueNotifications is the outbox subscriber that queues a message on
+// each channel the customer an event concerns has turned on and given an
+// address for
+func queueNotifications(tx *sql.Tx, e Event) error {
+	n, err := notificationFor(tx, e)
+	if err != nil || n == nil {
+		return err
+	}
+
+	var name string
+	var email, phone sql.NullString
+	if err := tx.QueryRow("SELECT name, email, phone FROM users WHERE user_id=?", n.userID).Scan(&name, &email, &phone); err != nil {
+		return err
+	}
+	n.data["Name"] = name
+	addresses := map[string]string{notify.Email: email.String, notify.SMS: phone.String}
+
+	enabled, err := notificationChannelsFor(tx, n.userID, n.kind)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(dbTime)
+	for _, channel := range notificationChannels {
+		if !enabled[channel] || addresses[channel] == "" {
+			continue
+		}
+		subject, body, err := renderNotification(n.template, channel, n.data)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO outbound_messages (message_id, event_id, user_id, kind, channel, recipient, subject, body, next_attempt_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			uuid.New().String(), e.ID, n.userID, n.kind, channel, addresses[channel], subject, body, now, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The sender config picks for a channel
+func messageSender(channel string) (notify.Sender, error) {
+	choice := config.EmailSender
+	if channel == notify.SMS {
+		choice = config.SMSSender
+	}
+
+	switch {
+	case choice == "file":
+		return notify.FileSender{Path: config.NotifyFile}, nil
+	case channel == notify.Email && choice == "smtp":
+		return notify.SMTPSender{Addr: config.SMTPAddr, From: config.SMTPFrom, Username: config.SMTPUsername, Password: config.SMTPPassword}, nil
+	case channel == notify.SMS && choice == "gateway" && config.SMSGatewayURL != "":
+		return notify.GatewaySender{URL: config.SMSGatewayURL, Token: config.SMSGatewayToken, Timeout: 10 * time.Second}, nil
+	}
+	return nil, fmt.Errorf("no %s sender %q is configured", channel, choice)
+}
+
+// SendNotifications sends every queued message that is due as of now.
+// Failures are retried with exponential backoff until
+// config.NotifyMaxAttempts, when the message is marked failed. Returns a
+// one line summary.
+func SendNotifications(now time.Time) (string, error) {
+	rows, err := config.DB.Query(`
+		SELECT message_id, channel, recipient, subject, body, attempts FROM outbound_messages
+		WHERE status='pending' AND next_attempt_at <= ? ORDER BY id LIMIT 100`, now.Format(dbTime))
+	if err != nil {
+		return "", err
+	}
+	type queued struct {
+		id       string
+		message  notify.Message
+		attempts int
+	}
+	var due []queued
+	for rows.Next() {
+		var q queued
+		if err := rows.Scan(&q.id, &q.message.Channel, &q.message.To, &q.message.Subject, &q.message.Body, &q.attempts); err != nil {
+			rows.Close()
+			return "", err
+		}
+		due = append(due, q)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(due) == 0 {
+		return "", err
+	}
+
+	sent, retrying, failed := 0, 0, 0
+	for _, q := range due {
+		sender, err := messageSender(q.message.Channel)
+		if err == nil {
+			err = sender.Send(q.message)
+		}
+		q.attempts++
+
+		at := time.Now().UTC()
+		switch {
+		case err == nil:
+			sent++
+			_, err = config.DB.Exec("UPDATE outbound_messages SET status='sent', attempts=?, last_error=NULL, sent_at=? WHERE message_id=?",
+				q.attempts, at.Format(dbTime), q.id)
+		case int64(q.attempts) < config.NotifyMaxAttempts:
+			retrying++
+			_, err = config.DB.Exec("UPDATE outbound_messages SET attempts=?, last_error=?, next_attempt_at=? WHERE message_id=?",
+				q.attempts, err.Error(), at.Add(retryDelay(config.NotifyRetryBase, q.attempts)).Format(dbTime), q.id)
+		default:
+			failed++
+			_, err = config.DB.Exec("UPDATE outbound_messages SET status='failed', attempts=?, last_error=? WHERE message_id=?",
+				q.attempts, err.Error(), q.id)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("sent %d message(s), %d to retry, %d failed", sent, retrying, failed), nil
+}
+
+// StartNotificationSender sends queued messages every
+// config.NotifyPollInterval until the process exits
+func StartNotificationSender() {
+	if config.NotifyPollInterval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			summary, err := SendNotifications(time.Now().UTC())
+			if err != nil {
+				log.Printf("sending notifications failed: %v", err)
+			} else if summary != "" {
+				log.Printf("notifications: %s", summary)
+			}
+			time.Sleep(config.NotifyPollInterval)
+		}
+	}()
+}
+
+// NotificationPreference is whether a customer gets one kind of message on
+// one channel
+type NotificationPreference struct {
+	Kind        string
+	Description string
+	Channels    map[string]bool
+}
+
+// SentMessage is a message recently sent or queued for a customer
+type SentMessage struct {
+	Channel   string
+	Recipient string
+	Subject   string
+	Status    string
+	CreatedAt time.Time
+}
+
+// NotificationSettingsPage shows where and how the logged in user is sent
+// messages, with the messages sent most recently
+func NotificationSettingsPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var email, phone sql.NullString
+	if err := config.DB.QueryRow("SELECT email, phone FROM users WHERE user_id=?", userID).Scan(&email, &phone); err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	kinds := make(map[string]bool, len(notificationKinds))
+	for kind := range notificationKinds {
+		kinds[kind] = true
+	}
+	var preferences []NotificationPreference
+	for _, kind := range sortedKeys(kinds) {
+		channels, err := notificationChannelsFor(config.DB, userID, kind)
+		if err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		preferences = append(preferences, NotificationPreference{kind, notificationKinds[kind], channels})
+	}
+
+	rows, err := config.DB.Query("SELECT channel, recipient, subject, status, created_at FROM outbound_messages WHERE user_id=? ORDER BY id DESC LIMIT 20", userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+	var messages []SentMessage
+	for rows.Next() {
+		var m SentMessage
+		if err := rows.Scan(&m.Channel, &m.Recipient, &m.Subject, &m.Status, &m.CreatedAt); err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		messages = append(messages, m)
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/notification_settings.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Email":       email.String,
+		"Phone":       phone.String,
+		"Channels":    notificationChannels,
+		"Preferences": preferences,
+		"Messages":    messages,
+	})
+}
+
+// Phone numbers are stored in E.164 form, such as +254712345678
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+// UpdateNotificationSettings saves the logged in user's email address,
+// phone number and choice of channels for each kind of message
+func UpdateNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid form")
+		return
+	}
+
+	var email, phone interface{}
+	if value := strings.TrimSpace(r.PostForm.Get("email")); value != "" {
+		address, err := mail.ParseAddress(value)
+		if err != nil || address.Address != value {
+			ErrorPage(w, r, http.StatusBadRequest, "Invalid email address")
+			return
+		}
+		email = value
+	}
+	if value := strings.Join(strings.Fields(r.PostForm.Get("phone")), ""); value != "" {
+		if !phonePattern.MatchString(value) {
+			ErrorPage(w, r, http.StatusBadRequest, "Enter the phone number with its country code, such as +254712345678")
+			return
+		}
+		phone = value
+	}
+
+	chosen := make(map[string]bool)
+	for _, value := range r.PostForm["channels"] {
+		chosen[value] = true
+	}
+
+	err = withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE users SET email=?, phone=? WHERE user_id=?", email, phone, userID); err != nil {
+			return err
+		}
+		for kind := range notificationKinds {
+			for _, channel := range notificationChannels {
+				_, err := tx.Exec(`
+					INSERT INTO notification_preferences (user_id, kind, channel, enabled) VALUES (?, ?, ?, ?)
+					ON CONFLICT(user_id, kind, channel) DO UPDATE SET enabled=excluded.enabled`,
+					userID, kind, channel, chosen[kind+":"+channel])
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Failed to save notification settings")
+		return
+	}
+
+	http.Redirect(w, r, "/notification-settings", http.StatusSeeOther)
+}
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Notification is an alert shown to a customer in the app
+type Notification struct {
+	ID        string
+	Kind      string
+	Title     string
+	Body      string
+	Link      string
+	CreatedAt time.Time
+	ReadAt    sql.NullTime
+}
+
+// Add a notification to a customer's notification center
+func createNotification(tx *sql.Tx, userID, kind, title, body, link string) error {
+	_, err := tx.Exec("INSERT INTO notifications (notification_id, user_id, kind, title, body, link, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		uuid.New().String(), userID, kind, title, body, link, time.Now().UTC().Format(dbTime))
+	return err
+}
+
+// The last four digits of an account number, for showing in alerts
+func maskAccount(number string) string {
+	if len(number) > 4 {
+		number = number[len(number)-4:]
+	}
+	return "****" + number
+}
+
+// An alert threshold set in the bank's default currency, converted into
+// currency at the stored exchange rate. It reports false if there is no
+// rate to convert at.
+func alertThreshold(q querier, threshold, currency string) (money.Money, bool, error) {
+	amount, err := money.Parse(threshold, money.DefaultCurrency)
+	if err != nil || currency == money.DefaultCurrency {
+		return amount, err == nil, err
+	}
+	rate, err := exchangeRate(q, money.DefaultCurrency, currency)
+	if _, ok := err.(*bankError); ok {
+		return money.Money{}, false, nil
+	} else if err != nil {
+		return money.Money{}, false, err
+	}
+	return amount.Convert(currency, rate, 0), true, nil
+}
+
+// Alert the account holder when a debit takes the balance below
+// config.LowBalanceThreshold, or when a withdrawal is at least
+// config.LargeWithdrawalThreshold. Accounts in another currency are
+// alerted at the equivalent amounts, and not at all while there is no
+// exchange rate for their currency.
+func transactionNotifications(tx *sql.Tx, e Event) error {
+	var t struct {
+		AccountNumber string      `json:"account_number"`
+		Type          string      `json:"type"`
+		Amount        money.Money `json:"amount"`
+		Balance       money.Money `json:"balance"`
+	}
+	if err := json.Unmarshal(e.Data, &t); err != nil {
+		return err
+	}
+	if isCredit(t.Type) {
+		return nil
+	}
+
+	var userID string
+	if err := tx.QueryRow("SELECT user_id FROM accounts WHERE account_number=?", t.AccountNumber).Scan(&userID); err != nil {
+		return err
+	}
+
+	low, ok, err := alertThreshold(tx, config.LowBalanceThreshold, t.Amount.Currency)
+	if err != nil {
+		return fmt.Errorf("low balance threshold: %w", err)
+	}
+	if ok && t.Balance.Amount < low.Amount && t.Balance.Amount+t.Amount.Amount >= low.Amount {
+		err := createNotification(tx, userID, "low_balance", "Low balance on "+maskAccount(t.AccountNumber),
+			fmt.Sprintf("Your balance is %s after %s left the account.", t.Balance, t.Amount), "/dashboard")
+		if err != nil {
+			return err
+		}
+	}
+
+	large, ok, err := alertThreshold(tx, config.LargeWithdrawalThreshold, t.Amount.Currency)
+	if err != nil {
+		return fmt.Errorf("large withdrawal threshold: %w", err)
+	}
+	if ok && t.Type == "withdraw" && t.Amount.Amount >= large.Amount {
+		return createNotification(tx, userID, "large_withdrawal", "Large withdrawal from "+maskAccount(t.AccountNumber),
+			fmt.Sprintf("%s was withdrawn from account %s. If this was not you, contact the bank immediately.", t.Amount, t.AccountNumber), "/dashboard")
+	}
+	return nil
+}
+
+// Tell a borrower their loan changed status or an installment needs
+// paying
+func loanNotifications(tx *sql.Tx, e Event) error {
+	var l Loan
+	var installment struct {
+		Loan       *Loan       `json:"loan"`
+		Seq        int         `json:"installment"`
+		DueDate    string      `json:"due_date"`
+		AmountDue  money.Money `json:"amount_due"`
+		AmountPaid money.Money `json:"amount_paid"`
+	}
+	switch e.Type {
+	case "loan.overdue", "loan.installment_due":
+		installment.Loan = &l
+		if err := json.Unmarshal(e.Data, &installment); err != nil {
+			return err
+		}
+	default:
+		if err := json.Unmarshal(e.Data, &l); err != nil {
+			return err
+		}
+	}
+	if err := tx.QueryRow("SELECT user_id FROM loans WHERE loan_id=?", l.LoanID).Scan(&l.UserID); err != nil {
+		return err
+	}
+
+	var kind, title, body string
+	switch e.Type {
+	case "loan.approved":
+		kind, title, body = "loan_status", "Loan approved", fmt.Sprintf("Your loan of %s was approved and paid into your account.", l.Amount)
+	case "loan.rejected":
+		kind, title, body = "loan_status", "Loan not approved", fmt.Sprintf("Your application for a loan of %s was not approved.", l.Amount)
+	case "loan.repaid":
+		kind, title, body = "loan_status", "Loan repaid", fmt.Sprintf("You have repaid your loan of %s in full.", l.Amount)
+	case "loan.overdue":
+		kind, title, body = "loan_status", "Installment overdue", fmt.Sprintf("Installment %d of your loan of %s was due on %s. %s is still owed.",
+			installment.Seq, l.Amount, installment.DueDate, installment.AmountDue.Sub(installment.AmountPaid))
+	case "loan.installment_due":
+		kind, title, body = "installment_due", "Installment due soon", fmt.Sprintf("Installment %d of your loan of %s is due on %s. %s is owed.",
+			installment.Seq, l.Amount, installment.DueDate, installment.AmountDue.Sub(installment.AmountPaid))
+	default:
+		return nil
+	}
+	return createNotification(tx, l.UserID, kind, title, body, "/view-loans")
+}
+
+// The parts of standing_order.failed customers are told about
+type standingOrderFailure struct {
+	OrderID     string      `json:"order_id"`
+	FromAccount string      `json:"from_account"`
+	Payee       string      `json:"payee"`
+	Amount      money.Money `json:"amount"`
+	DueDate     string      `json:"due_date"`
+	Error       string      `json:"error"`
+	WillRetry   bool        `json:"will_retry"`
+}
+
+// Tell a customer a standing order payment failed
+func standingOrderNotifications(tx *sql.Tx, e Event) error {
+	var f standingOrderFailure
+	if err := json.Unmarshal(e.Data, &f); err != nil {
+		return err
+	}
+	var userID string
+	if err := tx.QueryRow("SELECT user_id FROM standing_orders WHERE order_id=?", f.OrderID).Scan(&userID); err != nil {
+		return err
+	}
+
+	outcome := "It was skipped."
+	if f.WillRetry {
+		outcome = "It will be tried again on the next run."
+	}
+	return createNotification(tx, userID, "standing_order_failed", "Standing order payment failed",
+		fmt.Sprintf("Your payment of %s from %s to %s due on %s failed: %s. %s", f.Amount, maskAccount(f.FromAccount), f.Payee, f.DueDate, f.Error, outcome),
+		"/standing-orders")
+}
+
+// addNotifications is the outbox subscriber that fills customers'
+// notification centers
+func addNotifications(tx *sql.Tx, e Event) error {
+	switch e.Type {
+	case "transaction.posted":
+		return transactionNotifications(tx, e)
+	case "loan.approved", "loan.rejected", "loan.repaid", "loan.overdue", "loan.installment_due":
+		return loanNotifications(tx, e)
+	case "standing_order.failed":
+		return standingOrderNotifications(tx, e)
+	}
+	return nil
+}
+
+// remindInstallmentsDue raises loan.installment_due once for each unpaid
+// installment of an active loan that falls due within
+// config.InstallmentReminderDays
+func remindInstallmentsDue(tx *sql.Tx, now time.Time) (string, error) {
+	today := startOfDay(now)
+	n, err := publishInstallmentEvents(tx, now, "loan.installment_due", "reminded_at", "i.due_date >= ? AND i.due_date <= ?",
+		today.Format(dbDate), today.AddDate(0, 0, int(config.InstallmentReminderDays)).Format(dbDate))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("reminded borrowers of %d installment(s) due soon", n), nil
+}
+
+// Count a customer's unread notifications, for the badge in the header
+func unreadNotifications(userID string) (int, error) {
+	var n int
+	err := config.DB.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id=? AND read_at IS NULL", userID).Scan(&n)
+	return n, err
+}
+
+// NotificationsPage lists the logged in user's most recent notifications
+func NotificationsPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	rows, err := config.DB.Query("SELECT notification_id, kind, title, body, link, created_at, read_at FROM notifications WHERE user_id=? ORDER BY id DESC LIMIT 100", userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Title, &n.Body, &n.Link, &n.CreatedAt, &n.ReadAt); err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		notifications = append(notifications, n)
+	}
+
+	unread, err := unreadNotifications(userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/notifications.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Notifications": notifications,
+		"Unread":        unread,
+	})
+}
+
+// MarkNotificationRead marks one of the logged in user's notifications as
+// read
+func MarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	result, err := config.DB.Exec("UPDATE notifications SET read_at=COALESCE(read_at, ?) WHERE notification_id=? AND user_id=?",
+		time.Now().UTC().Format(dbTime), mux.Vars(r)["id"], userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		ErrorPage(w, r, http.StatusNotFound, "Notification not found")
+		return
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
+
+// MarkAllNotificationsRead marks every unread notification of the logged
+// in user as read
+func MarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	_, err = config.DB.Exec("UPDATE notifications SET read_at=? WHERE user_id=? AND read_at IS NULL", time.Now().UTC().Format(dbTime), userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestNotificationTemplatesLoad(t *testing.T) {
+	if err := LoadNotificationTemplates("../templates/notifications"); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadNotificationTemplates(t.TempDir()); err == nil {
+		t.Fatal("loading from a directory without templates succeeded")
+	}
+}
+
+func TestChannelPreferencesPickMessages(t *testing.T) {
+	openTestDB(t)
+	if err := LoadNotificationTemplates("../templates/notifications"); err != nil {
+		t.Fatal(err)
+	}
+	account := testAccount(t, "alice", "current", "")
+
+	tests := []struct {
+		name        string
+		phone       string
+		preferences map[string]bool // "kind channel" to enabled
+		want        []string
+	}{
+		{"defaults", "+254700000001", nil, []string{"email"}},
+		{"sms turned on", "+254700000001", map[string]bool{"deposit sms": true}, []string{"email", "sms"}},
+		{"email turned off", "+254700000001", map[string]bool{"deposit email": false, "deposit sms": true}, []string{"sms"}},
+		{"everything off", "+254700000001", map[string]bool{"deposit email": false}, nil},
+		{"other kinds do not count", "+254700000001", map[string]bool{"withdrawal sms": true, "withdrawal email": false}, []string{"email"}},
+		{"no phone number", "", map[string]bool{"deposit sms": true}, []string{"email"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := config.DB.Exec("DELETE FROM notification_preferences WHERE user_id=?", account.UserID); err != nil {
+				t.Fatal(err)
+			}
+			for preference, enabled := range test.preferences {
+				kindChannel := strings.Fields(preference)
+				_, err := config.DB.Exec("INSERT INTO notification_preferences (user_id, kind, channel, enabled) VALUES (?, ?, ?, ?)",
+					account.UserID, kindChannel[0], kindChannel[1], enabled)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var phone interface{}
+			if test.phone != "" {
+				phone = test.phone
+			}
+			if _, err := config.DB.Exec("UPDATE users SET email='alice@example.com', phone=? WHERE user_id=?", phone, account.UserID); err != nil {
+				t.Fatal(err)
+			}
+
+			data, _ := json.Marshal(map[string]interface{}{
+				"account_number": account.Number,
+				"type":           "deposit",
+				"amount":         money.New(100000, account.Currency),
+			})
+			e := Event{ID: uuid.New().String(), Type: "transaction.posted", Data: data, CreatedAt: time.Now()}
+			if err := withTx(func(tx *sql.Tx) error { return queueNotifications(tx, e) }); err != nil {
+				t.Fatal(err)
+			}
+
+			rows, err := config.DB.Query("SELECT channel, recipient, body FROM outbound_messages WHERE event_id=? ORDER BY channel", e.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var channels []string
+			for rows.Next() {
+				var channel, recipient, body string
+				if err := rows.Scan(&channel, &recipient, &body); err != nil {
+					t.Fatal(err)
+				}
+				if want := map[string]string{"email": "alice@example.com", "sms": test.phone}[channel]; recipient != want {
+					t.Errorf("%s queued to %q, want %q", channel, recipient, want)
+				}
+				if !strings.Contains(body, "1,000.00") {
+					t.Errorf("%s body %q does not mention the amount", channel, body)
+				}
+				channels = append(channels, channel)
+			}
+			if !reflect.DeepEqual(channels, test.want) {
+				t.Fatalf("queued %v, want %v", channels, test.want)
+			}
+		})
+	}
+}
+
+func TestAlertThresholdsInAccountCurrency(t *testing.T) {
+	openTestDB(t)
+	// The thresholds are 1,000 and 50,000 KES: USD 7.75 and USD 387.60
+	err := withTx(func(tx *sql.Tx) error {
+		return setExchangeRate(tx, "USD", "KES", 129*money.RateScale, "test")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		currency string
+		amount   int64
+		balance  int64
+		want     []string
+	}{
+		{"large withdrawal in USD", "USD", 40000, 60000, []string{"large_withdrawal"}},
+		{"just under the USD equivalent", "USD", 38000, 62000, nil},
+		{"low balance in USD", "USD", 1000, 500, []string{"low_balance"}},
+		{"both in KES", "KES", 5000000, 50000, []string{"large_withdrawal", "low_balance"}},
+		{"no rate for EUR", "EUR", 10000000, 0, nil},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			account := testAccountIn(t, fmt.Sprintf("user%d", i), "current", test.currency, "")
+			data, _ := json.Marshal(map[string]interface{}{
+				"account_number": account.Number,
+				"type":           "withdraw",
+				"amount":         money.New(test.amount, test.currency),
+				"balance":        money.New(test.balance, test.currency),
+			})
+			e := Event{ID: uuid.New().String(), Type: "transaction.posted", Data: data, CreatedAt: time.Now()}
+			if err := withTx(func(tx *sql.Tx) error { return transactionNotifications(tx, e) }); err != nil {
+				t.Fatal(err)
+			}
+
+			rows, err := config.DB.Query("SELECT kind FROM notifications WHERE user_id=? ORDER BY kind", account.UserID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var kinds []string
+			for rows.Next() {
+				var kind string
+				if err := rows.Scan(&kind); err != nil {
+					t.Fatal(err)
+				}
+				kinds = append(kinds, kind)
+			}
+			if !reflect.DeepEqual(kinds, test.want) {
+				t.Fatalf("alerts %v, want %v", kinds, test.want)
+			}
+		})
+	}
+}
+
+func TestInstallmentEventsAreRaisedOnce(t *testing.T) {
+	openTestDB(t)
+	account := testAccount(t, "alice", "current", "")
+	_, err := config.DB.Exec(`
+		INSERT INTO loans (user_id, loan_id, amount, currency, interest_rate_bps, repayment_period, status, outstanding, disbursed_to)
+		VALUES (?, 'loan-1', 30000, 'KES', 0, 3, 'active', 30000, ?)`, account.UserID, account.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+	for seq, due := range []string{"2026-03-09", "2026-03-12", "2026-03-20"} {
+		_, err := config.DB.Exec("INSERT INTO loan_installments (loan_id, seq, due_date, amount_due) VALUES ('loan-1', ?, ?, 10000)", seq+1, due)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for run := 0; run < 2; run++ {
+		err := withTx(func(tx *sql.Tx) error {
+			if _, err := markOverdueInstallments(tx, now); err != nil {
+				return err
+			}
+			_, err := remindInstallmentsDue(tx, now)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := config.DB.Query("SELECT type, payload FROM outbox_events WHERE type LIKE 'loan.%' ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var raised []string
+	for rows.Next() {
+		var eventType, payload string
+		if err := rows.Scan(&eventType, &payload); err != nil {
+			t.Fatal(err)
+		}
+		var data struct {
+			Installment int    `json:"installment"`
+			DueDate     string `json:"due_date"`
+		}
+		if err := json.Unmarshal([]byte(payload), &data); err != nil {
+			t.Fatal(err)
+		}
+		raised = append(raised, fmt.Sprintf("%s %d %s", eventType, data.Installment, data.DueDate))
+	}
+	if want := []string{"loan.overdue 1 2026-03-09", "loan.installment_due 2 2026-03-12"}; !reflect.DeepEqual(raised, want) {
+		t.Fatalf("raised %v, want %v", raised, want)
+	}
+}
@@ -0,0 +1,638 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scopes an app can ask for on top of the API token scopes: openid gets it
+// an ID token and profile adds the customer's name to it
+var oidcScopes = map[string]string{
+	"openid":  "Confirm who you are",
+	"profile": "See your name and username",
+}
+
+// What a scope lets an app do, for the consent page
+func scopeDescription(scope string) string {
+	if description, ok := apiScopes[scope]; ok {
+		return description
+	}
+	return oidcScopes[scope]
+}
+
+// The audience of OAuth access tokens: the JSON API
+func oauthAudience() string {
+	return config.OAuthIssuer + "/api/v1"
+}
+
+// oauthError is an OAuth 2.0 error response. Code is one of the error
+// codes from RFC 6749, such as "invalid_grant".
+type oauthError struct {
+	Status      int
+	Code        string
+	Description string
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// Write an OAuth error as the JSON body the token endpoints use
+func writeOAuthError(w http.ResponseWriter, err error) {
+	oe, ok := err.(*oauthError)
+	if !ok {
+		oe = &oauthError{http.StatusInternalServerError, "server_error", "The request could not be completed"}
+	}
+	if oe.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	writeOAuthJSON(w, oe.Status, map[string]string{"error": oe.Code, "error_description": oe.Description})
+}
+
+// Write a token endpoint response, which must never be cached
+func writeOAuthJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Send the browser back to an app with the result of an authorization
+// request added to the redirect URI's query
+func redirectToClient(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, _ := url.Parse(redirectURI)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// authorizeRequest is a validated request for a customer's consent
+type authorizeRequest struct {
+	Client        OAuthClient
+	RedirectURI   string
+	State         string
+	Scopes        []string
+	CodeChallenge string
+	Nonce         string
+}
+
+// Validate the parameters of an authorization request. A bankError means
+// the app or redirect URI is not trusted, so the customer must not be sent
+// back; an oauthError can be reported to the app at its redirect URI.
+func parseAuthorizeRequest(values url.Values) (authorizeRequest, error) {
+	var req authorizeRequest
+	client, err := getOAuthClient(values.Get("client_id"))
+	if err == sql.ErrNoRows {
+		return req, &bankError{http.StatusBadRequest, "Unknown application"}
+	} else if err != nil {
+		return req, err
+	}
+	if !client.allowsRedirect(values.Get("redirect_uri")) {
+		return req, &bankError{http.StatusBadRequest, "The application's redirect URI is not registered"}
+	}
+
+	req = authorizeRequest{
+		Client:        client,
+		RedirectURI:   values.Get("redirect_uri"),
+		State:         values.Get("state"),
+		Scopes:        strings.Fields(values.Get("scope")),
+		CodeChallenge: values.Get("code_challenge"),
+		Nonce:         values.Get("nonce"),
+	}
+	if values.Get("response_type") != "code" {
+		return req, &oauthError{http.StatusBadRequest, "unsupported_response_type", "Only the code response type is supported"}
+	}
+	if req.CodeChallenge == "" || values.Get("code_challenge_method") != "S256" {
+		return req, &oauthError{http.StatusBadRequest, "invalid_request", "PKCE with the S256 method is required"}
+	}
+	if len(req.Scopes) == 0 {
+		return req, &oauthError{http.StatusBadRequest, "invalid_scope", "No scope was requested"}
+	}
+	for _, scope := range req.Scopes {
+		if !client.allowsScope(scope) {
+			return req, &oauthError{http.StatusBadRequest, "invalid_scope", "The application may not request " + scope}
+		}
+	}
+	return req, nil
+}
+
+// Report an authorization request that failed validation: untrusted apps
+// get an error page, trusted ones an error at their redirect URI
+func authorizeError(w http.ResponseWriter, r *http.Request, req authorizeRequest, err error) {
+	if oe, ok := err.(*oauthError); ok {
+		params := url.Values{"error": {oe.Code}, "error_description": {oe.Description}}
+		if req.State != "" {
+			params.Set("state", req.State)
+		}
+		redirectToClient(w, r, req.RedirectURI, params)
+		return
+	}
+	if be, ok := err.(*bankError); ok {
+		ErrorPage(w, r, be.Status, be.Message)
+		return
+	}
+	ErrorPage(w, r, http.StatusInternalServerError, "Failed to authorize application")
+}
+
+// A token tying the consent form to the session that was shown it, so
+// another site cannot submit consent on a customer's behalf
+func consentToken(r *http.Request) string {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(cookie.Value))
+	mac.Write([]byte("oauth-consent"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// OAuthAuthorize asks the logged in customer whether an app may act for
+// them, sending them to log in first if they have not
+func OAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	req, err := parseAuthorizeRequest(r.URL.Query())
+	if err != nil {
+		authorizeError(w, r, req, err)
+		return
+	}
+
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	type scope struct {
+		Name        string
+		Description string
+	}
+	var scopes []scope
+	for _, name := range req.Scopes {
+		scopes = append(scopes, scope{name, scopeDescription(name)})
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/oauth_consent.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Client":       req.Client,
+		"Scopes":       scopes,
+		"Params":       r.URL.Query(),
+		"ConsentToken": consentToken(r),
+	})
+}
+
+// OAuthConsent records the customer's answer on the consent page and sends
+// them back to the app with an authorization code or an access_denied error
+func OAuthConsent(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid form")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostForm.Get("consent_token")), []byte(consentToken(r))) != 1 {
+		ErrorPage(w, r, http.StatusForbidden, "The consent form has expired, please try again from the application")
+		return
+	}
+
+	req, err := parseAuthorizeRequest(r.PostForm)
+	if err != nil {
+		authorizeError(w, r, req, err)
+		return
+	}
+	if r.PostForm.Get("decision") != "allow" {
+		authorizeError(w, r, req, &oauthError{http.StatusForbidden, "access_denied", "The customer declined"})
+		return
+	}
+
+	code, err := randomHex(32)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Failed to authorize application")
+		return
+	}
+	err = withTx(func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		grantID := uuid.New().String()
+		_, err := tx.Exec("INSERT INTO oauth_grants (grant_id, client_id, user_id, scopes, created_at) VALUES (?, ?, ?, ?, ?)",
+			grantID, req.Client.ID, userID, strings.Join(req.Scopes, " "), now.Format(dbTime))
+		if err != nil {
+			return err
+		}
+		var nonce interface{}
+		if req.Nonce != "" {
+			nonce = req.Nonce
+		}
+		_, err = tx.Exec("INSERT INTO oauth_codes (code_hash, grant_id, redirect_uri, code_challenge, nonce, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+			hashToken(code), grantID, req.RedirectURI, req.CodeChallenge, nonce, now.Add(config.OAuthCodeExpiry).Format(dbTime))
+		return err
+	})
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Failed to authorize application")
+		return
+	}
+
+	params := url.Values{"code": {code}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	redirectToClient(w, r, req.RedirectURI, params)
+}
+
+// Identify the app calling the token or revocation endpoint. Confidential
+// apps authenticate with their secret, by HTTP Basic auth or in the form;
+// public apps only name themselves and rely on PKCE.
+func authenticateOAuthClient(r *http.Request) (OAuthClient, error) {
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	invalid := &oauthError{http.StatusUnauthorized, "invalid_client", "Client authentication failed"}
+	client, err := getOAuthClient(clientID)
+	if err == sql.ErrNoRows {
+		return client, invalid
+	} else if err != nil {
+		return client, err
+	}
+	if client.secretHash != "" && subtle.ConstantTimeCompare([]byte(client.secretHash), []byte(hashToken(secret))) != 1 {
+		return client, invalid
+	}
+	return client, nil
+}
+
+// tokenResponse is what the token endpoint returns
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// OAuthToken exchanges an authorization code or a refresh token for an
+// access token, a new refresh token and, for the openid scope, an ID token
+func OAuthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, &oauthError{http.StatusBadRequest, "invalid_request", "Invalid form"})
+		return
+	}
+	client, err := authenticateOAuthClient(r)
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	var response tokenResponse
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		response, err = exchangeCode(client, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	case "refresh_token":
+		response, err = refreshAccess(client, r.PostForm.Get("refresh_token"), r.PostForm.Get("scope"))
+	default:
+		err = &oauthError{http.StatusBadRequest, "unsupported_grant_type", "Use authorization_code or refresh_token"}
+	}
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	writeOAuthJSON(w, http.StatusOK, response)
+}
+
+// errTokenReused stops a code or refresh token being redeemed twice
+var errTokenReused = errors.New("token already used")
+
+// Redeem an authorization code. A code presented twice means it leaked, so
+// the whole grant is revoked.
+func exchangeCode(client OAuthClient, code, redirectURI, verifier string) (tokenResponse, error) {
+	invalid := &oauthError{http.StatusBadRequest, "invalid_grant", "The authorization code is invalid or has expired"}
+
+	var grantID, codeRedirect, challenge, nonce, clientID, userID, scopes string
+	var expiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	err := config.DB.QueryRow(`
+		SELECT c.grant_id, c.redirect_uri, c.code_challenge, COALESCE(c.nonce, ''), c.expires_at, c.used_at,
+			g.client_id, g.user_id, g.scopes, g.revoked_at
+		FROM oauth_codes c JOIN oauth_grants g ON g.grant_id = c.grant_id
+		WHERE c.code_hash=?`, hashToken(code)).Scan(
+		&grantID, &codeRedirect, &challenge, &nonce, &expiresAt, &usedAt, &clientID, &userID, &scopes, &revokedAt)
+	if err == sql.ErrNoRows || (err == nil && clientID != client.ID) {
+		return tokenResponse{}, invalid
+	} else if err != nil {
+		return tokenResponse{}, err
+	}
+	if usedAt.Valid {
+		return tokenResponse{}, revokeReusedGrant(grantID, invalid)
+	}
+	if revokedAt.Valid || !time.Now().UTC().Before(expiresAt) || codeRedirect != redirectURI {
+		return tokenResponse{}, invalid
+	}
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return tokenResponse{}, &oauthError{http.StatusBadRequest, "invalid_grant", "A code_verifier of 43 to 128 characters is required"}
+	}
+	digest := sha256.Sum256([]byte(verifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(digest[:])), []byte(challenge)) != 1 {
+		return tokenResponse{}, &oauthError{http.StatusBadRequest, "invalid_grant", "The code_verifier does not match the code_challenge"}
+	}
+
+	var refresh string
+	err = withTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE oauth_codes SET used_at=? WHERE code_hash=? AND used_at IS NULL",
+			time.Now().UTC().Format(dbTime), hashToken(code))
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errTokenReused
+		}
+		refresh, err = insertRefreshToken(tx, grantID)
+		return err
+	})
+	if err == errTokenReused {
+		return tokenResponse{}, revokeReusedGrant(grantID, invalid)
+	} else if err != nil {
+		return tokenResponse{}, err
+	}
+	return issueTokens(client, grantID, userID, strings.Fields(scopes), nonce, refresh)
+}
+
+// Swap a refresh token for new tokens. Refresh tokens are single use: each
+// one is replaced by the next, and presenting a replaced one revokes the
+// grant since either the app or an attacker holds a stolen copy. scope may
+// narrow the grant's scopes for the new access token.
+func refreshAccess(client OAuthClient, token, scope string) (tokenResponse, error) {
+	invalid := &oauthError{http.StatusBadRequest, "invalid_grant", "The refresh token is invalid or has expired"}
+
+	var grantID, clientID, userID, scopes string
+	var expiresAt time.Time
+	var tokenRevoked, grantRevoked sql.NullTime
+	err := config.DB.QueryRow(`
+		SELECT t.grant_id, t.expires_at, t.revoked_at, g.client_id, g.user_id, g.scopes, g.revoked_at
+		FROM oauth_refresh_tokens t JOIN oauth_grants g ON g.grant_id = t.grant_id
+		WHERE t.token_hash=?`, hashToken(token)).Scan(
+		&grantID, &expiresAt, &tokenRevoked, &clientID, &userID, &scopes, &grantRevoked)
+	if err == sql.ErrNoRows || (err == nil && clientID != client.ID) {
+		return tokenResponse{}, invalid
+	} else if err != nil {
+		return tokenResponse{}, err
+	}
+	if grantRevoked.Valid || !time.Now().UTC().Before(expiresAt) {
+		return tokenResponse{}, invalid
+	}
+	if tokenRevoked.Valid {
+		return tokenResponse{}, revokeReusedGrant(grantID, invalid)
+	}
+
+	granted := strings.Fields(scopes)
+	if scope != "" {
+		requested := strings.Fields(scope)
+		for _, s := range requested {
+			if !strings.Contains(" "+scopes+" ", " "+s+" ") {
+				return tokenResponse{}, &oauthError{http.StatusBadRequest, "invalid_scope", s + " was not granted"}
+			}
+		}
+		granted = requested
+	}
+
+	var refresh string
+	err = withTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE oauth_refresh_tokens SET revoked_at=? WHERE token_hash=? AND revoked_at IS NULL",
+			time.Now().UTC().Format(dbTime), hashToken(token))
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errTokenReused
+		}
+		refresh, err = insertRefreshToken(tx, grantID)
+		return err
+	})
+	if err == errTokenReused {
+		return tokenResponse{}, revokeReusedGrant(grantID, invalid)
+	} else if err != nil {
+		return tokenResponse{}, err
+	}
+	return issueTokens(client, grantID, userID, granted, "", refresh)
+}
+
+// Store a new refresh token for a grant and return it
+func insertRefreshToken(tx *sql.Tx, grantID string) (string, error) {
+	random, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	token := "bprt_" + random
+	now := time.Now().UTC()
+	_, err = tx.Exec("INSERT INTO oauth_refresh_tokens (token_hash, grant_id, expires_at, created_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), grantID, now.Add(config.OAuthRefreshTokenExpiry).Format(dbTime), now.Format(dbTime))
+	return token, err
+}
+
+// Revoke a grant whose code or refresh token was used twice and return
+// the error to give the caller
+func revokeReusedGrant(grantID string, err error) error {
+	if revokeErr := revokeGrant(grantID); revokeErr != nil {
+		return revokeErr
+	}
+	return err
+}
+
+// Withdraw an app's access: its refresh tokens stop working at once and
+// access tokens already issued are refused by the API
+func revokeGrant(grantID string) error {
+	return withTx(func(tx *sql.Tx) error {
+		now := time.Now().UTC().Format(dbTime)
+		_, err := tx.Exec("UPDATE oauth_grants SET revoked_at=? WHERE grant_id=? AND revoked_at IS NULL", now, grantID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE oauth_refresh_tokens SET revoked_at=? WHERE grant_id=? AND revoked_at IS NULL", now, grantID)
+		return err
+	})
+}
+
+// Sign an access token for the grant and, if openid was granted, an ID
+// token for the app
+func issueTokens(client OAuthClient, grantID, userID string, scopes []string, nonce, refresh string) (tokenResponse, error) {
+	now := time.Now().UTC()
+	expires := now.Add(config.OAuthAccessTokenExpiry)
+	scope := strings.Join(scopes, " ")
+
+	access, err := signJWT(jwtClaims{
+		Issuer: config.OAuthIssuer, Subject: userID, Audience: oauthAudience(),
+		ExpiresAt: expires.Unix(), IssuedAt: now.Unix(), ID: uuid.New().String(),
+		ClientID: client.ID, GrantID: grantID, Scope: scope,
+	})
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	response := tokenResponse{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(config.OAuthAccessTokenExpiry / time.Second),
+		RefreshToken: refresh,
+		Scope:        scope,
+	}
+
+	if strings.Contains(" "+scope+" ", " openid ") {
+		claims := jwtClaims{
+			Issuer: config.OAuthIssuer, Subject: userID, Audience: client.ID,
+			ExpiresAt: expires.Unix(), IssuedAt: now.Unix(), Nonce: nonce,
+		}
+		if strings.Contains(" "+scope+" ", " profile ") {
+			err := config.DB.QueryRow("SELECT name, user_name FROM users WHERE user_id=?", userID).Scan(&claims.Name, &claims.PreferredUsername)
+			if err != nil {
+				return tokenResponse{}, err
+			}
+		}
+		if response.IDToken, err = signJWT(claims); err != nil {
+			return tokenResponse{}, err
+		}
+	}
+	return response, nil
+}
+
+// Check an OAuth access token presented to the API. The grant behind it
+// must still stand and the app must not have been disabled.
+func authenticateOAuthToken(token string) (string, APIToken, error) {
+	invalid := &bankError{http.StatusUnauthorized, "Invalid or expired access token"}
+	claims, err := parseJWT(token, oauthAudience())
+	if err == errInvalidJWT {
+		return "", APIToken{}, invalid
+	} else if err != nil {
+		return "", APIToken{}, err
+	}
+
+	var name string
+	var grantRevoked, clientDisabled sql.NullTime
+	err = config.DB.QueryRow(`
+		SELECT c.name, g.revoked_at, c.disabled_at
+		FROM oauth_grants g JOIN oauth_clients c ON c.client_id = g.client_id
+		WHERE g.grant_id=? AND g.user_id=?`, claims.GrantID, claims.Subject).Scan(&name, &grantRevoked, &clientDisabled)
+	if err == sql.ErrNoRows || grantRevoked.Valid || clientDisabled.Valid {
+		return "", APIToken{}, invalid
+	} else if err != nil {
+		return "", APIToken{}, err
+	}
+
+	return claims.Subject, APIToken{
+		ID:        claims.GrantID,
+		Kind:      "oauth",
+		Name:      name,
+		ClientID:  claims.ClientID,
+		Scopes:    strings.Fields(claims.Scope),
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+	}, nil
+}
+
+// OAuthUserInfo returns the claims about the customer an access token with
+// the openid scope was granted for
+func OAuthUserInfo(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	userID, t, err := authenticateOAuthToken(token)
+	if err != nil || !t.HasScope("openid") {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+
+	info := map[string]string{"sub": userID}
+	if t.HasScope("profile") {
+		var name, username string
+		if err := config.DB.QueryRow("SELECT name, user_name FROM users WHERE user_id=?", userID).Scan(&name, &username); err != nil {
+			writeOAuthError(w, err)
+			return
+		}
+		info["name"], info["preferred_username"] = name, username
+	}
+	writeOAuthJSON(w, http.StatusOK, info)
+}
+
+// OAuthRevoke lets an app give up a refresh or access token (RFC 7009).
+// Either one revokes the whole grant it belongs to. Unknown tokens are not
+// an error.
+func OAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, &oauthError{http.StatusBadRequest, "invalid_request", "Invalid form"})
+		return
+	}
+	client, err := authenticateOAuthClient(r)
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	var grantID string
+	err = config.DB.QueryRow(`
+		SELECT t.grant_id FROM oauth_refresh_tokens t JOIN oauth_grants g ON g.grant_id = t.grant_id
+		WHERE t.token_hash=? AND g.client_id=?`, hashToken(token), client.ID).Scan(&grantID)
+	if err == sql.ErrNoRows {
+		if claims, jwtErr := parseJWT(token, oauthAudience()); jwtErr == nil && claims.ClientID == client.ID {
+			grantID, err = claims.GrantID, nil
+		}
+	}
+	if err != nil && err != sql.ErrNoRows {
+		writeOAuthError(w, err)
+		return
+	}
+	if grantID != "" {
+		if err := revokeGrant(grantID); err != nil {
+			writeOAuthError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// OAuthJWKS publishes the keys that verify the bank's tokens
+func OAuthJWKS(w http.ResponseWriter, r *http.Request) {
+	set, err := jwks()
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(set)
+}
+
+// OpenIDConfiguration describes the provider for OpenID Connect discovery
+func OpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	scopes := append(sortedKeys(map[string]bool{"openid": true, "profile": true}), apiScopeNames()...)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                config.OAuthIssuer,
+		"authorization_endpoint":                config.OAuthIssuer + "/oauth/authorize",
+		"token_endpoint":                        config.OAuthIssuer + "/oauth/token",
+		"userinfo_endpoint":                     config.OAuthIssuer + "/oauth/userinfo",
+		"revocation_endpoint":                   config.OAuthIssuer + "/oauth/revoke",
+		"jwks_uri":                              config.OAuthIssuer + "/oauth/jwks.json",
+		"scopes_supported":                      scopes,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"claims_supported":                      []string{"sub", "name", "preferred_username"},
+	})
+}
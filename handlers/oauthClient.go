@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"database/sql"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OAuthClient is a third-party app registered to ask customers for access.
+// Confidential apps have a secret; public ones, such as apps running on
+// the customer's own device, rely on PKCE alone.
+type OAuthClient struct {
+	ID           string
+	Name         string
+	Confidential bool
+	RedirectURIs []string
+	Scopes       []string
+	CreatedAt    time.Time
+	DisabledAt   sql.NullTime
+	secretHash   string
+}
+
+// Report whether uri exactly matches one of the app's redirect URIs
+func (c OAuthClient) allowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether the app may ask for a scope
+func (c OAuthClient) allowsScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+const oauthClientColumns = "client_id, name, COALESCE(secret_hash, ''), redirect_uris, scopes, created_at, disabled_at"
+
+func scanOAuthClient(row scanner) (OAuthClient, error) {
+	var c OAuthClient
+	var redirectURIs, scopes string
+	err := row.Scan(&c.ID, &c.Name, &c.secretHash, &redirectURIs, &scopes, &c.CreatedAt, &c.DisabledAt)
+	c.Confidential = c.secretHash != ""
+	c.RedirectURIs = strings.Fields(redirectURIs)
+	c.Scopes = strings.Fields(scopes)
+	return c, err
+}
+
+// Fetch an app that has not been disabled
+func getOAuthClient(clientID string) (OAuthClient, error) {
+	return scanOAuthClient(config.DB.QueryRow("SELECT "+oauthClientColumns+" FROM oauth_clients WHERE client_id=? AND disabled_at IS NULL", clientID))
+}
+
+// Make sure a redirect URI is absolute, has no fragment and uses HTTPS,
+// except on localhost so apps can be tried out locally
+func checkRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return &bankError{http.StatusBadRequest, "Invalid redirect URI " + uri}
+	}
+	local := u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1"
+	if u.Scheme != "https" && !(u.Scheme == "http" && local) {
+		return &bankError{http.StatusBadRequest, "Redirect URIs must use https unless they are on localhost"}
+	}
+	return nil
+}
+
+// Register an app. It returns the client ID and, for confidential apps,
+// the secret, which is only shown once.
+func createOAuthClient(name string, redirectURIs, scopes []string, confidential bool, adminID string) (string, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", "", &bankError{http.StatusBadRequest, "A name is required"}
+	}
+	if len(redirectURIs) == 0 {
+		return "", "", &bankError{http.StatusBadRequest, "At least one redirect URI is required"}
+	}
+	for _, uri := range redirectURIs {
+		if err := checkRedirectURI(uri); err != nil {
+			return "", "", err
+		}
+	}
+	if len(scopes) == 0 {
+		return "", "", &bankError{http.StatusBadRequest, "Choose at least one scope"}
+	}
+	for _, scope := range scopes {
+		if scopeDescription(scope) == "" {
+			return "", "", &bankError{http.StatusBadRequest, "Unknown scope " + scope}
+		}
+	}
+
+	clientID, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	var secret string
+	var secretHash interface{}
+	if confidential {
+		if secret, err = randomHex(32); err != nil {
+			return "", "", err
+		}
+		secretHash = hashToken(secret)
+	}
+
+	_, err = config.DB.Exec(`
+		INSERT INTO oauth_clients (client_id, name, secret_hash, redirect_uris, scopes, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		clientID, name, secretHash, strings.Join(redirectURIs, " "), strings.Join(scopes, " "), adminID, time.Now().UTC().Format(dbTime))
+	return clientID, secret, err
+}
+
+// AdminOAuthClients lists the registered apps with a form to add another
+func AdminOAuthClients(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	renderOAuthClients(w, r, nil)
+}
+
+// Render the app list, showing a newly registered app's credentials if
+// there are any
+func renderOAuthClients(w http.ResponseWriter, r *http.Request, created map[string]string) {
+	rows, err := config.DB.Query("SELECT " + oauthClientColumns + " FROM oauth_clients ORDER BY id DESC")
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var clients []OAuthClient
+	for rows.Next() {
+		c, err := scanOAuthClient(rows)
+		if err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		clients = append(clients, c)
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/admin_oauth_clients.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Clients": clients,
+		"Scopes":  append(sortedKeys(map[string]bool{"openid": true, "profile": true}), apiScopeNames()...),
+		"Created": created,
+		"Issuer":  config.OAuthIssuer,
+	})
+}
+
+// CreateOAuthClient registers an app and shows its credentials once
+func CreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid form")
+		return
+	}
+
+	clientID, secret, err := createOAuthClient(r.PostForm.Get("name"), strings.Fields(r.PostForm.Get("redirect_uris")),
+		r.PostForm["scopes"], r.PostForm.Get("confidential") != "", adminID)
+	if err != nil {
+		adminError(w, r, err, "Failed to register application")
+		return
+	}
+
+	renderOAuthClients(w, r, map[string]string{"ClientID": clientID, "Secret": secret})
+}
+
+// DisableOAuthClient stops an app signing anyone in or using the tokens it
+// already holds
+func DisableOAuthClient(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	result, err := config.DB.Exec("UPDATE oauth_clients SET disabled_at=? WHERE client_id=? AND disabled_at IS NULL",
+		time.Now().UTC().Format(dbTime), mux.Vars(r)["id"])
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		ErrorPage(w, r, http.StatusNotFound, "Application not found")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/oauth-clients", http.StatusSeeOther)
+}
+
+// ConnectedApp is an app a customer has given access to
+type ConnectedApp struct {
+	GrantID   string
+	Name      string
+	Scopes    []string
+	CreatedAt time.Time
+}
+
+// The apps a user has given access to that can still refresh their tokens
+func getConnectedApps(userID string) ([]ConnectedApp, error) {
+	rows, err := config.DB.Query(`
+		SELECT g.grant_id, c.name, g.scopes, g.created_at
+		FROM oauth_grants g JOIN oauth_clients c ON c.client_id = g.client_id
+		WHERE g.user_id=? AND g.revoked_at IS NULL AND c.disabled_at IS NULL
+		AND EXISTS (SELECT 1 FROM oauth_refresh_tokens t WHERE t.grant_id = g.grant_id AND t.revoked_at IS NULL AND t.expires_at > ?)
+		ORDER BY g.id DESC`, userID, time.Now().UTC().Format(dbTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apps []ConnectedApp
+	for rows.Next() {
+		var app ConnectedApp
+		var scopes string
+		if err := rows.Scan(&app.GrantID, &app.Name, &scopes, &app.CreatedAt); err != nil {
+			return nil, err
+		}
+		app.Scopes = strings.Fields(scopes)
+		apps = append(apps, app)
+	}
+	return apps, rows.Err()
+}
+
+// RevokeOAuthGrant withdraws the access the logged in user gave an app
+func RevokeOAuthGrant(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	grantID := mux.Vars(r)["id"]
+	var owner string
+	err = config.DB.QueryRow("SELECT user_id FROM oauth_grants WHERE grant_id=?", grantID).Scan(&owner)
+	if err == sql.ErrNoRows || owner != userID {
+		ErrorPage(w, r, http.StatusNotFound, "Connected app not found")
+		return
+	} else if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	if err := revokeGrant(grantID); err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Failed to revoke access")
+		return
+	}
+	http.Redirect(w, r, "/api-tokens", http.StatusSeeOther)
+}
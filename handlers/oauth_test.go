@@ -0,0 +1,303 @@
+package handlers_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// oauthApp is a local third-party app: it receives the customer back at its
+// callback and talks to the bank's token endpoints
+type oauthApp struct {
+	t        *testing.T
+	bank     string
+	clientID string
+	callback string
+	verifier string
+
+	// The query the bank last sent the customer back to the callback with
+	received url.Values
+}
+
+// Start an app with a callback server and register it with the bank as a
+// public client
+func newOAuthApp(t *testing.T, bank string, admin *http.Client, scopes ...string) *oauthApp {
+	t.Helper()
+	app := &oauthApp{t: t, bank: bank, verifier: strings.Repeat("v", 43)}
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.received = r.URL.Query()
+	}))
+	t.Cleanup(callback.Close)
+	app.callback = callback.URL + "/callback"
+
+	response, err := admin.PostForm(bank+"/admin/oauth-clients", url.Values{
+		"name": {"Budget App"}, "redirect_uris": {app.callback}, "scopes": scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	match := regexp.MustCompile(`<code id="client-id">([^<]+)</code>`).FindSubmatch(page)
+	if match == nil {
+		t.Fatalf("registering the app: status %d", response.StatusCode)
+	}
+	app.clientID = string(match[1])
+	return app
+}
+
+// The PKCE challenge for the app's verifier
+func (app *oauthApp) challenge() string {
+	digest := sha256.Sum256([]byte(app.verifier))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// The query of an authorization request for the app
+func (app *oauthApp) authorizeParams(scope string) url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {app.clientID},
+		"redirect_uri":          {app.callback},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {app.challenge()},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// Follow a redirect from the bank to the app's callback and return what the
+// app received
+func (app *oauthApp) follow(response *http.Response) url.Values {
+	app.t.Helper()
+	location := response.Header.Get("Location")
+	if response.StatusCode != http.StatusFound || !strings.HasPrefix(location, app.callback+"?") {
+		app.t.Fatalf("want a redirect to the app, got status %d to %q", response.StatusCode, location)
+	}
+	app.received = nil
+	callback, err := http.Get(location)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	callback.Body.Close()
+	return app.received
+}
+
+// Have the customer allow or deny the app on the consent page and return
+// what the app received at its callback
+func (app *oauthApp) consent(customer *http.Client, scope, decision string) url.Values {
+	app.t.Helper()
+	params := app.authorizeParams(scope)
+	response, err := customer.Get(app.bank + "/oauth/authorize?" + params.Encode())
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	page, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	match := regexp.MustCompile(`name="consent_token" value="([^"]+)"`).FindSubmatch(page)
+	if response.StatusCode != http.StatusOK || match == nil {
+		app.t.Fatalf("consent page: status %d", response.StatusCode)
+	}
+
+	params.Set("consent_token", string(match[1]))
+	params.Set("decision", decision)
+	response, err = customer.PostForm(app.bank+"/oauth/authorize", params)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	response.Body.Close()
+	return app.follow(response)
+}
+
+// Get an authorization code from the customer
+func (app *oauthApp) code(customer *http.Client, scope string) string {
+	app.t.Helper()
+	received := app.consent(customer, scope, "allow")
+	if received.Get("code") == "" || received.Get("state") != "xyz" {
+		app.t.Fatalf("app received %v, want a code and its state", received)
+	}
+	return received.Get("code")
+}
+
+// Call one of the bank's OAuth endpoints as the app and return the status
+// and decoded body
+func (app *oauthApp) post(path string, form url.Values) (int, map[string]interface{}) {
+	app.t.Helper()
+	form.Set("client_id", app.clientID)
+	response, err := http.PostForm(app.bank+path, form)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(response.Body).Decode(&body)
+	return response.StatusCode, body
+}
+
+// Exchange a code for tokens, failing the test unless the bank answers with
+// want
+func (app *oauthApp) exchange(code, redirectURI, verifier string, want int) map[string]interface{} {
+	app.t.Helper()
+	status, body := app.post("/oauth/token", url.Values{
+		"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}, "code_verifier": {verifier}})
+	if status != want {
+		app.t.Fatalf("exchanging the code: status %d, want %d: %v", status, want, body)
+	}
+	return body
+}
+
+// Refresh tokens, failing the test unless the bank answers with want
+func (app *oauthApp) refresh(token string, want int) map[string]interface{} {
+	app.t.Helper()
+	status, body := app.post("/oauth/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token}})
+	if status != want {
+		app.t.Fatalf("refreshing: status %d, want %d: %v", status, want, body)
+	}
+	return body
+}
+
+// The status the JSON API answers a request with an access token with
+func apiStatus(t *testing.T, bank string, accessToken interface{}) int {
+	t.Helper()
+	request, _ := http.NewRequest("GET", bank+"/api/v1/accounts", nil)
+	request.Header.Set("Authorization", "Bearer "+accessToken.(string))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	_, server := startTestServer(t)
+	bank := server.URL
+	c := &apiChecker{t: t, server: bank}
+	customer, err := c.signUp("oauth_alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := c.signUp("oauth_admin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newOAuthApp(t, bank, admin, "openid", "profile", "balances:read")
+	const scope = "openid profile balances:read"
+
+	t.Run("untrusted redirect uri", func(t *testing.T) {
+		params := app.authorizeParams(scope)
+		params.Set("redirect_uri", app.callback+"/other")
+		response, err := customer.Get(bank + "/oauth/authorize?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusBadRequest || response.Header.Get("Location") != "" {
+			t.Fatalf("status %d to %q, want an error page and no redirect", response.StatusCode, response.Header.Get("Location"))
+		}
+	})
+
+	t.Run("pkce required", func(t *testing.T) {
+		params := app.authorizeParams(scope)
+		params.Set("code_challenge_method", "plain")
+		response, err := customer.Get(bank + "/oauth/authorize?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if received := app.follow(response); received.Get("error") != "invalid_request" || received.Get("state") != "xyz" {
+			t.Fatalf("app received %v, want invalid_request", received)
+		}
+	})
+
+	t.Run("scope not allowed", func(t *testing.T) {
+		params := app.authorizeParams("payments:write")
+		response, err := customer.Get(bank + "/oauth/authorize?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if received := app.follow(response); received.Get("error") != "invalid_scope" {
+			t.Fatalf("app received %v, want invalid_scope", received)
+		}
+	})
+
+	t.Run("customer declines", func(t *testing.T) {
+		if received := app.consent(customer, scope, "deny"); received.Get("error") != "access_denied" || received.Get("code") != "" {
+			t.Fatalf("app received %v, want access_denied", received)
+		}
+	})
+
+	t.Run("code exchange and refresh rotation", func(t *testing.T) {
+		code := app.code(customer, scope)
+		app.exchange(code, app.callback+"/other", app.verifier, http.StatusBadRequest)
+		app.exchange(code, app.callback, strings.Repeat("v", 42), http.StatusBadRequest)
+		app.exchange(code, app.callback, strings.Repeat("w", 43), http.StatusBadRequest)
+		app.exchange(code, app.callback, strings.Repeat("v", 129), http.StatusBadRequest)
+		tokens := app.exchange(code, app.callback, app.verifier, http.StatusOK)
+		if tokens["token_type"] != "Bearer" || tokens["scope"] != scope || tokens["id_token"] == nil || tokens["refresh_token"] == nil {
+			t.Fatalf("token response %v", tokens)
+		}
+		if status := apiStatus(t, bank, tokens["access_token"]); status != http.StatusOK {
+			t.Fatalf("API answered the access token with %d", status)
+		}
+
+		request, _ := http.NewRequest("GET", bank+"/oauth/userinfo", nil)
+		request.Header.Set("Authorization", "Bearer "+tokens["access_token"].(string))
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info map[string]string
+		json.NewDecoder(response.Body).Decode(&info)
+		response.Body.Close()
+		if info["preferred_username"] != "oauth_alice" || info["sub"] == "" {
+			t.Fatalf("userinfo %v", info)
+		}
+
+		// Each refresh token works once and is replaced by the next
+		rotated := app.refresh(tokens["refresh_token"].(string), http.StatusOK)
+		if rotated["refresh_token"] == tokens["refresh_token"] {
+			t.Fatal("refresh token was not rotated")
+		}
+		narrowed := app.refresh(rotated["refresh_token"].(string), http.StatusOK)
+		if status := apiStatus(t, bank, narrowed["access_token"]); status != http.StatusOK {
+			t.Fatalf("API answered the refreshed access token with %d", status)
+		}
+
+		// Presenting a replaced refresh token means it was stolen: the
+		// whole grant goes, including the newest tokens
+		app.refresh(tokens["refresh_token"].(string), http.StatusBadRequest)
+		app.refresh(narrowed["refresh_token"].(string), http.StatusBadRequest)
+		if status := apiStatus(t, bank, narrowed["access_token"]); status != http.StatusUnauthorized {
+			t.Fatalf("API answered a revoked grant's access token with %d", status)
+		}
+	})
+
+	t.Run("reused code revokes the grant", func(t *testing.T) {
+		code := app.code(customer, scope)
+		tokens := app.exchange(code, app.callback, app.verifier, http.StatusOK)
+		app.exchange(code, app.callback, app.verifier, http.StatusBadRequest)
+		if status := apiStatus(t, bank, tokens["access_token"]); status != http.StatusUnauthorized {
+			t.Fatalf("API answered the access token with %d after the code was reused", status)
+		}
+		app.refresh(tokens["refresh_token"].(string), http.StatusBadRequest)
+	})
+
+	t.Run("app revokes its tokens", func(t *testing.T) {
+		tokens := app.exchange(app.code(customer, scope), app.callback, app.verifier, http.StatusOK)
+		if status, body := app.post("/oauth/revoke", url.Values{"token": {tokens["refresh_token"].(string)}}); status != http.StatusOK {
+			t.Fatalf("revoking: status %d: %v", status, body)
+		}
+		if status := apiStatus(t, bank, tokens["access_token"]); status != http.StatusUnauthorized {
+			t.Fatalf("API answered a revoked access token with %d", status)
+		}
+		app.refresh(tokens["refresh_token"].(string), http.StatusBadRequest)
+	})
+}
@@ -0,0 +1,255 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// apiDocument is a parsed OpenAPI 3 document, reduced to what is needed to
+// check that responses match it: paths, operations and their response
+// schemas. Schemas support $ref, type, properties, required, items, enum,
+// oneOf and additionalProperties, which is all the bank's API document uses.
+type apiDocument struct {
+	OpenAPI    string                             `json:"openapi"`
+	Servers    []apiServer                        `json:"servers"`
+	Paths      map[string]map[string]apiOperation `json:"paths"`
+	Components struct {
+		Responses map[string]apiResponse `json:"responses"`
+		Schemas   map[string]*apiSchema  `json:"schemas"`
+	} `json:"components"`
+}
+
+// apiServer is a base URL the paths are relative to
+type apiServer struct {
+	URL string `json:"url"`
+}
+
+// apiOperation is one method on one path. Scope is the bank's
+// x-required-scope extension: the scope an API token needs to call it.
+type apiOperation struct {
+	OperationID string                 `json:"operationId"`
+	Scope       string                 `json:"x-required-scope"`
+	Responses   map[string]apiResponse `json:"responses"`
+}
+
+// apiResponse is a documented response, or a reference to one in components
+type apiResponse struct {
+	Ref         string `json:"$ref"`
+	Description string `json:"description"`
+	Content     map[string]struct {
+		Schema *apiSchema `json:"schema"`
+	} `json:"content"`
+}
+
+// apiSchema describes a JSON value
+type apiSchema struct {
+	Ref                  string                `json:"$ref"`
+	Type                 string                `json:"type"`
+	Properties           map[string]*apiSchema `json:"properties"`
+	Required             []string              `json:"required"`
+	Items                *apiSchema            `json:"items"`
+	Enum                 []interface{}         `json:"enum"`
+	OneOf                []*apiSchema          `json:"oneOf"`
+	AdditionalProperties *bool                 `json:"additionalProperties"`
+}
+
+// parseAPIDocument reads an OpenAPI document
+func parseAPIDocument(data []byte) (*apiDocument, error) {
+	var doc apiDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version %q", doc.OpenAPI)
+	}
+	return &doc, nil
+}
+
+// BasePath is the path of the first server, which the document's paths
+// are relative to
+func (d *apiDocument) BasePath() string {
+	if len(d.Servers) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(d.Servers[0].URL, "/")
+}
+
+// Find returns the path template and operation that a request for method
+// and path, relative to BasePath, is handled by
+func (d *apiDocument) Find(method, path string) (string, apiOperation, bool) {
+	for template, operations := range d.Paths {
+		if matchPath(template, path) {
+			op, ok := operations[strings.ToLower(method)]
+			return template, op, ok
+		}
+	}
+	return "", apiOperation{}, false
+}
+
+// Report whether path fits a template such as /loans/{id}
+func matchPath(template, path string) bool {
+	want := strings.Split(strings.Trim(template, "/"), "/")
+	got := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if strings.HasPrefix(want[i], "{") && strings.HasSuffix(want[i], "}") {
+			if got[i] == "" {
+				return false
+			}
+			continue
+		}
+		if want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckResponse validates a JSON response body against the schema the
+// operation documents for status. It returns a description of every
+// mismatch, or nil if the body fits.
+func (d *apiDocument) CheckResponse(op apiOperation, status int, body []byte) []string {
+	response, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		return []string{fmt.Sprintf("status %d is not documented", status)}
+	}
+	if ref := response.Ref; ref != "" {
+		if response, ok = d.Components.Responses[strings.TrimPrefix(ref, "#/components/responses/")]; !ok {
+			return []string{"unknown response " + ref}
+		}
+	}
+
+	media, ok := response.Content["application/json"]
+	if !ok || media.Schema == nil {
+		if len(body) > 0 {
+			return []string{fmt.Sprintf("status %d documents no body", status)}
+		}
+		return nil
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return []string{"body is not JSON: " + err.Error()}
+	}
+	return d.Validate(media.Schema, value, "$")
+}
+
+// Validate checks a value decoded with UseNumber against schema. Objects
+// may only have the properties their schema lists unless it sets
+// additionalProperties, so fields added to a response without being
+// documented are caught.
+func (d *apiDocument) Validate(schema *apiSchema, value interface{}, at string) []string {
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		resolved, ok := d.Components.Schemas[name]
+		if !ok {
+			return []string{at + ": unknown schema " + schema.Ref}
+		}
+		return d.Validate(resolved, value, at)
+	}
+
+	if len(schema.OneOf) > 0 {
+		matched := 0
+		for _, option := range schema.OneOf {
+			if len(d.Validate(option, value, at)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return []string{fmt.Sprintf("%s: matches %d of the oneOf schemas", at, matched)}
+		}
+		return nil
+	}
+
+	var problems []string
+	if schema.Type != "" && !hasType(value, schema.Type) {
+		return []string{fmt.Sprintf("%s: want %s, got %s", at, schema.Type, typeOf(value))}
+	}
+	if len(schema.Enum) > 0 && !inEnum(value, schema.Enum) {
+		problems = append(problems, fmt.Sprintf("%s: %v is not one of %v", at, value, schema.Enum))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing required property %q", at, name))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := schema.Properties[name]
+			if !ok {
+				if schema.AdditionalProperties == nil || !*schema.AdditionalProperties {
+					problems = append(problems, fmt.Sprintf("%s: undocumented property %q", at, name))
+				}
+				continue
+			}
+			problems = append(problems, d.Validate(property, v[name], at+"."+name)...)
+		}
+	case []interface{}:
+		if schema.Items != nil {
+			for i, item := range v {
+				problems = append(problems, d.Validate(schema.Items, item, fmt.Sprintf("%s[%d]", at, i))...)
+			}
+		}
+	}
+	return problems
+}
+
+// Report whether a decoded value has a JSON schema type
+func hasType(value interface{}, want string) bool {
+	switch want {
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	}
+	return typeOf(value) == want
+}
+
+// The JSON schema type of a decoded value
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// Report whether value is one of the enum's values
+func inEnum(value interface{}, enum []interface{}) bool {
+	for _, option := range enum {
+		if fmt.Sprint(option) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
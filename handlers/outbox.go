@@ -0,0 +1,392 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Event is something that happened in the bank, such as a posting or a
+// loan decision. Events are written to the outbox in the same transaction
+// as the change they describe, so they exist exactly when the change was
+// committed.
+type Event struct {
+	// Seq orders events; subscribers see them in Seq order
+	Seq       int64
+	ID        string
+	Type      string
+	Data      json.RawMessage
+	CreatedAt time.Time
+}
+
+// A subscriber reacts to events from the outbox. It runs inside the
+// transaction that records it has seen the event, so its database changes
+// happen once; anything it does outside the database may be repeated if
+// the process stops before that transaction commits. Subscribers ignore
+// event types they have no interest in.
+type subscriber func(tx *sql.Tx, e Event) error
+
+// In-process subscribers by name. The name keys the subscriber's position
+// in the outbox. A subscriber added to a bank that already has events
+// starts after them rather than being handed its whole history.
+var subscribers = map[string]subscriber{
+	"in-app":        addNotifications,
+	"notifications": queueNotifications,
+	"webhooks":      queueWebhooks,
+}
+
+// Record an event in the outbox as part of tx
+func publishEvent(tx *sql.Tx, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO outbox_events (event_id, type, payload, created_at) VALUES (?, ?, ?, ?)",
+		uuid.New().String(), eventType, string(payload), time.Now().UTC().Format(dbTime))
+	return err
+}
+
+// Record a loan event carrying the loan as it is now
+func publishLoanEvent(tx *sql.Tx, eventType, loanID string) error {
+	l, err := scanLoan(tx.QueryRow("SELECT "+loanColumns+" FROM loans l JOIN users u ON u.user_id = l.user_id WHERE l.loan_id=?", loanID))
+	if err != nil {
+		return err
+	}
+	return publishEvent(tx, eventType, l)
+}
+
+// How far through the outbox a subscriber has got
+func subscriberPosition(q querier, name string) (int64, error) {
+	var seq int64
+	err := q.QueryRow("SELECT last_seq FROM outbox_positions WHERE subscriber=?", name).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// Give subscribers that have never run a position at the end of the outbox
+func seedSubscriberPositions() error {
+	now := time.Now().UTC().Format(dbTime)
+	for name := range subscribers {
+		_, err := config.DB.Exec(`
+			INSERT OR IGNORE INTO outbox_positions (subscriber, last_seq, updated_at)
+			SELECT ?, COALESCE(MAX(id), 0), ? FROM outbox_events`, name, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hand one subscriber the events it has not seen yet, oldest first. It
+// stops at the first event the subscriber fails on, so later events wait
+// until that one succeeds, unless the subscriber has now failed on it
+// config.EventMaxAttempts times in a row: then the event is parked in
+// outbox_dead_letters for an admin to retry and the subscriber moves on.
+// Returns how many events were handled.
+func dispatchTo(name string, handle subscriber) (int, error) {
+	after, err := subscriberPosition(config.DB, name)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := config.DB.Query("SELECT id, event_id, type, payload, created_at FROM outbox_events WHERE id > ? ORDER BY id LIMIT 100", after)
+	if err != nil {
+		return 0, err
+	}
+	var events []Event
+	for rows.Next() {
+		var e Event
+		var payload string
+		if err := rows.Scan(&e.Seq, &e.ID, &e.Type, &payload, &e.CreatedAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		e.Data = json.RawMessage(payload)
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	handled := 0
+	for _, e := range events {
+		err := withTx(func(tx *sql.Tx) error {
+			// Another dispatcher, such as the dispatch-events command,
+			// may have got here first
+			seen, err := subscriberPosition(tx, name)
+			if err != nil || seen >= e.Seq {
+				return err
+			}
+			if err := handle(tx, e); err != nil {
+				return err
+			}
+			return setSubscriberPosition(tx, name, e.Seq)
+		})
+		if err != nil {
+			parked, failErr := recordSubscriberFailure(name, e, err)
+			if failErr != nil {
+				return handled, failErr
+			}
+			if !parked {
+				return handled, fmt.Errorf("event %d (%s): %w", e.Seq, e.Type, err)
+			}
+			log.Printf("events: %s gave up on event %d (%s) after %d attempts: %v", name, e.Seq, e.Type, config.EventMaxAttempts, err)
+			continue
+		}
+		handled++
+	}
+	return handled, nil
+}
+
+// Move a subscriber past an event, clearing its failure count
+func setSubscriberPosition(tx *sql.Tx, name string, seq int64) error {
+	_, err := tx.Exec(`
+		INSERT INTO outbox_positions (subscriber, last_seq, failures, last_error, updated_at) VALUES (?, ?, 0, NULL, ?)
+		ON CONFLICT(subscriber) DO UPDATE SET last_seq=excluded.last_seq, failures=0, last_error=NULL, updated_at=excluded.updated_at`,
+		name, seq, time.Now().UTC().Format(dbTime))
+	return err
+}
+
+// Count a subscriber's failure on the event after its position. Once it
+// has failed config.EventMaxAttempts times the event is parked and the
+// subscriber moved past it, and recordSubscriberFailure reports true.
+func recordSubscriberFailure(name string, e Event, cause error) (bool, error) {
+	parked := false
+	err := withTx(func(tx *sql.Tx) error {
+		var seq int64
+		var failures int
+		err := tx.QueryRow("SELECT last_seq, failures FROM outbox_positions WHERE subscriber=?", name).Scan(&seq, &failures)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if seq >= e.Seq {
+			// Another dispatcher handled it in the meantime
+			return nil
+		}
+
+		now := time.Now().UTC().Format(dbTime)
+		failures++
+		if int64(failures) < config.EventMaxAttempts {
+			_, err = tx.Exec(`
+				INSERT INTO outbox_positions (subscriber, last_seq, failures, last_error, updated_at) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT(subscriber) DO UPDATE SET failures=excluded.failures, last_error=excluded.last_error, updated_at=excluded.updated_at`,
+				name, e.Seq-1, failures, cause.Error(), now)
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO outbox_dead_letters (subscriber, seq, attempts, last_error, failed_at) VALUES (?, ?, ?, ?, ?)",
+			name, e.Seq, failures, cause.Error(), now)
+		if err != nil {
+			return err
+		}
+		parked = true
+		return setSubscriberPosition(tx, name, e.Seq)
+	})
+	return parked, err
+}
+
+// DispatchEvents hands every subscriber the outbox events it has not seen
+// yet and returns a one line summary. A failing subscriber does not hold
+// up the others.
+func DispatchEvents() (string, error) {
+	if err := seedSubscriberPositions(); err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(subscribers))
+	for name := range subscribers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts, failures []string
+	for _, name := range names {
+		n, err := dispatchTo(name, subscribers[name])
+		if err != nil {
+			failures = append(failures, name+": "+err.Error())
+		}
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", name, n))
+		}
+	}
+
+	summary := ""
+	if len(parts) > 0 {
+		summary = "dispatched " + strings.Join(parts, ", ")
+	}
+	if len(failures) > 0 {
+		return summary, fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return summary, nil
+}
+
+// StartEventDispatcher dispatches outbox events every
+// config.EventPollInterval until the process exits
+func StartEventDispatcher() {
+	if config.EventPollInterval <= 0 {
+		return
+	}
+	// Before any request can publish an event, so a new subscriber starts
+	// with the first event published after the upgrade
+	if err := seedSubscriberPositions(); err != nil {
+		log.Printf("event dispatch failed: %v", err)
+	}
+
+	go func() {
+		for {
+			summary, err := DispatchEvents()
+			if err != nil {
+				log.Printf("event dispatch failed: %v", err)
+			}
+			if summary != "" {
+				log.Printf("events: %s", summary)
+			}
+			time.Sleep(config.EventPollInterval)
+		}
+	}()
+}
+
+// SubscriberStatus is how far an outbox subscriber has got
+type SubscriberStatus struct {
+	Name      string
+	LastSeq   int64
+	Behind    int
+	Failures  int
+	LastError string
+	UpdatedAt time.Time
+}
+
+// EventDeadLetter is an event a subscriber gave up on
+type EventDeadLetter struct {
+	ID         int64
+	Subscriber string
+	Seq        int64
+	EventID    string
+	EventType  string
+	Attempts   int
+	LastError  string
+	FailedAt   time.Time
+	RetriedAt  sql.NullTime
+}
+
+// AdminEvents shows how far each subscriber has got through the outbox and
+// the events they gave up on
+func AdminEvents(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	var statuses []SubscriberStatus
+	rows, err := config.DB.Query(`
+		SELECT p.subscriber, p.last_seq, (SELECT COUNT(*) FROM outbox_events e WHERE e.id > p.last_seq),
+			p.failures, COALESCE(p.last_error, ''), p.updated_at
+		FROM outbox_positions p ORDER BY p.subscriber`)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	for rows.Next() {
+		var s SubscriberStatus
+		if err := rows.Scan(&s.Name, &s.LastSeq, &s.Behind, &s.Failures, &s.LastError, &s.UpdatedAt); err != nil {
+			rows.Close()
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		statuses = append(statuses, s)
+	}
+	rows.Close()
+
+	var deadLetters []EventDeadLetter
+	rows, err = config.DB.Query(`
+		SELECT d.id, d.subscriber, d.seq, e.event_id, e.type, d.attempts, d.last_error, d.failed_at, d.retried_at
+		FROM outbox_dead_letters d JOIN outbox_events e ON e.id = d.seq
+		ORDER BY d.id DESC LIMIT 50`)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	for rows.Next() {
+		var d EventDeadLetter
+		if err := rows.Scan(&d.ID, &d.Subscriber, &d.Seq, &d.EventID, &d.EventType, &d.Attempts, &d.LastError, &d.FailedAt, &d.RetriedAt); err != nil {
+			rows.Close()
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		deadLetters = append(deadLetters, d)
+	}
+	rows.Close()
+
+	tmpl := template.Must(template.ParseFiles("templates/admin_events.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Subscribers": statuses,
+		"DeadLetters": deadLetters,
+		"MaxAttempts": config.EventMaxAttempts,
+	})
+}
+
+// Hand a parked event to its subscriber again. The dead letter is only
+// marked retried if the subscriber succeeds this time.
+func retryDeadEvent(id int64) error {
+	return withTx(func(tx *sql.Tx) error {
+		var name string
+		var retried sql.NullTime
+		var e Event
+		var payload string
+		err := tx.QueryRow(`
+			SELECT d.subscriber, d.retried_at, e.id, e.event_id, e.type, e.payload, e.created_at
+			FROM outbox_dead_letters d JOIN outbox_events e ON e.id = d.seq WHERE d.id=?`, id).
+			Scan(&name, &retried, &e.Seq, &e.ID, &e.Type, &payload, &e.CreatedAt)
+		if err == sql.ErrNoRows {
+			return &bankError{http.StatusNotFound, "Dead letter not found"}
+		} else if err != nil {
+			return err
+		}
+		if retried.Valid {
+			return &bankError{http.StatusBadRequest, "Event was already retried"}
+		}
+		handle, ok := subscribers[name]
+		if !ok {
+			return &bankError{http.StatusBadRequest, "Subscriber " + name + " no longer exists"}
+		}
+		e.Data = json.RawMessage(payload)
+
+		if err := handle(tx, e); err != nil {
+			return &bankError{http.StatusInternalServerError, "The subscriber failed again: " + err.Error()}
+		}
+		_, err = tx.Exec("UPDATE outbox_dead_letters SET retried_at=? WHERE id=?", time.Now().UTC().Format(dbTime), id)
+		return err
+	})
+}
+
+// RetryDeadEvent hands a parked event to its subscriber again
+func RetryDeadEvent(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		ErrorPage(w, r, http.StatusNotFound, "Dead letter not found")
+		return
+	}
+	if err := retryDeadEvent(id); err != nil {
+		adminError(w, r, err, "Failed to retry event")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/events", http.StatusSeeOther)
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"database/sql"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// recorder is a subscriber that remembers the events it was handed and
+// fails on the event types in failOn
+type recorder struct {
+	events []string
+	failOn map[string]bool
+}
+
+func (rec *recorder) handle(tx *sql.Tx, e Event) error {
+	rec.events = append(rec.events, e.Type)
+	if rec.failOn[e.Type] {
+		return errors.New("cannot handle " + e.Type)
+	}
+	return nil
+}
+
+// Replace the outbox subscribers with one recorder for the test
+func testSubscriber(t *testing.T) *recorder {
+	t.Helper()
+	rec := &recorder{failOn: map[string]bool{}}
+	saved := subscribers
+	subscribers = map[string]subscriber{"test": rec.handle}
+	t.Cleanup(func() { subscribers = saved })
+	if _, err := DispatchEvents(); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+// Publish an event in a transaction that commits, or rolls back if
+// rollback is set
+func testPublish(t *testing.T, eventType string, rollback bool) {
+	t.Helper()
+	rolledBack := errors.New("rolled back")
+	err := withTx(func(tx *sql.Tx) error {
+		if err := publishEvent(tx, eventType, map[string]string{"type": eventType}); err != nil {
+			return err
+		}
+		if rollback {
+			return rolledBack
+		}
+		return nil
+	})
+	if err != nil && err != rolledBack {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatchEventsDeliversCommittedEventsInOrder(t *testing.T) {
+	openTestDB(t)
+	rec := testSubscriber(t)
+
+	testPublish(t, "first", false)
+	testPublish(t, "rolled.back", true)
+	testPublish(t, "second", false)
+	testPublish(t, "third", false)
+	rec.failOn["third"] = true
+
+	// The subscriber fails on the third event, so it is offered again on
+	// the next run rather than skipped
+	if _, err := DispatchEvents(); err == nil {
+		t.Fatal("DispatchEvents did not report the failing subscriber")
+	}
+	if want := []string{"first", "second", "third"}; !reflect.DeepEqual(rec.events, want) {
+		t.Fatalf("subscriber got %v, want %v", rec.events, want)
+	}
+
+	delete(rec.failOn, "third")
+	testPublish(t, "fourth", false)
+	if _, err := DispatchEvents(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DispatchEvents(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"first", "second", "third", "third", "fourth"}; !reflect.DeepEqual(rec.events, want) {
+		t.Fatalf("subscriber got %v, want %v", rec.events, want)
+	}
+}
+
+func TestFailingEventIsParked(t *testing.T) {
+	openTestDB(t)
+	maxAttempts := config.EventMaxAttempts
+	config.EventMaxAttempts = 3
+	t.Cleanup(func() { config.EventMaxAttempts = maxAttempts })
+
+	rec := testSubscriber(t)
+	rec.failOn["poison"] = true
+	testPublish(t, "poison", false)
+	testPublish(t, "after", false)
+
+	for attempt := 1; attempt < 3; attempt++ {
+		if _, err := DispatchEvents(); err == nil {
+			t.Fatalf("attempt %d: DispatchEvents did not report the failure", attempt)
+		}
+		var failures int
+		if err := config.DB.QueryRow("SELECT failures FROM outbox_positions WHERE subscriber='test'").Scan(&failures); err != nil {
+			t.Fatal(err)
+		}
+		if failures != attempt {
+			t.Fatalf("after %d attempt(s) the subscriber has %d failure(s)", attempt, failures)
+		}
+	}
+
+	// The third failure parks the event and the subscriber moves on
+	if _, err := DispatchEvents(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"poison", "poison", "poison", "after"}; !reflect.DeepEqual(rec.events, want) {
+		t.Fatalf("subscriber got %v, want %v", rec.events, want)
+	}
+
+	var id int64
+	var attempts, failures int
+	var lastError string
+	err := config.DB.QueryRow(`
+		SELECT d.id, d.attempts, d.last_error FROM outbox_dead_letters d JOIN outbox_events e ON e.id = d.seq
+		WHERE d.subscriber='test' AND e.type='poison'`).Scan(&id, &attempts, &lastError)
+	if err != nil {
+		t.Fatalf("no dead letter: %v", err)
+	}
+	if attempts != 3 || lastError != "cannot handle poison" {
+		t.Fatalf("dead letter after %d attempt(s) with %q", attempts, lastError)
+	}
+	if err := config.DB.QueryRow("SELECT failures FROM outbox_positions WHERE subscriber='test'").Scan(&failures); err != nil {
+		t.Fatal(err)
+	}
+	if failures != 0 {
+		t.Fatalf("subscriber still has %d failure(s) after moving on", failures)
+	}
+
+	// An admin retries it once the subscriber is fixed
+	var be *bankError
+	if err := retryDeadEvent(id); !errors.As(err, &be) || be.Status != http.StatusInternalServerError {
+		t.Fatalf("retrying while the subscriber still fails returned %v", err)
+	}
+	delete(rec.failOn, "poison")
+	if err := retryDeadEvent(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := retryDeadEvent(id); !errors.As(err, &be) || be.Status != http.StatusBadRequest {
+		t.Fatalf("second retry returned %v, want 400", err)
+	}
+	if rec.events[len(rec.events)-1] != "poison" {
+		t.Fatalf("subscriber got %v, want the retried event last", rec.events)
+	}
+}
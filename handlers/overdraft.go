@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// accrueOverdraftInterest charges interest on every account with an
+// overdraft rate for each day since it last accrued that it started
+// overdrawn, and on the first run of a month debits the interest accrued
+// over the previous month.
+func accrueOverdraftInterest(tx *sql.Tx, now time.Time) (string, error) {
+	rows, err := tx.Query("SELECT account_number, currency, overdraft_rate_bps FROM accounts WHERE overdraft_rate_bps > 0")
+	if err != nil {
+		return "", err
+	}
+
+	type facility struct {
+		number   string
+		currency string
+		rateBps  int64
+	}
+	var facilities []facility
+	for rows.Next() {
+		var f facility
+		if err := rows.Scan(&f.number, &f.currency, &f.rateBps); err != nil {
+			rows.Close()
+			return "", err
+		}
+		facilities = append(facilities, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	days, accounts := 0, 0
+	for _, f := range facilities {
+		n, err := accrueDays(tx, f.number, f.currency, "overdraft", startOfDay(now), func(balance int64) (int64, int64, error) {
+			return -balance, f.rateBps, nil
+		})
+		if err != nil {
+			return "", err
+		}
+		if n > 0 {
+			days += n
+			accounts++
+		}
+	}
+
+	charged, err := capitalizeInterest(tx, "overdraft", "overdraft_interest", startOfMonth(now))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("accrued %d day(s) of interest on %d account(s), charged %d account(s)", days, accounts, charged), nil
+}
+
+// Set the overdraft facility on an account
+func setOverdraft(accountNumber string, limit string, rate string, approvedBy string) error {
+	var currency string
+	err := config.DB.QueryRow("SELECT currency FROM accounts WHERE account_number=?", accountNumber).Scan(&currency)
+	if err == sql.ErrNoRows {
+		return &bankError{http.StatusNotFound, "Account not found"}
+	} else if err != nil {
+		return err
+	}
+
+	overdraftLimit, err := money.Parse(limit, currency)
+	if err != nil {
+		return &bankError{http.StatusBadRequest, "Invalid overdraft limit"}
+	}
+	rateBps, err := money.ParseRate(rate)
+	if err != nil {
+		return &bankError{http.StatusBadRequest, "Invalid overdraft interest rate"}
+	}
+
+	_, err = config.DB.Exec(`
+		UPDATE accounts SET overdraft_limit=?, overdraft_rate_bps=?, overdraft_approved_by=?, overdraft_approved_at=?
+		WHERE account_number=?`,
+		overdraftLimit.Amount, rateBps, approvedBy, time.Now().UTC().Format(dbTime), accountNumber)
+	return err
+}
+
+// AdminOverdrafts lists the accounts with an overdraft facility
+func AdminOverdrafts(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	rows, err := config.DB.Query("SELECT " + accountColumns + " FROM " + accountsWithBalances + " WHERE a.overdraft_limit > 0 ORDER BY a.id")
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		accounts = append(accounts, account)
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/admin_overdrafts.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Accounts": accounts,
+	})
+}
+
+// SetOverdraft approves, changes or removes an account's overdraft facility
+func SetOverdraft(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	err := setOverdraft(r.FormValue("account_number"), r.FormValue("limit"), r.FormValue("rate"), userID)
+	if err != nil {
+		adminError(w, r, err, "Failed to set overdraft")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/overdrafts", http.StatusSeeOther)
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import "database/sql"
+
+// BalanceDrift is an account whose materialized balance disagrees with its ledger
+type BalanceDrift struct {
+	AccountNumber string
+	Stored        int64
+	Ledger        int64
+}
+
+// ReconcileBalances recomputes every account balance from the ledger and
+// reports the accounts whose stored balance has drifted. With fix set the
+// stored balances are corrected as well.
+func ReconcileBalances(fix bool) ([]BalanceDrift, error) {
+	var drifts []BalanceDrift
+	err := withTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`
+			SELECT a.account_number, COALESCE(b.balance, 0),
+				COALESCE((SELECT SUM(` + signedAmount + `) FROM transactions t WHERE t.account_number = a.account_number), 0) AS ledger
+			FROM accounts a LEFT JOIN balances b ON b.account_number = a.account_number
+			WHERE COALESCE(b.balance, 0) != ledger
+			ORDER BY a.id`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var drift BalanceDrift
+			if err := rows.Scan(&drift.AccountNumber, &drift.Stored, &drift.Ledger); err != nil {
+				return err
+			}
+			drifts = append(drifts, drift)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		if !fix {
+			return nil
+		}
+		for _, drift := range drifts {
+			if err := recomputeBalance(tx, drift.AccountNumber); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return drifts, err
+}
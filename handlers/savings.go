@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// SavingsProduct is a set of interest tiers savings accounts can earn under
+type SavingsProduct struct {
+	Code      string
+	Name      string
+	Currency  string
+	IsDefault bool
+	Tiers     []SavingsTier
+}
+
+// SavingsTier is the annual rate paid once the balance reaches MinBalance
+type SavingsTier struct {
+	MinBalance money.Money
+	RateBps    int64
+}
+
+// Rate formats the tier's rate as a percentage
+func (t SavingsTier) Rate() string {
+	return money.FormatRate(t.RateBps)
+}
+
+// Look up the annual rate a savings balance earns under a product. The whole
+// balance earns the rate of the highest tier it reaches.
+func savingsRate(tx *sql.Tx, productCode string, balance int64) (int64, error) {
+	var rateBps int64
+	err := tx.QueryRow(`
+		SELECT rate_bps FROM savings_product_tiers
+		WHERE product_code=? AND min_balance <= ?
+		ORDER BY min_balance DESC LIMIT 1`, productCode, balance).Scan(&rateBps)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return rateBps, err
+}
+
+// accrueSavingsInterest accrues interest on every savings account for each
+// day since it last accrued, on the balance at the start of the day, and on
+// the first run of a month credits the interest accrued over the previous
+// month. Accounts without a product of their own earn under the default
+// product for their currency.
+func accrueSavingsInterest(tx *sql.Tx, now time.Time) (string, error) {
+	rows, err := tx.Query(`
+		SELECT a.account_number, a.currency,
+			COALESCE(a.savings_product, (SELECT code FROM savings_products p WHERE p.currency = a.currency AND p.is_default = 1))
+		FROM accounts a WHERE a.type = 'savings'`)
+	if err != nil {
+		return "", err
+	}
+
+	type saver struct {
+		number   string
+		currency string
+		product  sql.NullString
+	}
+	var savers []saver
+	for rows.Next() {
+		var s saver
+		if err := rows.Scan(&s.number, &s.currency, &s.product); err != nil {
+			rows.Close()
+			return "", err
+		}
+		savers = append(savers, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	days, accounts := 0, 0
+	for _, s := range savers {
+		if !s.product.Valid {
+			continue
+		}
+		n, err := accrueDays(tx, s.number, s.currency, "savings", startOfDay(now), func(balance int64) (int64, int64, error) {
+			if balance <= 0 {
+				return 0, 0, nil
+			}
+			rateBps, err := savingsRate(tx, s.product.String, balance)
+			return balance, rateBps, err
+		})
+		if err != nil {
+			return "", err
+		}
+		if n > 0 {
+			days += n
+			accounts++
+		}
+	}
+
+	credited, err := capitalizeInterest(tx, "savings", "interest", startOfMonth(now))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("accrued %d day(s) of interest on %d account(s), credited %d account(s)", days, accounts, credited), nil
+}
+
+// Fetch every savings product with its tiers
+func getSavingsProducts() ([]SavingsProduct, error) {
+	rows, err := config.DB.Query("SELECT code, name, currency, is_default FROM savings_products ORDER BY code")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var products []SavingsProduct
+	for rows.Next() {
+		var p SavingsProduct
+		if err := rows.Scan(&p.Code, &p.Name, &p.Currency, &p.IsDefault); err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range products {
+		tiers, err := config.DB.Query("SELECT min_balance, rate_bps FROM savings_product_tiers WHERE product_code=? ORDER BY min_balance", products[i].Code)
+		if err != nil {
+			return nil, err
+		}
+		for tiers.Next() {
+			var t SavingsTier
+			if err := tiers.Scan(&t.MinBalance.Amount, &t.RateBps); err != nil {
+				tiers.Close()
+				return nil, err
+			}
+			t.MinBalance.Currency = products[i].Currency
+			products[i].Tiers = append(products[i].Tiers, t)
+		}
+		tiers.Close()
+		if err := tiers.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return products, nil
+}
+
+// AdminSavingsProducts lists savings products with forms to change them
+func AdminSavingsProducts(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	products, err := getSavingsProducts()
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/admin_savings_products.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Products":   products,
+		"Currencies": money.Currencies(),
+	})
+}
+
+// SaveSavingsProduct creates or renames a savings product. A product marked
+// as default replaces the previous default for its currency.
+func SaveSavingsProduct(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	code, name, currency := r.FormValue("code"), r.FormValue("name"), r.FormValue("currency")
+	isDefault := r.FormValue("is_default") == "on"
+	if code == "" || name == "" || !money.ValidCurrency(currency) {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid savings product")
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		if isDefault {
+			if _, err := tx.Exec("UPDATE savings_products SET is_default=0 WHERE currency=?", currency); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`
+			INSERT INTO savings_products (code, name, currency, is_default) VALUES (?, ?, ?, ?)
+			ON CONFLICT(code) DO UPDATE SET name=excluded.name, is_default=excluded.is_default`,
+			code, name, currency, isDefault)
+		return err
+	})
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Failed to save savings product")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/savings-products", http.StatusSeeOther)
+}
+
+// SaveSavingsTier sets the rate paid from a minimum balance under a product
+func SaveSavingsTier(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	code := r.FormValue("product_code")
+	var currency string
+	err := config.DB.QueryRow("SELECT currency FROM savings_products WHERE code=?", code).Scan(&currency)
+	if err == sql.ErrNoRows {
+		ErrorPage(w, r, http.StatusNotFound, "Savings product not found")
+		return
+	} else if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	minBalance, err := money.Parse(r.FormValue("min_balance"), currency)
+	if err != nil {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid minimum balance")
+		return
+	}
+	rateBps, err := money.ParseRate(r.FormValue("rate"))
+	if err != nil {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid interest rate")
+		return
+	}
+
+	_, err = config.DB.Exec(`
+		INSERT INTO savings_product_tiers (product_code, min_balance, rate_bps) VALUES (?, ?, ?)
+		ON CONFLICT(product_code, min_balance) DO UPDATE SET rate_bps=excluded.rate_bps`,
+		code, minBalance.Amount, rateBps)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Failed to save interest tier")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/savings-products", http.StatusSeeOther)
+}
+
+// AssignSavingsProduct moves a savings account onto another product
+func AssignSavingsProduct(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	result, err := config.DB.Exec(`
+		UPDATE accounts SET savings_product=?
+		WHERE account_number=? AND type='savings'
+			AND currency = (SELECT currency FROM savings_products WHERE code=?)`,
+		r.FormValue("product_code"), r.FormValue("account_number"), r.FormValue("product_code"))
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Failed to assign savings product")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		ErrorPage(w, r, http.StatusBadRequest, "No savings account in the product's currency with that number")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/savings-products", http.StatusSeeOther)
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A job is periodic background work. Each run happens inside a single
+// database transaction and returns a one line summary; jobs must be safe to
+// run more than once for the same day.
+type job func(tx *sql.Tx, now time.Time) (string, error)
+
+// Background jobs in the order they run. Later jobs may depend on the work
+// of earlier ones, so add new jobs where they belong rather than at the end.
+var jobs = []struct {
+	name string
+	run  job
+}{
+	{"dormant-accounts", markDormantAccounts},
+	{"expire-holds", expireHolds},
+	{"installment-reminders", remindInstallmentsDue},
+	{"loan-collections", collectLoanInstallments},
+	// After loan-collections, so installments collected today are not
+	// reported as overdue
+	{"overdue-loans", markOverdueInstallments},
+	{"overdraft-interest", accrueOverdraftInterest},
+	{"savings-interest", accrueSavingsInterest},
+	{"standing-orders", runStandingOrders},
+	{"term-deposits", matureTermDeposits},
+}
+
+// JobNames lists the registered jobs in the order they run
+func JobNames() []string {
+	names := make([]string, len(jobs))
+	for i, j := range jobs {
+		names[i] = j.name
+	}
+	return names
+}
+
+// RunJob runs a single job as of now. With dryRun set the job's changes are
+// rolled back, so only its summary is kept.
+func RunJob(name string, now time.Time, dryRun bool) (string, error) {
+	var run job
+	for _, j := range jobs {
+		if j.name == name {
+			run = j.run
+		}
+	}
+	if run == nil {
+		return "", fmt.Errorf("unknown job %q", name)
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	summary, err := run(tx, now)
+	if err != nil || dryRun {
+		tx.Rollback()
+		return summary, err
+	}
+	return summary, tx.Commit()
+}
+
+// StartScheduler runs every job at config.SchedulerInterval until the
+// process exits
+func StartScheduler() {
+	if config.SchedulerInterval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			for _, name := range JobNames() {
+				summary, err := RunJob(name, time.Now().UTC(), false)
+				if err != nil {
+					log.Printf("job %s failed: %v", name, err)
+				} else if summary != "" {
+					log.Printf("job %s: %s", name, summary)
+				}
+			}
+			time.Sleep(config.SchedulerInterval)
+		}
+	}()
+}
@@ -0,0 +1,622 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// How often a standing order pays; "once" is a single future-dated payment
+var frequencies = map[string]bool{
+	"once":    true,
+	"daily":   true,
+	"weekly":  true,
+	"monthly": true,
+}
+
+// StandingOrder is a payment the scheduler makes on the customer's behalf,
+// either a transfer to another account or a loan repayment
+type StandingOrder struct {
+	ID          string
+	UserID      string
+	Kind        string
+	FromAccount string
+	ToAccount   string
+	LoanID      string
+	Amount      money.Money
+	Frequency   string
+	StartDate   time.Time
+	EndDate     sql.NullTime
+	NextRun     time.Time
+	Runs        int
+	Attempts    int
+	Status      string
+	LastRunAt   sql.NullTime
+	LastError   string
+}
+
+// Payee describes where the order's payments go
+func (o StandingOrder) Payee() string {
+	if o.Kind == "loan_repayment" {
+		return "Loan " + o.LoanID
+	}
+	return o.ToAccount
+}
+
+// The date of the order's nth payment, counting from zero. Monthly orders
+// keep to the start date's day of the month.
+func (o StandingOrder) occurrence(n int) time.Time {
+	switch o.Frequency {
+	case "daily":
+		return o.StartDate.AddDate(0, 0, n)
+	case "weekly":
+		return o.StartDate.AddDate(0, 0, 7*n)
+	case "monthly":
+		return addMonths(o.StartDate, n)
+	}
+	return o.StartDate
+}
+
+// Report whether the order has no payments left after the nth
+func (o StandingOrder) finishedAfter(n int) bool {
+	if o.Frequency == "once" {
+		return true
+	}
+	return o.EndDate.Valid && o.occurrence(n).After(o.EndDate.Time)
+}
+
+const standingOrderColumns = "order_id, user_id, kind, from_account, COALESCE(to_account, ''), COALESCE(loan_id, ''), amount, currency, frequency, start_date, end_date, next_run, runs, attempts, status, last_run_at, COALESCE(last_error, '')"
+
+// Read a standing order selected with standingOrderColumns
+func scanStandingOrder(row scanner) (StandingOrder, error) {
+	var o StandingOrder
+	err := row.Scan(&o.ID, &o.UserID, &o.Kind, &o.FromAccount, &o.ToAccount, &o.LoanID, &o.Amount.Amount, &o.Amount.Currency,
+		&o.Frequency, &o.StartDate, &o.EndDate, &o.NextRun, &o.Runs, &o.Attempts, &o.Status, &o.LastRunAt, &o.LastError)
+	return o, err
+}
+
+// Fetch a standing order, making sure it belongs to the given user
+func getStandingOrder(userID, orderID string) (StandingOrder, error) {
+	o, err := scanStandingOrder(config.DB.QueryRow("SELECT "+standingOrderColumns+" FROM standing_orders WHERE order_id=? AND user_id=?", orderID, userID))
+	if err == sql.ErrNoRows {
+		return o, &bankError{http.StatusNotFound, "Standing order not found"}
+	}
+	return o, err
+}
+
+// Read the schedule fields shared by the create and edit forms
+func scheduleFromRequest(r *http.Request) (string, time.Time, sql.NullTime, error) {
+	return parseSchedule(r.FormValue("frequency"), r.FormValue("start_date"), r.FormValue("end_date"))
+}
+
+// Check a standing order's frequency and its first and last payment dates,
+// given as YYYY-MM-DD. A blank start date means today.
+func parseSchedule(frequency, startDate, endDate string) (string, time.Time, sql.NullTime, error) {
+	start := startOfDay(time.Now().UTC())
+	var end sql.NullTime
+	if !frequencies[frequency] {
+		return "", start, end, &bankError{http.StatusBadRequest, "Invalid frequency"}
+	}
+
+	if startDate != "" {
+		date, err := time.Parse(dbDate, startDate)
+		if err != nil || date.Before(start) {
+			return "", start, end, &bankError{http.StatusBadRequest, "The first payment date must be today or later"}
+		}
+		start = date
+	}
+
+	if endDate != "" && frequency != "once" {
+		date, err := time.Parse(dbDate, endDate)
+		if err != nil || date.Before(start) {
+			return "", start, end, &bankError{http.StatusBadRequest, "The end date must not be before the first payment"}
+		}
+		end = sql.NullTime{Time: date, Valid: true}
+	}
+	return frequency, start, end, nil
+}
+
+// Make one payment of a standing order inside tx. Returns the ledger
+// reference of the payment and whether the order has nothing left to pay,
+// which happens once a repaid loan is cleared.
+func payStandingOrder(tx *sql.Tx, o StandingOrder) (string, bool, error) {
+	from, err := getAccount(tx, o.FromAccount)
+	if err == sql.ErrNoRows || (err == nil && from.UserID != o.UserID) {
+		return "", false, &bankError{http.StatusNotFound, "Paying account not found"}
+	} else if err != nil {
+		return "", false, err
+	}
+
+	if o.Kind == "loan_repayment" {
+		if _, err := repayLoan(tx, from, o.LoanID, o.Amount, "standing_order"); err != nil {
+			return "", false, err
+		}
+		var outstanding int64
+		if err := tx.QueryRow("SELECT outstanding FROM loans WHERE loan_id=?", o.LoanID).Scan(&outstanding); err != nil {
+			return "", false, err
+		}
+		return o.LoanID, outstanding <= 0, nil
+	}
+
+	to, err := getAccount(tx, o.ToAccount)
+	if err == sql.ErrNoRows {
+		return "", false, &bankError{http.StatusNotFound, "Recipient account not found"}
+	} else if err != nil {
+		return "", false, err
+	}
+	reference := uuid.New().String()
+	return reference, false, postTransfer(tx, from, to, o.Amount, reference, "standing_order")
+}
+
+// Record that a payment of a standing order failed, and whether it will be
+// tried again on a later run or was skipped
+func publishStandingOrderFailure(tx *sql.Tx, o StandingOrder, message string, retrying bool) error {
+	return publishEvent(tx, "standing_order.failed", map[string]interface{}{
+		"order_id":     o.ID,
+		"kind":         o.Kind,
+		"from_account": o.FromAccount,
+		"payee":        o.Payee(),
+		"amount":       o.Amount,
+		"due_date":     o.NextRun.Format(dbDate),
+		"error":        message,
+		"will_retry":   retrying,
+	})
+}
+
+// runStandingOrders makes every payment that has fallen due. Each payment is
+// made in its own savepoint so one failure does not undo the others. A
+// failed payment is retried on later runs up to
+// config.StandingOrderMaxAttempts times before it is skipped. The failure
+// is kept on the order, and standing_order.failed is raised when a payment
+// first fails and when it is skipped so the customer is told. Payments the
+// fraud rules stop are recorded as fraud cases and never retried: a held
+// payment is made if an admin approves it and a blocked one is skipped.
+func runStandingOrders(tx *sql.Tx, now time.Time) (string, error) {
+	rows, err := tx.Query("SELECT "+standingOrderColumns+" FROM standing_orders WHERE status='active' AND next_run <= ? ORDER BY next_run, id", now.Format(dbDate))
+	if err != nil {
+		return "", err
+	}
+
+	var due []StandingOrder
+	for rows.Next() {
+		o, err := scanStandingOrder(rows)
+		if err != nil {
+			rows.Close()
+			return "", err
+		}
+		due = append(due, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	paid, held, failed := 0, 0, 0
+	ranAt := now.Format(dbTime)
+	for _, o := range due {
+		var reference string
+		var done bool
+		err := withSavepoint(tx, "standing_order", func() error {
+			var err error
+			reference, done, err = payStandingOrder(tx, o)
+			return err
+		})
+
+		if err == nil {
+			paid++
+			status := "active"
+			if done || o.finishedAfter(o.Runs+1) {
+				status = "completed"
+			}
+			_, err = tx.Exec(`
+				UPDATE standing_orders SET runs=runs+1, next_run=?, attempts=0, status=?, last_run_at=?, last_reference=?, last_error=NULL
+				WHERE order_id=?`,
+				o.occurrence(o.Runs+1).Format(dbDate), status, ranAt, reference, o.ID)
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		fe, screened := err.(*fraudError)
+		if screened {
+			if err := recordFraudCase(tx, fe); err != nil {
+				return "", err
+			}
+		}
+		if screened && fe.Decision == "hold" {
+			held++
+			status := "active"
+			if o.finishedAfter(o.Runs + 1) {
+				status = "completed"
+			}
+			_, err = tx.Exec(`
+				UPDATE standing_orders SET runs=runs+1, next_run=?, attempts=0, status=?, last_run_at=?, last_reference=NULL, last_error=?
+				WHERE order_id=?`,
+				o.occurrence(o.Runs+1).Format(dbDate), status, ranAt,
+				fmt.Sprintf("Payment due %s is held for review and will be made once it is approved", o.NextRun.Format(dbDate)), o.ID)
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		failed++
+		message := "Payment could not be made"
+		if screened {
+			message = fe.Message
+		} else if be, ok := err.(*bankError); ok {
+			message = be.Message
+		} else {
+			log.Printf("standing order %s: %v", o.ID, err)
+		}
+
+		// The customer hears about the first failure and about the payment
+		// being skipped, not about every retry in between
+		retrying := !screened && o.Attempts+1 < int(config.StandingOrderMaxAttempts)
+		if o.Attempts == 0 || !retrying {
+			if err := publishStandingOrderFailure(tx, o, message, retrying); err != nil {
+				return "", err
+			}
+		}
+		if retrying {
+			_, err = tx.Exec("UPDATE standing_orders SET attempts=attempts+1, last_run_at=?, last_error=? WHERE order_id=?",
+				ranAt, fmt.Sprintf("Payment due %s failed, will retry: %s", o.NextRun.Format(dbDate), message), o.ID)
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		// Out of retries: skip this payment and move on to the next one
+		log.Printf("standing order %s for user %s gave up on payment due %s: %s", o.ID, o.UserID, o.NextRun.Format(dbDate), message)
+		status := "active"
+		if o.finishedAfter(o.Runs + 1) {
+			status = "completed"
+			if o.Frequency == "once" {
+				status = "failed"
+			}
+		}
+		_, err = tx.Exec(`
+			UPDATE standing_orders SET runs=runs+1, next_run=?, attempts=0, status=?, last_run_at=?, last_error=?
+			WHERE order_id=?`,
+			o.occurrence(o.Runs+1).Format(dbDate), status, ranAt,
+			fmt.Sprintf("Payment due %s failed and was skipped: %s", o.NextRun.Format(dbDate), message), o.ID)
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("made %d standing order payment(s), %d held for review, %d failed", paid, held, failed), nil
+}
+
+// Count the user's live standing orders whose last payment failed
+func failedStandingOrders(userID string) (int, error) {
+	var count int
+	err := config.DB.QueryRow("SELECT COUNT(*) FROM standing_orders WHERE user_id=? AND last_error IS NOT NULL AND status IN ('active', 'paused', 'failed')", userID).Scan(&count)
+	return count, err
+}
+
+// Set up a standing order paying o.Amount from the account from on o's
+// schedule. A transfer goes to to, an account number or username; a loan
+// repayment goes to o.LoanID, which must be one of the user's active loans.
+// Returns the new order's ID.
+func createStandingOrder(o StandingOrder, from Account, to string) (string, error) {
+	var toAccount, loanID interface{}
+	switch o.Kind {
+	case "transfer":
+		recipient, err := resolveRecipient(to)
+		if err != nil {
+			return "", err
+		}
+		if recipient.Number == from.Number {
+			return "", &bankError{http.StatusBadRequest, "Cannot transfer to the same account"}
+		}
+		toAccount = recipient.Number
+	case "loan_repayment":
+		var currency string
+		err := config.DB.QueryRow("SELECT currency FROM loans WHERE loan_id=? AND user_id=? AND status='active'", o.LoanID, o.UserID).Scan(&currency)
+		if err == sql.ErrNoRows {
+			return "", &bankError{http.StatusNotFound, "Loan not found"}
+		} else if err != nil {
+			return "", err
+		}
+		if currency != from.Currency {
+			return "", &bankError{http.StatusBadRequest, "Loans must be repaid from an account in the loan's currency"}
+		}
+		loanID = o.LoanID
+	default:
+		return "", &bankError{http.StatusBadRequest, "Invalid standing order type"}
+	}
+
+	var endDate interface{}
+	if o.EndDate.Valid {
+		endDate = o.EndDate.Time.Format(dbDate)
+	}
+	orderID := uuid.New().String()
+	_, err := config.DB.Exec(`
+		INSERT INTO standing_orders (order_id, user_id, kind, from_account, to_account, loan_id, amount, currency, frequency, start_date, end_date, next_run, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		orderID, o.UserID, o.Kind, from.Number, toAccount, loanID, o.Amount.Amount, o.Amount.Currency, o.Frequency,
+		o.StartDate.Format(dbDate), endDate, o.StartDate.Format(dbDate), time.Now().UTC().Format(dbTime))
+	return orderID, err
+}
+
+// Change the amount and schedule of a standing order. The schedule restarts
+// from the new first payment date.
+func updateStandingOrder(o StandingOrder, amount money.Money, frequency string, start time.Time, end sql.NullTime) error {
+	if o.Status != "active" && o.Status != "paused" {
+		return &bankError{http.StatusBadRequest, "Standing order can no longer be changed"}
+	}
+
+	var endDate interface{}
+	if end.Valid {
+		endDate = end.Time.Format(dbDate)
+	}
+	_, err := config.DB.Exec(`
+		UPDATE standing_orders SET amount=?, frequency=?, start_date=?, end_date=?, next_run=?, runs=0, attempts=0, last_error=NULL
+		WHERE order_id=? AND user_id=? AND status IN ('active', 'paused')`,
+		amount.Amount, frequency, start.Format(dbDate), endDate, start.Format(dbDate), o.ID, o.UserID)
+	return err
+}
+
+// Restart a paused standing order. Payments that fell due while it was
+// paused are skipped.
+func resumeStandingOrder(o StandingOrder) error {
+	if o.Status != "paused" {
+		return &bankError{http.StatusBadRequest, "Standing order is not paused"}
+	}
+
+	today := startOfDay(time.Now().UTC())
+	runs, next := o.Runs, o.NextRun
+	if o.Frequency == "once" {
+		if next.Before(today) {
+			next = today
+		}
+	} else {
+		for next.Before(today) {
+			runs++
+			next = o.occurrence(runs)
+		}
+	}
+
+	status := "active"
+	if o.Frequency != "once" && o.EndDate.Valid && next.After(o.EndDate.Time) {
+		status = "completed"
+	}
+	_, err := config.DB.Exec("UPDATE standing_orders SET status=?, runs=?, next_run=?, attempts=0 WHERE order_id=? AND status='paused'",
+		status, runs, next.Format(dbDate), o.ID)
+	return err
+}
+
+// Move a standing order to status if it is currently in one of the from
+// statuses
+func changeStandingOrderStatus(o StandingOrder, status string, from ...string) error {
+	allowed := false
+	for _, s := range from {
+		allowed = allowed || o.Status == s
+	}
+	if !allowed {
+		return &bankError{http.StatusBadRequest, "Standing order is already " + o.Status}
+	}
+
+	_, err := config.DB.Exec("UPDATE standing_orders SET status=? WHERE order_id=? AND status=?", status, o.ID, o.Status)
+	return err
+}
+
+// StandingOrdersPage lists the user's standing orders with a form to add one
+func StandingOrdersPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	rows, err := config.DB.Query("SELECT "+standingOrderColumns+" FROM standing_orders WHERE user_id=? AND status != 'cancelled' ORDER BY id DESC", userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var orders []StandingOrder
+	for rows.Next() {
+		o, err := scanStandingOrder(rows)
+		if err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		orders = append(orders, o)
+	}
+
+	accounts, err := getUserAccounts(userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	loanRows, err := config.DB.Query("SELECT loan_id, outstanding, currency FROM loans WHERE user_id=? AND status='active'", userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer loanRows.Close()
+
+	type loan struct {
+		ID          string
+		Outstanding money.Money
+	}
+	var loans []loan
+	for loanRows.Next() {
+		var l loan
+		if err := loanRows.Scan(&l.ID, &l.Outstanding.Amount, &l.Outstanding.Currency); err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		loans = append(loans, l)
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/standing_orders.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Orders":         orders,
+		"Accounts":       accounts,
+		"Loans":          loans,
+		"Today":          time.Now().UTC().Format(dbDate),
+		"IdempotencyKey": uuid.New().String(),
+	})
+}
+
+// CreateStandingOrder sets up a scheduled transfer or loan repayment
+func CreateStandingOrder(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	from, err := accountFromRequest(r, userID)
+	if err != nil {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid account")
+		return
+	}
+
+	amount, err := amountFromRequest(r, from)
+	if err != nil {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid amount")
+		return
+	}
+
+	frequency, start, end, err := scheduleFromRequest(r)
+	if err != nil {
+		transactionError(w, r, err, "Invalid schedule")
+		return
+	}
+
+	o := StandingOrder{UserID: userID, Kind: r.FormValue("kind"), LoanID: r.FormValue("loan_id"), Amount: amount,
+		Frequency: frequency, StartDate: start, EndDate: end}
+	if _, err := createStandingOrder(o, from, r.FormValue("to")); err != nil {
+		transactionError(w, r, err, "Failed to create standing order")
+		return
+	}
+
+	http.Redirect(w, r, "/standing-orders", http.StatusSeeOther)
+}
+
+// EditStandingOrderPage renders the form to change a standing order
+func EditStandingOrderPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	o, err := getStandingOrder(userID, mux.Vars(r)["id"])
+	if err != nil {
+		transactionError(w, r, err, "Database error")
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/standing_order_edit.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Order": o,
+		"Today": time.Now().UTC().Format(dbDate),
+	})
+}
+
+// UpdateStandingOrder changes the amount and schedule of a standing order.
+// The schedule restarts from the new first payment date.
+func UpdateStandingOrder(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	o, err := getStandingOrder(userID, mux.Vars(r)["id"])
+	if err != nil {
+		transactionError(w, r, err, "Database error")
+		return
+	}
+
+	amount, err := money.Parse(r.FormValue("amount"), o.Amount.Currency)
+	if err != nil || amount.Amount <= 0 {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid amount")
+		return
+	}
+
+	frequency, start, end, err := scheduleFromRequest(r)
+	if err != nil {
+		transactionError(w, r, err, "Invalid schedule")
+		return
+	}
+
+	if err := updateStandingOrder(o, amount, frequency, start, end); err != nil {
+		transactionError(w, r, err, "Failed to update standing order")
+		return
+	}
+
+	http.Redirect(w, r, "/standing-orders", http.StatusSeeOther)
+}
+
+// PauseStandingOrder stops a standing order's payments until it is resumed
+func PauseStandingOrder(w http.ResponseWriter, r *http.Request) {
+	setStandingOrderStatus(w, r, "paused", "active")
+}
+
+// CancelStandingOrder stops a standing order for good
+func CancelStandingOrder(w http.ResponseWriter, r *http.Request) {
+	setStandingOrderStatus(w, r, "cancelled", "active", "paused")
+}
+
+// ResumeStandingOrder restarts a paused standing order. Payments that fell
+// due while it was paused are skipped.
+func ResumeStandingOrder(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	o, err := getStandingOrder(userID, mux.Vars(r)["id"])
+	if err != nil {
+		transactionError(w, r, err, "Database error")
+		return
+	}
+
+	if err := resumeStandingOrder(o); err != nil {
+		transactionError(w, r, err, "Failed to resume standing order")
+		return
+	}
+
+	http.Redirect(w, r, "/standing-orders", http.StatusSeeOther)
+}
+
+// Move one of the user's standing orders to status if it is currently in
+// one of the from statuses
+func setStandingOrderStatus(w http.ResponseWriter, r *http.Request, status string, from ...string) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	o, err := getStandingOrder(userID, mux.Vars(r)["id"])
+	if err != nil {
+		transactionError(w, r, err, "Database error")
+		return
+	}
+
+	if err := changeStandingOrderStatus(o, status, from...); err != nil {
+		transactionError(w, r, err, "Failed to update standing order")
+		return
+	}
+
+	http.Redirect(w, r, "/standing-orders", http.StatusSeeOther)
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// TermDeposit is money locked away from a source account for a fixed term
+type TermDeposit struct {
+	ID            string
+	UserID        string
+	SourceAccount string
+	Principal     money.Money
+	RateBps       int64
+	TermDays      int
+	Status        string
+	OpenedAt      time.Time
+	MaturesOn     time.Time
+	InterestPaid  money.Money
+
+	// Interest accrued so far, and the day it has been accrued up to
+	Accrued   money.Money
+	AccruedOn sql.NullTime
+}
+
+// Rate formats the deposit's annual rate as a percentage
+func (d TermDeposit) Rate() string {
+	return money.FormatRate(d.RateBps)
+}
+
+// MaturityValue is what the deposit pays out if held to maturity
+func (d TermDeposit) MaturityValue() money.Money {
+	return d.Principal.Add(d.Principal.Interest(d.RateBps, int64(d.TermDays)))
+}
+
+const termDepositColumns = "deposit_id, user_id, source_account, principal, currency, rate_bps, term_days, status, opened_at, matures_on, COALESCE(interest_paid, 0), accrued_interest, accrued_on"
+
+// Read a term deposit selected with termDepositColumns
+func scanTermDeposit(row scanner) (TermDeposit, error) {
+	var d TermDeposit
+	err := row.Scan(&d.ID, &d.UserID, &d.SourceAccount, &d.Principal.Amount, &d.Principal.Currency, &d.RateBps,
+		&d.TermDays, &d.Status, &d.OpenedAt, &d.MaturesOn, &d.InterestPaid.Amount, &d.Accrued.Amount, &d.AccruedOn)
+	d.InterestPaid.Currency = d.Principal.Currency
+	d.Accrued.Currency = d.Principal.Currency
+	return d, err
+}
+
+// Accrue a deposit's interest up to today, or its maturity date if that is
+// sooner: a day at its rate for every day held. The total is worked out
+// from the days held rather than added to, so a missed day is made up by
+// the next run and a deposit held to maturity earns exactly its term's
+// interest. Reports whether anything changed.
+func accrueTermDeposit(tx *sql.Tx, d *TermDeposit, now time.Time) (bool, error) {
+	through := startOfDay(now)
+	if through.After(d.MaturesOn) {
+		through = d.MaturesOn
+	}
+	if d.AccruedOn.Valid && !through.After(d.AccruedOn.Time) {
+		return false, nil
+	}
+
+	days := int64(through.Sub(startOfDay(d.OpenedAt)).Hours() / 24)
+	if days < 0 {
+		days = 0
+	}
+	d.Accrued = d.Principal.Interest(d.RateBps, days)
+	d.AccruedOn = sql.NullTime{Time: through, Valid: true}
+	_, err := tx.Exec("UPDATE term_deposits SET accrued_interest=?, accrued_on=? WHERE deposit_id=?", d.Accrued.Amount, through.Format(dbDate), d.ID)
+	return err == nil, err
+}
+
+// Move funds from an account into a new term deposit
+func openTermDeposit(account Account, amount money.Money, termDays int) (string, error) {
+	rateBps, ok := config.TermDepositRates[termDays]
+	if !ok {
+		return "", &bankError{http.StatusBadRequest, "Unsupported term"}
+	}
+	if account.Type != "current" && account.Type != "savings" {
+		return "", &bankError{http.StatusBadRequest, "Term deposits must be funded from a current or savings account"}
+	}
+	if err := checkDebit(account); err != nil {
+		return "", err
+	}
+
+	depositID := uuid.New().String()
+	now := time.Now().UTC()
+	err := withTx(func(tx *sql.Tx) error {
+		// Overdraft cannot be used to fund a deposit
+		balance, err := freeBalance(tx, account.Number)
+		if err != nil {
+			return err
+		}
+		if balance < amount.Amount {
+			return &bankError{http.StatusBadRequest, "Insufficient funds"}
+		}
+
+		err = postTransaction(tx, Posting{UserID: account.UserID, AccountNumber: account.Number, Type: "term_deposit", Amount: amount, Reference: depositID})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO term_deposits (deposit_id, user_id, source_account, principal, currency, rate_bps, term_days, status, opened_at, matures_on)
+			VALUES (?, ?, ?, ?, ?, ?, ?, 'active', ?, ?)`,
+			depositID, account.UserID, account.Number, amount.Amount, amount.Currency, rateBps, termDays,
+			now.Format(dbTime), now.AddDate(0, 0, termDays).Format(dbDate))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return depositID, nil
+}
+
+// Pay a term deposit's principal and interest back to its source account
+func closeTermDeposit(tx *sql.Tx, d TermDeposit, interest money.Money, status string, now time.Time) error {
+	err := postTransaction(tx, Posting{UserID: d.UserID, AccountNumber: d.SourceAccount, Type: "term_deposit_release", Amount: d.Principal, Reference: d.ID})
+	if err != nil {
+		return err
+	}
+	if interest.Amount > 0 {
+		err = postTransaction(tx, Posting{UserID: d.UserID, AccountNumber: d.SourceAccount, Type: "interest", Amount: interest, Reference: d.ID})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE term_deposits SET status=?, closed_at=?, interest_paid=? WHERE deposit_id=? AND status='active'",
+		status, now.Format(dbTime), interest.Amount, d.ID)
+	return err
+}
+
+// matureTermDeposits accrues interest on every active deposit and pays out
+// those whose term has ended
+func matureTermDeposits(tx *sql.Tx, now time.Time) (string, error) {
+	rows, err := tx.Query("SELECT " + termDepositColumns + " FROM term_deposits WHERE status='active'")
+	if err != nil {
+		return "", err
+	}
+
+	var active []TermDeposit
+	for rows.Next() {
+		d, err := scanTermDeposit(rows)
+		if err != nil {
+			rows.Close()
+			return "", err
+		}
+		active = append(active, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	accrued, matured := 0, 0
+	for _, d := range active {
+		changed, err := accrueTermDeposit(tx, &d, now)
+		if err != nil {
+			return "", err
+		}
+		if changed {
+			accrued++
+		}
+		if d.MaturesOn.After(now) {
+			continue
+		}
+		if err := closeTermDeposit(tx, d, d.Accrued, "matured", now); err != nil {
+			return "", err
+		}
+		matured++
+	}
+	return fmt.Sprintf("accrued interest on %d term deposit(s), matured %d term deposit(s)", accrued, matured), nil
+}
+
+// Break a deposit before maturity. The interest accrued for the days held
+// is paid at the deposit's rate less the early withdrawal penalty.
+func breakTermDeposit(userID, depositID string) error {
+	return withTx(func(tx *sql.Tx) error {
+		d, err := scanTermDeposit(tx.QueryRow("SELECT "+termDepositColumns+" FROM term_deposits WHERE deposit_id=? AND user_id=?", depositID, userID))
+		if err == sql.ErrNoRows {
+			return &bankError{http.StatusNotFound, "Term deposit not found"}
+		} else if err != nil {
+			return err
+		}
+		if d.Status != "active" {
+			return &bankError{http.StatusBadRequest, "Term deposit is already closed"}
+		}
+
+		now := time.Now().UTC()
+		if _, err := accrueTermDeposit(tx, &d, now); err != nil {
+			return err
+		}
+		if !now.Before(d.MaturesOn) {
+			return closeTermDeposit(tx, d, d.Accrued, "matured", now)
+		}
+
+		rateBps := d.RateBps - config.TermDepositPenaltyBps
+		if rateBps <= 0 || d.RateBps == 0 {
+			return closeTermDeposit(tx, d, money.New(0, d.Principal.Currency), "broken", now)
+		}
+		return closeTermDeposit(tx, d, d.Accrued.MulRatio(rateBps, d.RateBps), "broken", now)
+	})
+}
+
+// TermDepositsPage lists the user's term deposits with a form to open one
+func TermDepositsPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	rows, err := config.DB.Query("SELECT "+termDepositColumns+" FROM term_deposits WHERE user_id=? ORDER BY id DESC", userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var deposits []TermDeposit
+	for rows.Next() {
+		d, err := scanTermDeposit(rows)
+		if err != nil {
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		deposits = append(deposits, d)
+	}
+
+	accounts, err := getUserAccounts(userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	type term struct {
+		Days int
+		Rate string
+	}
+	var terms []term
+	for days, rateBps := range config.TermDepositRates {
+		terms = append(terms, term{days, money.FormatRate(rateBps)})
+	}
+	sort.Slice(terms, func(i, j int) bool { return terms[i].Days < terms[j].Days })
+
+	tmpl := template.Must(template.ParseFiles("templates/term_deposits.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Deposits":       deposits,
+		"Accounts":       accounts,
+		"Terms":          terms,
+		"PenaltyRate":    money.FormatRate(config.TermDepositPenaltyBps),
+		"IdempotencyKey": uuid.New().String(),
+	})
+}
+
+// OpenTermDeposit locks funds from one of the user's accounts for a term
+func OpenTermDeposit(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	account, err := accountFromRequest(r, userID)
+	if err != nil {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid account")
+		return
+	}
+
+	amount, err := amountFromRequest(r, account)
+	if err != nil {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid deposit amount")
+		return
+	}
+
+	termDays, err := strconv.Atoi(r.FormValue("term_days"))
+	if err != nil {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid term")
+		return
+	}
+
+	if _, err := openTermDeposit(account, amount, termDays); err != nil {
+		transactionError(w, r, err, "Failed to open term deposit")
+		return
+	}
+
+	http.Redirect(w, r, "/term-deposits", http.StatusSeeOther)
+}
+
+// BreakTermDeposit closes a term deposit early
+func BreakTermDeposit(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	if err := breakTermDeposit(userID, mux.Vars(r)["id"]); err != nil {
+		transactionError(w, r, err, "Failed to break term deposit")
+		return
+	}
+
+	http.Redirect(w, r, "/term-deposits", http.StatusSeeOther)
+}
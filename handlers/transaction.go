@@ -2,29 +2,84 @@ package handlers
 
 import (
 	"Bank-Management-System/config"
+	"Bank-Management-System/money"
 	"database/sql"
 	"encoding/json"
 	"net/http"
-	"strconv"
 )
 
-// Fetch user's UUID from the database using their username/email
+// Fetch user's UUID from the database using their username
 func getUserID(username string) (string, error) {
 	var userID string
-	err := config.DB.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	err := config.DB.QueryRow("SELECT user_id FROM users WHERE user_name = ?", username).Scan(&userID)
 	if err == sql.ErrNoRows {
 		return "", nil // No user found
 	}
 	return userID, err
 }
 
-// Get user's balance using their UUID
-func getBalance(userID string) (int, error) {
-	var balance int
-	err := config.DB.QueryRow(`
-		SELECT COALESCE(SUM(CASE WHEN type='deposit' THEN amount ELSE -amount END), 0)
-		FROM transactions WHERE user_id=?`, userID).Scan(&balance)
-	return balance, err
+// Parse the amount field of a form in the account's currency
+func amountFromRequest(r *http.Request, account Account) (money.Money, error) {
+	amount, err := money.Parse(r.FormValue("amount"), account.Currency)
+	if err == nil && amount.Amount <= 0 {
+		err = money.ErrInvalidAmount
+	}
+	return amount, err
+}
+
+// Credit an account with a deposit made through a channel once it passes
+// the fraud rules. A deposit wakes a dormant account, and the money is
+// first used to clear any arrears.
+func depositFunds(account Account, amount money.Money, channel string) error {
+	if err := checkCredit(account); err != nil {
+		return err
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		return postDeposit(tx, account, amount, channel, "")
+	})
+	return fraudCaseFor(err)
+}
+
+// Post a deposit inside tx once it passes the fraud rules
+func postDeposit(tx *sql.Tx, account Account, amount money.Money, channel, reference string) error {
+	if err := screenPayment(tx, payment{Kind: "deposit", From: account, Amount: amount, Channel: channel}); err != nil {
+		return err
+	}
+	// Wake the account first so arrears can be collected from it
+	if account.Status == "dormant" {
+		if err := setAccountStatus(tx, account, "active", "Reactivated by deposit", account.UserID); err != nil {
+			return err
+		}
+	}
+	return postTransaction(tx, Posting{UserID: account.UserID, AccountNumber: account.Number, Type: "deposit", Amount: amount, Reference: reference, Channel: channel})
+}
+
+// Debit an account, checking limits, the balance and the fraud rules and
+// posting in one transaction
+func withdrawFunds(account Account, amount money.Money, channel string) error {
+	err := withTx(func(tx *sql.Tx) error {
+		return postWithdrawal(tx, account, amount, channel, "")
+	})
+	return fraudCaseFor(err)
+}
+
+// Post a withdrawal inside tx once it passes the account's limits, balance
+// and the fraud rules
+func postWithdrawal(tx *sql.Tx, account Account, amount money.Money, channel, reference string) error {
+	if err := checkDebit(account); err != nil {
+		return err
+	}
+	if err := checkLimits(tx, account, amount, channel); err != nil {
+		return err
+	}
+	if err := ensureFunds(tx, account.Number, amount); err != nil {
+		return err
+	}
+	if err := screenPayment(tx, payment{Kind: "withdraw", From: account, Amount: amount, Channel: channel}); err != nil {
+		return err
+	}
+	return postTransaction(tx, Posting{UserID: account.UserID, AccountNumber: account.Number, Type: "withdraw", Amount: amount, Reference: reference, Channel: channel})
 }
 
 // Deposit function
@@ -35,22 +90,20 @@ func Deposit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	amount, err := strconv.Atoi(r.FormValue("amount"))
-	if err != nil || amount <= 0 {
-		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid deposit amount")
+	account, err := accountFromRequest(r, userID)
+	if err != nil {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid account")
 		return
 	}
 
-	stmt, err := config.DB.Prepare("INSERT INTO transactions (user_id, type, amount) VALUES (?, 'deposit', ?)")
+	amount, err := amountFromRequest(r, account)
 	if err != nil {
-		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid deposit amount")
 		return
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(userID, amount)
-	if err != nil {
-		ErrorPage(w, r, http.StatusInternalServerError, "Failed to deposit")
+	if err := depositFunds(account, amount, "web"); err != nil {
+		transactionError(w, r, err, "Failed to deposit")
 		return
 	}
 
@@ -65,33 +118,20 @@ func Withdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	amount, err := strconv.Atoi(r.FormValue("amount"))
-	if err != nil || amount <= 0 {
-		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid withdrawal amount")
-		return
-	}
-
-	balance, err := getBalance(userID)
+	account, err := accountFromRequest(r, userID)
 	if err != nil {
-		ErrorPageTrans(w, r, http.StatusInternalServerError, "Database error")
-		return
-	}
-
-	if balance < amount {
-		ErrorPageTrans(w, r, http.StatusBadRequest, "Insufficient funds")
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid account")
 		return
 	}
 
-	stmt, err := config.DB.Prepare("INSERT INTO transactions (user_id, type, amount) VALUES (?, 'withdraw', ?)")
+	amount, err := amountFromRequest(r, account)
 	if err != nil {
-		ErrorPageTrans(w, r, http.StatusInternalServerError, "Database error")
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid withdrawal amount")
 		return
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(userID, amount)
-	if err != nil {
-		ErrorPageTrans(w, r, http.StatusInternalServerError, "Failed to withdraw")
+	if err := withdrawFunds(account, amount, "web"); err != nil {
+		transactionError(w, r, err, "Failed to withdraw")
 		return
 	}
 
@@ -106,12 +146,21 @@ func Balance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	balance, err := getBalance(userID)
-	if err != nil {
+	var account Account
+	accountNumber := r.URL.Query().Get("account_number")
+	if accountNumber == "" {
+		account, err = scanAccount(config.DB.QueryRow("SELECT "+accountColumns+" FROM "+accountsWithBalances+" WHERE a.user_id=? ORDER BY a.id LIMIT 1", userID))
+	} else {
+		account, err = getUserAccount(userID, accountNumber)
+	}
+	if err == sql.ErrNoRows {
+		ErrorPageTrans(w, r, http.StatusNotFound, "Account not found")
+		return
+	} else if err != nil {
 		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]int{"balance": balance})
-}
\ No newline at end of file
+	json.NewEncoder(w).Encode(map[string]interface{}{"account_number": account.Number, "balance": account.Balance})
+}
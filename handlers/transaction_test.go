@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Point config.DB at a fresh database in a temporary directory
+func openTestDB(t *testing.T) {
+	t.Helper()
+	config.DBPath = filepath.Join(t.TempDir(), "bank.db")
+	config.InitDB()
+	t.Cleanup(func() { config.DB.Close() })
+}
+
+// Register a customer with one funded account and return the account
+func testAccount(t *testing.T, username, accountType, funds string) Account {
+	t.Helper()
+	return testAccountIn(t, username, accountType, money.DefaultCurrency, funds)
+}
+
+// Register a customer with one funded account in a currency
+func testAccountIn(t *testing.T, username, accountType, currency, funds string) Account {
+	t.Helper()
+	userID := username + "-id"
+	_, err := config.DB.Exec("INSERT INTO users (user_id, name, user_name, user_pin, confirm_pin) VALUES (?, ?, ?, 'x', 'x')", userID, username, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	number, err := openAccount(userID, accountType, currency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := getAccount(config.DB, number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if funds != "" {
+		amount, err := money.Parse(funds, account.Currency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := depositFunds(account, amount, "web"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return account
+}
+
+func TestConcurrentWithdrawalsNeverOverdraw(t *testing.T) {
+	openTestDB(t)
+	// Only the balance check should turn withdrawals away
+	if _, err := config.DB.Exec("UPDATE fraud_rules SET action='allow'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.DB.Exec("UPDATE transaction_limits SET per_transaction=0, daily_amount=0, monthly_amount=0, daily_count=0, monthly_count=0"); err != nil {
+		t.Fatal(err)
+	}
+
+	account := testAccount(t, "alice", "current", "10000")
+	amount := money.New(10000, account.Currency)
+
+	const withdrawals = 300
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < withdrawals; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := withTx(func(tx *sql.Tx) error {
+				return postWithdrawal(tx, account, amount, "web", "")
+			})
+			var be *bankError
+			switch {
+			case err == nil:
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			case errors.As(err, &be) && be.Message == "Insufficient funds":
+			default:
+				t.Errorf("withdrawal failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	final, err := getAccount(config.DB, account.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final.Balance.Amount < 0 {
+		t.Fatalf("balance went negative: %s", final.Balance)
+	}
+	if want := int64(1000000) - int64(succeeded)*amount.Amount; final.Balance.Amount != want {
+		t.Fatalf("balance is %d after %d withdrawals, want %d", final.Balance.Amount, succeeded, want)
+	}
+	if succeeded != 100 {
+		t.Fatalf("%d withdrawals succeeded, want 100", succeeded)
+	}
+	ledger, err := ledgerBalance(config.DB, account.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger != final.Balance.Amount {
+		t.Fatalf("ledger sums to %d but the balance is %d", ledger, final.Balance.Amount)
+	}
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"Bank-Management-System/money"
+	"database/sql"
+	"html/template"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Transfer struct describing both legs of a completed transfer
+type Transfer struct {
+	Reference     string      `json:"reference"`
+	FromAccount   string      `json:"from_account"`
+	ToAccount     string      `json:"to_account"`
+	RecipientName string      `json:"recipient_name"`
+	Amount        money.Money `json:"amount"`
+	Received      money.Money `json:"received"`
+	FXRate        string      `json:"fx_rate,omitempty"`
+	CreatedAt     string      `json:"created_at"`
+}
+
+// Resolve a transfer destination given as an account number or a username.
+// Input that looks like an account number, either current with a correct
+// check digit or legacy 10 digit, is looked up as one first; anything else
+// is a username, which resolves to that customer's oldest active account.
+// Digits that are neither an account nor a username are rejected as a
+// mistyped number instead of being sent somewhere else.
+func resolveRecipient(to string) (Account, error) {
+	if plausibleAccountNumber(to) {
+		account, err := getAccount(config.DB, to)
+		if err != sql.ErrNoRows {
+			return account, err
+		}
+	}
+
+	var account Account
+	userID, err := getUserID(to)
+	if err != nil {
+		return account, err
+	}
+	if userID == "" {
+		if isDigits(to) {
+			return account, &bankError{http.StatusBadRequest, "Invalid account number, please check it and try again"}
+		}
+		return account, &bankError{http.StatusNotFound, "Recipient not found"}
+	}
+
+	account, err = scanAccount(config.DB.QueryRow("SELECT "+accountColumns+" FROM "+accountsWithBalances+" WHERE a.user_id=? AND a.status='active' ORDER BY a.id LIMIT 1", userID))
+	if err == sql.ErrNoRows {
+		return account, &bankError{http.StatusNotFound, "Recipient has no account that can receive transfers"}
+	}
+	return account, err
+}
+
+// Move funds between two accounts, debiting and crediting atomically.
+// Returns the reference shared by both legs.
+func transferFunds(from, to Account, amount money.Money, channel string) (string, error) {
+	reference := uuid.New().String()
+	err := withTx(func(tx *sql.Tx) error {
+		return postTransfer(tx, from, to, amount, reference, channel)
+	})
+	if err != nil {
+		return "", fraudCaseFor(err)
+	}
+	return reference, nil
+}
+
+// Post both legs of a transfer made through a channel inside tx, screening
+// it with the fraud rules. Between accounts in different currencies the
+// credit is converted at the current exchange rate less the configured
+// spread.
+func postTransfer(tx *sql.Tx, from, to Account, amount money.Money, reference, channel string) error {
+	if from.Number == to.Number {
+		return &bankError{http.StatusBadRequest, "Cannot transfer to the same account"}
+	}
+	if err := checkDebit(from); err != nil {
+		return err
+	}
+	if err := checkCredit(to); err != nil {
+		return err
+	}
+	if err := checkLimits(tx, from, amount, channel); err != nil {
+		return err
+	}
+	if err := ensureFunds(tx, from.Number, amount); err != nil {
+		return err
+	}
+	if err := screenPayment(tx, payment{Kind: "transfer", From: from, ToAccount: to.Number, Amount: amount, Channel: channel}); err != nil {
+		return err
+	}
+
+	credit := Posting{UserID: to.UserID, AccountNumber: to.Number, Type: "transfer_in", Amount: amount, Reference: reference, Channel: channel}
+	if from.Currency != to.Currency {
+		rate, err := exchangeRate(tx, from.Currency, to.Currency)
+		if err != nil {
+			return err
+		}
+		credit.Amount = amount.Convert(to.Currency, rate, config.FXSpreadBps)
+		credit.OriginalAmount = amount
+		credit.FXRate = rate
+		if credit.Amount.Amount <= 0 {
+			return &bankError{http.StatusBadRequest, "Amount is too small to convert"}
+		}
+	}
+
+	err := postTransaction(tx, Posting{UserID: from.UserID, AccountNumber: from.Number, Type: "transfer_out", Amount: amount, Reference: reference, Channel: channel})
+	if err != nil {
+		return err
+	}
+	return postTransaction(tx, credit)
+}
+
+// Look up a transfer sent by the given user
+func getTransfer(userID, reference string) (Transfer, error) {
+	var transfer Transfer
+	var fxRate sql.NullInt64
+	err := config.DB.QueryRow(`
+		SELECT o.reference, o.account_number, i.account_number, u.name, o.amount, o.currency, i.amount, i.currency, i.fx_rate, COALESCE(o.created_at, '')
+		FROM transactions o
+		JOIN transactions i ON i.reference = o.reference AND i.type = 'transfer_in'
+		JOIN users u ON u.user_id = i.user_id
+		WHERE o.reference=? AND o.type='transfer_out' AND o.user_id=?`, reference, userID).
+		Scan(&transfer.Reference, &transfer.FromAccount, &transfer.ToAccount, &transfer.RecipientName,
+			&transfer.Amount.Amount, &transfer.Amount.Currency, &transfer.Received.Amount, &transfer.Received.Currency, &fxRate, &transfer.CreatedAt)
+	if fxRate.Valid {
+		transfer.FXRate = money.FormatExchangeRate(fxRate.Int64)
+	}
+	return transfer, err
+}
+
+// TransferPage renders the transfer form
+func TransferPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	accounts, err := getUserAccounts(userID)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/transfer.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Accounts":       accounts,
+		"IdempotencyKey": uuid.New().String(),
+	})
+}
+
+// MakeTransfer moves funds to one of the user's own accounts or to another customer
+func MakeTransfer(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		ErrorPage(w, r, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	from, err := accountFromRequest(r, userID)
+	if err != nil {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid account")
+		return
+	}
+
+	amount, err := amountFromRequest(r, from)
+	if err != nil {
+		ErrorPageTrans(w, r, http.StatusBadRequest, "Invalid transfer amount")
+		return
+	}
+
+	to, err := resolveRecipient(r.FormValue("to"))
+	if err != nil {
+		transactionError(w, r, err, "Database error")
+		return
+	}
+
+	reference, err := transferFunds(from, to, amount, "web")
+	if err != nil {
+		transactionError(w, r, err, "Failed to transfer")
+		return
+	}
+
+	http.Redirect(w, r, "/transfer/"+reference, http.StatusSeeOther)
+}
+
+// TransferConfirmation shows the details of a completed transfer
+func TransferConfirmation(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil || userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	transfer, err := getTransfer(userID, mux.Vars(r)["reference"])
+	if err == sql.ErrNoRows {
+		ErrorPageTrans(w, r, http.StatusNotFound, "Transfer not found")
+		return
+	} else if err != nil {
+		ErrorPageTrans(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/transfer_confirmation.html"))
+	tmpl.Execute(w, transfer)
+}
@@ -0,0 +1,515 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Events a webhook subscription can ask for, with what they mean
+var webhookEvents = map[string]string{
+	"transaction.posted":     "A transaction was posted to an account",
+	"loan.approved":          "A loan was approved and paid out",
+	"loan.rejected":          "A loan application was rejected",
+	"loan.repaid":            "A loan was repaid in full",
+	"loan.overdue":           "A loan installment went past its due date unpaid",
+	"loan.installment_due":   "A loan installment falls due in the next few days",
+	"account.status_changed": "An account was frozen, unfrozen, made dormant or closed",
+	"standing_order.failed":  "A standing order payment failed",
+}
+
+// webhookEvent is the body POSTed to subscribers
+type webhookEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt string          `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// queueWebhooks is the outbox subscriber that queues a delivery of an
+// event to every active subscription that wants it
+func queueWebhooks(tx *sql.Tx, e Event) error {
+	if _, ok := webhookEvents[e.Type]; !ok {
+		return nil
+	}
+
+	rows, err := tx.Query("SELECT subscription_id, events FROM webhook_subscriptions WHERE disabled_at IS NULL")
+	if err != nil {
+		return err
+	}
+	var subscriptions []string
+	for rows.Next() {
+		var id, events string
+		if err := rows.Scan(&id, &events); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, eventType := range strings.Fields(events) {
+			if eventType == e.Type {
+				subscriptions = append(subscriptions, id)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(subscriptions) == 0 {
+		return err
+	}
+
+	payload, err := json.Marshal(webhookEvent{ID: e.ID, Type: e.Type, CreatedAt: e.CreatedAt.UTC().Format(time.RFC3339), Data: e.Data})
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(dbTime)
+	for _, subscriptionID := range subscriptions {
+		_, err := tx.Exec(`
+			INSERT INTO webhook_deliveries (delivery_id, subscription_id, event_id, event_type, payload, next_attempt_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			uuid.New().String(), subscriptionID, e.ID, e.Type, string(payload), now, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sign a payload for a subscriber. The signature covers the timestamp so a
+// captured request cannot be replayed later with a fresh one.
+func signWebhook(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// The wait before retrying something that has failed attempts times,
+// doubling from base
+func retryDelay(base time.Duration, attempts int) time.Duration {
+	if attempts > 20 {
+		attempts = 20
+	}
+	return base << uint(attempts-1)
+}
+
+// A delivery that is due, with what is needed to send it
+type dueDelivery struct {
+	id, url, secret, eventType, payload string
+	attempts                            int
+	disabled                            bool
+}
+
+// POST one delivery and return the status code the subscriber answered
+// with, or an error if it did not answer with a 2xx
+func sendWebhook(client *http.Client, d dueDelivery) (int, error) {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader([]byte(d.payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Bank-Sys-Webhooks/1")
+	req.Header.Set("X-Bank-Event", d.eventType)
+	req.Header.Set("X-Bank-Delivery", d.id)
+	req.Header.Set("X-Bank-Signature", signWebhook(d.secret, time.Now().Unix(), []byte(d.payload)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("subscriber answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// DeliverWebhooks sends every delivery that is due as of now. Failures are
+// retried with exponential backoff; after config.WebhookMaxAttempts the
+// delivery is dead and moved to webhook_dead_letters. Deliveries to
+// subscriptions that have since been disabled are dropped the same way.
+// Each delivery is claimed before it is sent, so several workers can run
+// at once without sending anything twice. Returns a one line summary.
+func DeliverWebhooks(now time.Time) (string, error) {
+	rows, err := config.DB.Query(`
+		SELECT d.delivery_id, s.url, s.secret, d.event_type, d.payload, d.attempts, s.disabled_at IS NOT NULL
+		FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.subscription_id = d.subscription_id
+		WHERE d.status='pending' AND d.next_attempt_at <= ?
+		ORDER BY d.id LIMIT 100`, now.Format(dbTime))
+	if err != nil {
+		return "", err
+	}
+	var due []dueDelivery
+	for rows.Next() {
+		var d dueDelivery
+		if err := rows.Scan(&d.id, &d.url, &d.secret, &d.eventType, &d.payload, &d.attempts, &d.disabled); err != nil {
+			rows.Close()
+			return "", err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	client := &http.Client{
+		Timeout: config.WebhookTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	delivered, retrying, dead := 0, 0, 0
+	for _, d := range due {
+		// Claim the delivery before sending it so another worker, or the
+		// CLI running alongside the server, does not send it too. The
+		// lease outlasts the request; if this process dies mid-send the
+		// delivery becomes due again once it runs out.
+		lease := now.Add(config.WebhookTimeout + time.Minute).Format(dbTime)
+		result, err := config.DB.Exec("UPDATE webhook_deliveries SET next_attempt_at=? WHERE delivery_id=? AND status='pending' AND next_attempt_at <= ?",
+			lease, d.id, now.Format(dbTime))
+		if err != nil {
+			return "", err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return "", err
+		} else if n == 0 {
+			continue
+		}
+
+		var status int
+		var sendErr error
+		if d.disabled {
+			sendErr = fmt.Errorf("subscription disabled")
+		} else {
+			status, sendErr = sendWebhook(client, d)
+		}
+		d.attempts++
+
+		err = withTx(func(tx *sql.Tx) error {
+			at := time.Now().UTC().Format(dbTime)
+			var code interface{}
+			if status != 0 {
+				code = status
+			}
+			if sendErr == nil {
+				delivered++
+				_, err := tx.Exec("UPDATE webhook_deliveries SET status='delivered', attempts=?, last_status_code=?, last_error=NULL, delivered_at=? WHERE delivery_id=?",
+					d.attempts, code, at, d.id)
+				return err
+			}
+			if int64(d.attempts) < config.WebhookMaxAttempts && !d.disabled {
+				retrying++
+				_, err := tx.Exec("UPDATE webhook_deliveries SET attempts=?, last_status_code=?, last_error=?, next_attempt_at=? WHERE delivery_id=?",
+					d.attempts, code, sendErr.Error(), now.Add(retryDelay(config.WebhookRetryBase, d.attempts)).Format(dbTime), d.id)
+				return err
+			}
+			dead++
+			_, err := tx.Exec("UPDATE webhook_deliveries SET status='dead', attempts=?, last_status_code=?, last_error=? WHERE delivery_id=?",
+				d.attempts, code, sendErr.Error(), d.id)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`
+				INSERT INTO webhook_dead_letters (delivery_id, subscription_id, event_type, payload, attempts, last_error, failed_at)
+				SELECT delivery_id, subscription_id, event_type, payload, attempts, last_error, ? FROM webhook_deliveries WHERE delivery_id=?`,
+				at, d.id)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	if delivered+retrying+dead == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("delivered %d webhook(s), %d to retry, %d dead", delivered, retrying, dead), nil
+}
+
+// StartWebhookWorker delivers webhooks every config.WebhookPollInterval
+// until the process exits
+func StartWebhookWorker() {
+	if config.WebhookPollInterval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			summary, err := DeliverWebhooks(time.Now().UTC())
+			if err != nil {
+				log.Printf("webhook delivery failed: %v", err)
+			} else if summary != "" {
+				log.Printf("webhooks: %s", summary)
+			}
+			time.Sleep(config.WebhookPollInterval)
+		}
+	}()
+}
+
+// WebhookSubscription is an endpoint events are POSTed to
+type WebhookSubscription struct {
+	ID          string
+	URL         string
+	Events      []string
+	Description string
+	CreatedAt   time.Time
+	DisabledAt  sql.NullTime
+}
+
+// WebhookDelivery is one event on its way to one subscription
+type WebhookDelivery struct {
+	ID             string
+	SubscriptionID string
+	EventType      string
+	Status         string
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastStatusCode sql.NullInt64
+	LastError      string
+	CreatedAt      time.Time
+}
+
+// WebhookDeadLetter is a delivery that was given up on
+type WebhookDeadLetter struct {
+	DeliveryID     string
+	SubscriptionID string
+	EventType      string
+	Attempts       int
+	LastError      string
+	FailedAt       time.Time
+	RedeliveredAt  sql.NullTime
+}
+
+// Make sure a subscription URL is absolute and uses HTTPS, except on
+// localhost so receivers can be tried out locally
+func checkWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return &bankError{http.StatusBadRequest, "Invalid webhook URL " + raw}
+	}
+	local := u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1"
+	if u.Scheme != "https" && !(u.Scheme == "http" && local) {
+		return &bankError{http.StatusBadRequest, "Webhook URLs must use https unless they are on localhost"}
+	}
+	return nil
+}
+
+// Add a subscription and return its ID and signing secret. The secret is
+// kept as is because every delivery is signed with it.
+func createWebhookSubscription(rawURL string, events []string, description, adminID string) (string, string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if err := checkWebhookURL(rawURL); err != nil {
+		return "", "", err
+	}
+	if len(events) == 0 {
+		return "", "", &bankError{http.StatusBadRequest, "Choose at least one event"}
+	}
+	for _, e := range events {
+		if _, ok := webhookEvents[e]; !ok {
+			return "", "", &bankError{http.StatusBadRequest, "Unknown event " + e}
+		}
+	}
+
+	random, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+	id, secret := uuid.New().String(), "whsec_"+random
+	_, err = config.DB.Exec(`
+		INSERT INTO webhook_subscriptions (subscription_id, url, secret, events, description, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		id, rawURL, secret, strings.Join(events, " "), strings.TrimSpace(description), adminID, time.Now().UTC().Format(dbTime))
+	return id, secret, err
+}
+
+// AdminWebhooks lists subscriptions, recent deliveries and dead letters
+func AdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	renderWebhooks(w, r, nil)
+}
+
+// Render the webhooks page, showing a new subscription's secret if there
+// is one
+func renderWebhooks(w http.ResponseWriter, r *http.Request, created map[string]string) {
+	var subscriptions []WebhookSubscription
+	rows, err := config.DB.Query("SELECT subscription_id, url, events, description, created_at, disabled_at FROM webhook_subscriptions ORDER BY id DESC")
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	for rows.Next() {
+		var s WebhookSubscription
+		var events string
+		if err := rows.Scan(&s.ID, &s.URL, &events, &s.Description, &s.CreatedAt, &s.DisabledAt); err != nil {
+			rows.Close()
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		s.Events = strings.Fields(events)
+		subscriptions = append(subscriptions, s)
+	}
+	rows.Close()
+
+	var deliveries []WebhookDelivery
+	rows, err = config.DB.Query(`
+		SELECT delivery_id, subscription_id, event_type, status, attempts, next_attempt_at, last_status_code, COALESCE(last_error, ''), created_at
+		FROM webhook_deliveries ORDER BY id DESC LIMIT 50`)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.EventType, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastStatusCode, &d.LastError, &d.CreatedAt); err != nil {
+			rows.Close()
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+
+	var deadLetters []WebhookDeadLetter
+	rows, err = config.DB.Query(`
+		SELECT delivery_id, subscription_id, event_type, attempts, last_error, failed_at, redelivered_at
+		FROM webhook_dead_letters ORDER BY id DESC LIMIT 50`)
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	for rows.Next() {
+		var d WebhookDeadLetter
+		if err := rows.Scan(&d.DeliveryID, &d.SubscriptionID, &d.EventType, &d.Attempts, &d.LastError, &d.FailedAt, &d.RedeliveredAt); err != nil {
+			rows.Close()
+			ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+			return
+		}
+		deadLetters = append(deadLetters, d)
+	}
+	rows.Close()
+
+	events := make(map[string]bool, len(webhookEvents))
+	for e := range webhookEvents {
+		events[e] = true
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/admin_webhooks.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Subscriptions": subscriptions,
+		"Deliveries":    deliveries,
+		"DeadLetters":   deadLetters,
+		"Events":        sortedKeys(events),
+		"Descriptions":  webhookEvents,
+		"Created":       created,
+	})
+}
+
+// CreateWebhookSubscription adds a subscription and shows its secret once
+func CreateWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		ErrorPage(w, r, http.StatusBadRequest, "Invalid form")
+		return
+	}
+
+	id, secret, err := createWebhookSubscription(r.PostForm.Get("url"), r.PostForm["events"], r.PostForm.Get("description"), adminID)
+	if err != nil {
+		adminError(w, r, err, "Failed to add webhook")
+		return
+	}
+
+	renderWebhooks(w, r, map[string]string{"ID": id, "Secret": secret})
+}
+
+// DisableWebhookSubscription stops sending events to a subscription.
+// Deliveries still pending for it are moved to the dead letters the next
+// time the worker runs.
+func DisableWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	result, err := config.DB.Exec("UPDATE webhook_subscriptions SET disabled_at=? WHERE subscription_id=? AND disabled_at IS NULL",
+		time.Now().UTC().Format(dbTime), mux.Vars(r)["id"])
+	if err != nil {
+		ErrorPage(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		ErrorPage(w, r, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// Queue a dead delivery to be sent again as a new delivery of the same
+// event, so subscribers can tell it apart by X-Bank-Delivery but still
+// recognise the event ID
+func redeliverWebhook(deliveryID string) error {
+	return withTx(func(tx *sql.Tx) error {
+		var subscriptionID string
+		var redelivered sql.NullTime
+		err := tx.QueryRow("SELECT subscription_id, redelivered_at FROM webhook_dead_letters WHERE delivery_id=?", deliveryID).
+			Scan(&subscriptionID, &redelivered)
+		if err == sql.ErrNoRows {
+			return &bankError{http.StatusNotFound, "Dead letter not found"}
+		} else if err != nil {
+			return err
+		}
+		if redelivered.Valid {
+			return &bankError{http.StatusBadRequest, "Delivery was already redelivered"}
+		}
+
+		var disabled bool
+		if err := tx.QueryRow("SELECT disabled_at IS NOT NULL FROM webhook_subscriptions WHERE subscription_id=?", subscriptionID).Scan(&disabled); err != nil {
+			return err
+		}
+		if disabled {
+			return &bankError{http.StatusBadRequest, "Webhook is disabled"}
+		}
+
+		now := time.Now().UTC().Format(dbTime)
+		_, err = tx.Exec(`
+			INSERT INTO webhook_deliveries (delivery_id, subscription_id, event_id, event_type, payload, next_attempt_at, created_at)
+			SELECT ?, subscription_id, event_id, event_type, payload, ?, ? FROM webhook_deliveries WHERE delivery_id=?`,
+			uuid.New().String(), now, now, deliveryID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE webhook_dead_letters SET redelivered_at=? WHERE delivery_id=?", now, deliveryID)
+		return err
+	})
+}
+
+// RedeliverWebhook sends a dead delivery again
+func RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	if err := redeliverWebhook(mux.Vars(r)["id"]); err != nil {
+		adminError(w, r, err, "Failed to redeliver webhook")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
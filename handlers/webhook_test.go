@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"Bank-Management-System/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSignWebhook(t *testing.T) {
+	payload := []byte(`{"id":"evt"}`)
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte("1700000000." + string(payload)))
+	want := "t=1700000000,v1=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := signWebhook("whsec_test", 1700000000, payload); got != want {
+		t.Fatalf("signature %q, want %q", got, want)
+	}
+	if signWebhook("whsec_test", 1700000001, payload) == want {
+		t.Fatal("signature does not cover the timestamp")
+	}
+	if signWebhook("whsec_other", 1700000000, payload) == want {
+		t.Fatal("signature does not depend on the secret")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, 64 * time.Minute},
+		{20, 30 * time.Second << 19},
+		{21, 30 * time.Second << 19},
+		{100, 30 * time.Second << 19},
+	}
+	for _, test := range tests {
+		if got := retryDelay(30*time.Second, test.attempts); got != test.want {
+			t.Errorf("retryDelay after %d attempt(s) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+// webhookReceiver is a subscriber endpoint that checks signatures and
+// answers with whatever status it is set to
+type webhookReceiver struct {
+	t      *testing.T
+	secret string
+	mu     sync.Mutex
+	status int
+	delay  time.Duration
+	// The X-Bank-Delivery header and event of every request received
+	deliveries []string
+	events     []webhookEvent
+}
+
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var timestamp int64
+	if _, err := fmt.Sscanf(r.Header.Get("X-Bank-Signature"), "t=%d,", &timestamp); err != nil ||
+		signWebhook(rec.secret, timestamp, body) != r.Header.Get("X-Bank-Signature") {
+		rec.t.Errorf("bad signature %q", r.Header.Get("X-Bank-Signature"))
+	}
+	var e webhookEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		rec.t.Errorf("bad payload %s", body)
+	}
+	if r.Header.Get("X-Bank-Event") != e.Type {
+		rec.t.Errorf("X-Bank-Event %q for a %q event", r.Header.Get("X-Bank-Event"), e.Type)
+	}
+	time.Sleep(rec.delay)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.deliveries = append(rec.deliveries, r.Header.Get("X-Bank-Delivery"))
+	rec.events = append(rec.events, e)
+	w.WriteHeader(rec.status)
+}
+
+// Subscribe a receiver to loan.approved and return it
+func testWebhookReceiver(t *testing.T, status int) *webhookReceiver {
+	t.Helper()
+	rec := &webhookReceiver{t: t, status: status}
+	server := httptest.NewServer(rec)
+	t.Cleanup(server.Close)
+
+	id, secret, err := createWebhookSubscription(server.URL+"/hooks", []string{"loan.approved"}, "test", "admin-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.secret = secret
+	t.Cleanup(func() {
+		config.DB.Exec("UPDATE webhook_subscriptions SET disabled_at=? WHERE subscription_id=?", time.Now().UTC().Format(dbTime), id)
+	})
+	return rec
+}
+
+// Queue a loan.approved event for every subscription and return its ID
+func queueTestWebhook(t *testing.T) string {
+	t.Helper()
+	e := Event{ID: uuid.New().String(), Type: "loan.approved", Data: json.RawMessage(`{"loan_id":"l1"}`), CreatedAt: time.Now()}
+	if err := withTx(func(tx *sql.Tx) error { return queueWebhooks(tx, e) }); err != nil {
+		t.Fatal(err)
+	}
+	return e.ID
+}
+
+// Send the deliveries due at now, failing the test on error
+func deliverTestWebhooks(t *testing.T, now time.Time) {
+	t.Helper()
+	if _, err := DeliverWebhooks(now); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	openTestDB(t)
+	rec := testWebhookReceiver(t, http.StatusOK)
+	eventID := queueTestWebhook(t)
+
+	deliverTestWebhooks(t, time.Now().UTC())
+	deliverTestWebhooks(t, time.Now().UTC().Add(time.Hour))
+	if len(rec.events) != 1 || rec.events[0].ID != eventID || string(rec.events[0].Data) != `{"loan_id":"l1"}` {
+		t.Fatalf("receiver got %+v, want the event once", rec.events)
+	}
+
+	var status string
+	var attempts int
+	err := config.DB.QueryRow("SELECT status, attempts FROM webhook_deliveries WHERE delivery_id=?", rec.deliveries[0]).Scan(&status, &attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "delivered" || attempts != 1 {
+		t.Fatalf("delivery is %s after %d attempt(s)", status, attempts)
+	}
+}
+
+func TestConcurrentWorkersDeliverOnce(t *testing.T) {
+	openTestDB(t)
+	rec := testWebhookReceiver(t, http.StatusOK)
+	rec.delay = 50 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		queueTestWebhook(t)
+	}
+
+	// The server's worker and the CLI both find the same deliveries due
+	now := time.Now().UTC()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := DeliverWebhooks(now); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, id := range rec.deliveries {
+		if seen[id] {
+			t.Errorf("delivery %s was sent more than once", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 5 {
+		t.Fatalf("receiver got %d deliveries, want 5", len(seen))
+	}
+}
+
+func TestFailingWebhookIsRetriedThenDead(t *testing.T) {
+	openTestDB(t)
+	maxAttempts := config.WebhookMaxAttempts
+	config.WebhookMaxAttempts = 3
+	t.Cleanup(func() { config.WebhookMaxAttempts = maxAttempts })
+
+	rec := testWebhookReceiver(t, http.StatusInternalServerError)
+	eventID := queueTestWebhook(t)
+
+	now := time.Now().UTC()
+	for attempt := 1; attempt <= 3; attempt++ {
+		deliverTestWebhooks(t, now)
+		// The retry waits retryDelay, so it is not due again yet
+		deliverTestWebhooks(t, now.Add(retryDelay(config.WebhookRetryBase, attempt)-time.Second))
+		if len(rec.deliveries) != attempt {
+			t.Fatalf("after %d attempt(s) the receiver was called %d time(s)", attempt, len(rec.deliveries))
+		}
+		now = now.Add(retryDelay(config.WebhookRetryBase, attempt) + time.Minute)
+	}
+	deliverTestWebhooks(t, now.Add(time.Hour))
+	if len(rec.deliveries) != 3 {
+		t.Fatalf("a dead delivery was sent again: %d call(s)", len(rec.deliveries))
+	}
+
+	deliveryID := rec.deliveries[0]
+	var status string
+	var lastCode int
+	if err := config.DB.QueryRow("SELECT status, last_status_code FROM webhook_deliveries WHERE delivery_id=?", deliveryID).Scan(&status, &lastCode); err != nil {
+		t.Fatal(err)
+	}
+	if status != "dead" || lastCode != http.StatusInternalServerError {
+		t.Fatalf("delivery is %s with last status %d, want dead after a 500", status, lastCode)
+	}
+	var attempts int
+	if err := config.DB.QueryRow("SELECT attempts FROM webhook_dead_letters WHERE delivery_id=?", deliveryID).Scan(&attempts); err != nil {
+		t.Fatalf("no dead letter: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("dead letter records %d attempt(s), want 3", attempts)
+	}
+
+	// Once the receiver is fixed the event can be sent again as a new
+	// delivery, but only once
+	rec.status = http.StatusNoContent
+	if err := redeliverWebhook(deliveryID); err != nil {
+		t.Fatal(err)
+	}
+	var be *bankError
+	if err := redeliverWebhook(deliveryID); !errors.As(err, &be) || be.Status != http.StatusBadRequest {
+		t.Fatalf("second redelivery returned %v, want 400", err)
+	}
+	if err := redeliverWebhook("missing"); !errors.As(err, &be) || be.Status != http.StatusNotFound {
+		t.Fatalf("redelivering a missing dead letter returned %v, want 404", err)
+	}
+
+	deliverTestWebhooks(t, time.Now().UTC())
+	if len(rec.deliveries) != 4 {
+		t.Fatalf("receiver was called %d time(s), want the redelivery", len(rec.deliveries))
+	}
+	if rec.deliveries[3] == deliveryID || rec.events[3].ID != eventID {
+		t.Fatalf("redelivery %s of event %s, want a new delivery of event %s", rec.deliveries[3], rec.events[3].ID, eventID)
+	}
+}
@@ -0,0 +1,44 @@
+package money
+
+import "math/big"
+
+// RateScale is the fixed-point scale of exchange rates: a rate of 129.5
+// KES per USD is stored as 129_500_000
+const RateScale = 1_000_000
+
+// ParseExchangeRate reads a rate such as "129.45" into RateScale units
+func ParseExchangeRate(input string) (int64, error) {
+	rate, err := parseDecimal(input, 6)
+	if err == nil && rate <= 0 {
+		err = ErrInvalidAmount
+	}
+	return rate, err
+}
+
+// FormatExchangeRate formats a rate in RateScale units, e.g. "129.450000"
+func FormatExchangeRate(rate int64) string {
+	return formatDecimal(rate, 6, false)
+}
+
+// InvertRate returns the rate for the opposite direction of a currency pair
+func InvertRate(rate int64) int64 {
+	return RoundHalfEven(big.NewInt(RateScale*RateScale), big.NewInt(rate))
+}
+
+// Convert turns m into the target currency at rate (target units per unit of
+// m's currency, in RateScale units) less a spread in basis points, rounding
+// to the target's minor unit with banker's rounding.
+func (m Money) Convert(target string, rate int64, spreadBps int64) Money {
+	num := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(rate))
+	num.Mul(num, big.NewInt(10000-spreadBps))
+	num.Mul(num, pow10(Exponent(target)))
+
+	den := big.NewInt(RateScale * 10000)
+	den.Mul(den, pow10(Exponent(m.Currency)))
+
+	return New(RoundHalfEven(num, den), target)
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
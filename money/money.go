@@ -0,0 +1,261 @@
+// Package money represents amounts as integer minor units (cents) tagged
+// with an ISO 4217 currency code, so no amount ever passes through a float.
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// DefaultCurrency is the currency accounts are opened in unless told otherwise
+const DefaultCurrency = "KES"
+
+// Number of decimal places in each supported currency's minor unit
+var exponents = map[string]int{
+	"KES": 2,
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"TZS": 2,
+	"UGX": 0,
+}
+
+var (
+	ErrInvalidAmount   = errors.New("invalid amount")
+	ErrTooManyDecimals = errors.New("too many decimal places")
+	ErrUnknownCurrency = errors.New("unknown currency")
+)
+
+// Money is an amount in minor units of a currency
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// New creates a Money from an amount already in minor units
+func New(minor int64, currency string) Money {
+	return Money{Amount: minor, Currency: currency}
+}
+
+// ValidCurrency reports whether the currency code is supported
+func ValidCurrency(currency string) bool {
+	_, ok := exponents[currency]
+	return ok
+}
+
+// Currencies lists the supported currency codes in alphabetical order
+func Currencies() []string {
+	codes := make([]string, 0, len(exponents))
+	for code := range exponents {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Exponent returns the number of decimal places of a currency's minor unit
+func Exponent(currency string) int {
+	if e, ok := exponents[currency]; ok {
+		return e
+	}
+	return 2
+}
+
+// Parse reads a decimal amount typed by a user, such as "1,250.50", in the
+// given currency. Thousands separators are allowed; more decimal places
+// than the currency has, signs and anything else are rejected.
+func Parse(input, currency string) (Money, error) {
+	if !ValidCurrency(currency) {
+		return Money{}, ErrUnknownCurrency
+	}
+	minor, err := parseDecimal(input, Exponent(currency))
+	if err != nil {
+		return Money{}, err
+	}
+	return New(minor, currency), nil
+}
+
+// ParseRate reads a percentage such as "12.5" and returns it in basis points
+func ParseRate(input string) (int64, error) {
+	return parseDecimal(input, 2)
+}
+
+// FormatRate formats basis points as a percentage such as "12.50"
+func FormatRate(bps int64) string {
+	return formatDecimal(bps, 2, false)
+}
+
+// Parse a non-negative decimal string into an integer scaled by 10^exponent
+func parseDecimal(input string, exponent int) (int64, error) {
+	s := strings.TrimSpace(input)
+	whole, frac, hasPoint := strings.Cut(s, ".")
+	if strings.Contains(whole, ",") {
+		if !validGrouping(whole) {
+			return 0, ErrInvalidAmount
+		}
+		whole = strings.ReplaceAll(whole, ",", "")
+	}
+	if whole == "" && frac == "" || hasPoint && frac == "" {
+		return 0, ErrInvalidAmount
+	}
+	if len(frac) > exponent {
+		return 0, ErrTooManyDecimals
+	}
+	if whole == "" {
+		whole = "0"
+	}
+
+	digits := whole + frac + strings.Repeat("0", exponent-len(frac))
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidAmount
+		}
+	}
+
+	n, ok := new(big.Int).SetString(digits, 10)
+	if !ok || !n.IsInt64() {
+		return 0, ErrInvalidAmount
+	}
+	return n.Int64(), nil
+}
+
+// Report whether commas in the whole part of an amount separate thousands:
+// a leading group of one to three digits and then groups of exactly three
+func validGrouping(whole string) bool {
+	groups := strings.Split(whole, ",")
+	if len(groups[0]) == 0 || len(groups[0]) > 3 {
+		return false
+	}
+	for _, g := range groups[1:] {
+		if len(g) != 3 {
+			return false
+		}
+	}
+	return true
+}
+
+// Format a scaled integer as a decimal string, optionally grouping thousands
+func formatDecimal(n int64, exponent int, group bool) string {
+	sign := ""
+	abs := new(big.Int).Abs(big.NewInt(n)).String()
+	if n < 0 {
+		sign = "-"
+	}
+	if len(abs) <= exponent {
+		abs = strings.Repeat("0", exponent-len(abs)+1) + abs
+	}
+
+	whole, frac := abs[:len(abs)-exponent], abs[len(abs)-exponent:]
+	if group {
+		var b strings.Builder
+		for i, c := range whole {
+			if i > 0 && (len(whole)-i)%3 == 0 {
+				b.WriteByte(',')
+			}
+			b.WriteRune(c)
+		}
+		whole = b.String()
+	}
+	if exponent == 0 {
+		return sign + whole
+	}
+	return sign + whole + "." + frac
+}
+
+// Decimal formats the amount without grouping or currency, e.g. "1250.50"
+func (m Money) Decimal() string {
+	return formatDecimal(m.Amount, Exponent(m.Currency), false)
+}
+
+// String formats the amount for display, e.g. "KES 1,250.50"
+func (m Money) String() string {
+	return m.Currency + " " + formatDecimal(m.Amount, Exponent(m.Currency), true)
+}
+
+// IsZero reports whether the amount is zero
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// Add returns m + o; both must be in the same currency
+func (m Money) Add(o Money) Money {
+	mustMatch(m, o)
+	return New(m.Amount+o.Amount, m.Currency)
+}
+
+// Sub returns m - o; both must be in the same currency
+func (m Money) Sub(o Money) Money {
+	mustMatch(m, o)
+	return New(m.Amount-o.Amount, m.Currency)
+}
+
+// MulRatio returns m * num / den rounded to the nearest minor unit, with
+// ties going to the even neighbour (banker's rounding)
+func (m Money) MulRatio(num, den int64) Money {
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(num))
+	return New(RoundHalfEven(product, big.NewInt(den)), m.Currency)
+}
+
+// RoundHalfEven divides num by den, rounding ties to the even result
+func RoundHalfEven(num, den *big.Int) int64 {
+	if den.Sign() < 0 {
+		num, den = new(big.Int).Neg(num), new(big.Int).Neg(den)
+	}
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+
+	// Compare twice the remainder with the divisor to decide the rounding
+	twice := new(big.Int).Abs(r)
+	twice.Lsh(twice, 1)
+	cmp := twice.Cmp(den)
+	if cmp > 0 || cmp == 0 && q.Bit(0) == 1 {
+		if num.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q.Int64()
+}
+
+// Interest is simple interest on m at an annual rate in basis points over
+// the given number of days, using a 365 day year and banker's rounding
+func (m Money) Interest(bps int64, days int64) Money {
+	return m.MulRatio(bps*days, 10000*365)
+}
+
+// MarshalJSON encodes the amount as a decimal string next to its currency
+// and minor units, so clients never need to parse a float
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Minor    int64  `json:"minor_units"`
+		Currency string `json:"currency"`
+	}{m.Decimal(), m.Amount, m.Currency})
+}
+
+// UnmarshalJSON reads an amount written by MarshalJSON, trusting its minor
+// units over the decimal string
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Minor    int64  `json:"minor_units"`
+		Currency string `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if !ValidCurrency(v.Currency) {
+		return ErrUnknownCurrency
+	}
+	m.Amount, m.Currency = v.Minor, v.Currency
+	return nil
+}
+
+func mustMatch(a, b Money) {
+	if a.Currency != b.Currency {
+		panic(fmt.Sprintf("money: currency mismatch %s and %s", a.Currency, b.Currency))
+	}
+}
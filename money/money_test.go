@@ -0,0 +1,160 @@
+package money
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		currency string
+		want     int64
+		err      error
+	}{
+		{"1,250.50", "KES", 125050, nil},
+		{"1250.5", "KES", 125050, nil},
+		{"1,234,567", "KES", 123456700, nil},
+		{" 12 ", "KES", 1200, nil},
+		{".5", "KES", 50, nil},
+		{"0.01", "USD", 1, nil},
+		{"1,500", "UGX", 1500, nil},
+		{"1,,2", "KES", 0, ErrInvalidAmount},
+		{",5", "KES", 0, ErrInvalidAmount},
+		{"12,34,5", "KES", 0, ErrInvalidAmount},
+		{"1,2345", "KES", 0, ErrInvalidAmount},
+		{"1234,567", "KES", 0, ErrInvalidAmount},
+		{"1,000,", "KES", 0, ErrInvalidAmount},
+		{"1.", "KES", 0, ErrInvalidAmount},
+		{"", "KES", 0, ErrInvalidAmount},
+		{"-5", "KES", 0, ErrInvalidAmount},
+		{"+5", "KES", 0, ErrInvalidAmount},
+		{"1e3", "KES", 0, ErrInvalidAmount},
+		{"99999999999999999999", "KES", 0, ErrInvalidAmount},
+		{"1.005", "KES", 0, ErrTooManyDecimals},
+		{"1.5", "UGX", 0, ErrTooManyDecimals},
+		{"10", "XYZ", 0, ErrUnknownCurrency},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.input, tt.currency)
+		if err != tt.err {
+			t.Errorf("Parse(%q, %s): error %v, want %v", tt.input, tt.currency, err, tt.err)
+			continue
+		}
+		if err == nil && (got.Amount != tt.want || got.Currency != tt.currency) {
+			t.Errorf("Parse(%q, %s) = %d %s, want %d", tt.input, tt.currency, got.Amount, got.Currency, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{New(125050, "KES"), "KES 1,250.50"},
+		{New(5, "USD"), "USD 0.05"},
+		{New(-123456789, "EUR"), "EUR -1,234,567.89"},
+		{New(1500, "UGX"), "UGX 1,500"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("%d %s formats as %q, want %q", tt.m.Amount, tt.m.Currency, got, tt.want)
+		}
+	}
+}
+
+func TestRoundHalfEven(t *testing.T) {
+	tests := []struct {
+		num, den int64
+		want     int64
+	}{
+		{1, 2, 0},   // 0.5
+		{3, 2, 2},   // 1.5
+		{5, 2, 2},   // 2.5
+		{7, 2, 4},   // 3.5
+		{-1, 2, 0},  // -0.5
+		{-3, 2, -2}, // -1.5
+		{-5, 2, -2}, // -2.5
+		{5, -2, -2}, // -2.5 with the sign on the divisor
+		{7, 3, 2},   // 2.33
+		{8, 3, 3},   // 2.67
+		{-8, 3, -3}, // -2.67
+		{6, 3, 2},
+	}
+	for _, tt := range tests {
+		if got := RoundHalfEven(big.NewInt(tt.num), big.NewInt(tt.den)); got != tt.want {
+			t.Errorf("RoundHalfEven(%d, %d) = %d, want %d", tt.num, tt.den, got, tt.want)
+		}
+	}
+}
+
+func TestMulRatio(t *testing.T) {
+	tests := []struct {
+		amount, num, den int64
+		want             int64
+	}{
+		{1000, 1, 3, 333},
+		{1000, 2, 3, 667},
+		{25, 1, 10, 2}, // 2.5
+		{35, 1, 10, 4}, // 3.5
+		{-25, 1, 10, -2},
+		{100, 0, 7, 0},
+	}
+	for _, tt := range tests {
+		got := New(tt.amount, "KES").MulRatio(tt.num, tt.den)
+		if got.Amount != tt.want || got.Currency != "KES" {
+			t.Errorf("%d * %d/%d = %d %s, want %d KES", tt.amount, tt.num, tt.den, got.Amount, got.Currency, tt.want)
+		}
+	}
+}
+
+func TestInterest(t *testing.T) {
+	// 10% a year on KES 10,000 for 73 days is exactly KES 200
+	if got := New(1000000, "KES").Interest(1000, 73); got.Amount != 20000 {
+		t.Errorf("interest is %d, want 20000", got.Amount)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	rate, err := ParseExchangeRate("129.5")
+	if err != nil || rate != 129*RateScale+RateScale/2 {
+		t.Fatalf("ParseExchangeRate(129.5) = %d, %v", rate, err)
+	}
+
+	tests := []struct {
+		from      Money
+		target    string
+		rate      int64
+		spreadBps int64
+		want      int64
+	}{
+		{New(100, "USD"), "KES", rate, 0, 12950},            // USD 1.00 -> KES 129.50
+		{New(100, "USD"), "KES", rate, 100, 12820},          // less 1% is 128.205, a tie that goes to the even 128.20
+		{New(100, "USD"), "UGX", 3700 * RateScale, 0, 3700}, // UGX has no minor unit
+		{New(3700, "UGX"), "USD", InvertRate(3700 * RateScale), 0, 100},
+		{New(1, "KES"), "USD", InvertRate(rate), 0, 0}, // too small to convert
+	}
+	for _, tt := range tests {
+		got := tt.from.Convert(tt.target, tt.rate, tt.spreadBps)
+		if got.Amount != tt.want || got.Currency != tt.target {
+			t.Errorf("%s at %s less %d bps = %s, want %d %s", tt.from, FormatExchangeRate(tt.rate), tt.spreadBps, got, tt.want, tt.target)
+		}
+	}
+}
+
+func TestInvertRate(t *testing.T) {
+	tests := []struct {
+		rate, want int64
+	}{
+		{2 * RateScale, RateScale / 2},
+		{4 * RateScale, RateScale / 4},
+		{129500000, 7722}, // 1/129.5 = 0.0077220
+		{3 * RateScale, 333333},
+	}
+	for _, tt := range tests {
+		if got := InvertRate(tt.rate); got != tt.want {
+			t.Errorf("InvertRate(%d) = %d, want %d", tt.rate, got, tt.want)
+		}
+	}
+}
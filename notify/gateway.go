@@ -0,0 +1,46 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// GatewaySender sends SMS through an HTTP gateway. Each message is POSTed
+// to URL as {"to": "+254...", "message": "..."}, with Token as a bearer
+// token if it is set; any 2xx answer means the gateway accepted it.
+type GatewaySender struct {
+	URL     string
+	Token   string
+	Timeout time.Duration
+}
+
+// Send posts m to the gateway
+func (s GatewaySender) Send(m Message) error {
+	body, err := json.Marshal(map[string]string{"to": m.To, "message": m.Body})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+
+	resp, err := (&http.Client{Timeout: s.Timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("SMS gateway answered %s", resp.Status)
+	}
+	return nil
+}
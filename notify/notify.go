@@ -0,0 +1,61 @@
+// Package notify sends messages to customers by email and SMS. Senders are
+// pluggable: SMTPSender and GatewaySender talk to real services, while
+// FileSender writes every message to a local file and FakeSMTPServer
+// accepts mail on a local port, so everything can be tried out offline.
+package notify
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Channels messages can be sent on
+const (
+	Email = "email"
+	SMS   = "sms"
+)
+
+// Message is one message to one recipient. Subject is only used for email.
+type Message struct {
+	Channel string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers messages on a channel
+type Sender interface {
+	Send(m Message) error
+}
+
+// FileSender appends messages to a file instead of sending them
+type FileSender struct {
+	Path string
+}
+
+// Writes from different senders to the same file must not interleave
+var fileMu sync.Mutex
+
+// Send appends m to the file
+func (s FileSender) Send(m Message) error {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "=== %s %s to %s\n", time.Now().UTC().Format(time.RFC3339), m.Channel, m.To)
+	if err == nil && m.Subject != "" {
+		_, err = fmt.Fprintf(f, "Subject: %s\n", m.Subject)
+	}
+	if err == nil {
+		_, err = fmt.Fprintf(f, "\n%s\n\n", m.Body)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
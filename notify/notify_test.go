@@ -0,0 +1,84 @@
+package notify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSender(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.log")
+	sender := FileSender{Path: path}
+
+	if err := sender.Send(Message{Channel: Email, To: "alice@example.com", Subject: "Deposit received", Body: "Hi Alice,\n\nKES 1,000.00 arrived."}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.Send(Message{Channel: SMS, To: "+254700000001", Body: "Bank Sys: KES 1,000.00 paid in."}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := strings.Split(string(data), "=== ")[1:]
+	if len(messages) != 2 {
+		t.Fatalf("file holds %d message(s), want 2:\n%s", len(messages), data)
+	}
+	for _, want := range []string{" email to alice@example.com\n", "Subject: Deposit received\n", "\nHi Alice,\n\nKES 1,000.00 arrived.\n"} {
+		if !strings.Contains(messages[0], want) {
+			t.Errorf("email %q does not contain %q", messages[0], want)
+		}
+	}
+	if !strings.Contains(messages[1], " sms to +254700000001\n") || strings.Contains(messages[1], "Subject:") {
+		t.Errorf("SMS written as %q", messages[1])
+	}
+}
+
+func TestSMTPSender(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &FakeSMTPServer{Path: path}
+	done := make(chan struct{})
+	go func() {
+		server.Serve(listener)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+
+	sender := SMTPSender{Addr: listener.Addr().String(), From: "Bank Sys <no-reply@banksys.local>"}
+	err = sender.Send(Message{
+		Channel: Email,
+		To:      "alice@example.com",
+		Subject: "Paiement reçu",
+		Body:    "Hi Alice,\n.hidden line\nBank Sys",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"from no-reply@banksys.local to alice@example.com\n",
+		"From: Bank Sys <no-reply@banksys.local>\n",
+		"To: alice@example.com\n",
+		"Subject: =?utf-8?q?Paiement_re=C3=A7u?=\n",
+		"Content-Type: text/plain; charset=UTF-8\n",
+		"\nHi Alice,\n.hidden line\nBank Sys\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("received mail does not contain %q:\n%s", want, data)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package notify
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTPSender sends email through an SMTP server. Username and Password are
+// optional; without them no authentication is attempted.
+type SMTPSender struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Send emails m as plain UTF-8 text
+func (s SMTPSender) Send(m Message) error {
+	// From may carry a display name; the envelope takes the bare address
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("sender address: %w", err)
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+
+	return smtp.SendMail(s.Addr, auth, from.Address, []string{m.To}, []byte(b.String()))
+}
+
+// FakeSMTPServer accepts mail on a local address and appends each message
+// to a file, so SMTPSender can be tried out without a mail server. It
+// speaks just enough SMTP for net/smtp and common mail clients, and
+// accepts every sender and recipient.
+type FakeSMTPServer struct {
+	Addr string
+	Path string
+
+	mu sync.Mutex
+}
+
+// ListenAndServe listens on Addr and accepts connections until the
+// listener fails
+func (s *FakeSMTPServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener until it fails or is closed
+func (s *FakeSMTPServer) Serve(listener net.Listener) error {
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.serve(conn); err != nil && err != io.EOF {
+				log.Printf("fake smtp: %v", err)
+			}
+		}()
+	}
+}
+
+// Hold one SMTP conversation
+func (s *FakeSMTPServer) serve(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) error {
+		_, err := fmt.Fprintf(conn, format+"\r\n", args...)
+		return err
+	}
+
+	if err := reply("220 localhost fake SMTP ready"); err != nil {
+		return err
+	}
+	var from string
+	var to []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(line)
+		if i := strings.IndexByte(verb, ' '); i >= 0 {
+			verb = verb[:i]
+		}
+
+		switch verb {
+		case "EHLO", "HELO":
+			err = reply("250 localhost")
+		case "MAIL":
+			from, to = addressIn(line), nil
+			err = reply("250 OK")
+		case "RCPT":
+			to = append(to, addressIn(line))
+			err = reply("250 OK")
+		case "DATA":
+			if len(to) == 0 {
+				err = reply("503 RCPT first")
+				break
+			}
+			if err = reply("354 End data with <CR><LF>.<CR><LF>"); err != nil {
+				return err
+			}
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return err
+				}
+				line = strings.TrimRight(line, "\r\n")
+				if line == "." {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, ".") + "\n")
+			}
+			if err = s.save(from, to, data.String()); err != nil {
+				reply("451 %v", err)
+				return err
+			}
+			to = nil
+			err = reply("250 OK")
+		case "RSET":
+			from, to = "", nil
+			err = reply("250 OK")
+		case "NOOP":
+			err = reply("250 OK")
+		case "QUIT":
+			return reply("221 Bye")
+		default:
+			err = reply("502 Command not implemented")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The address in a MAIL FROM:<a> or RCPT TO:<a> command
+func addressIn(line string) string {
+	start, end := strings.IndexByte(line, '<'), strings.LastIndexByte(line, '>')
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+// Append a received message to the file
+func (s *FakeSMTPServer) save(from string, to []string, data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "=== %s from %s to %s\n%s\n", time.Now().UTC().Format(time.RFC3339), from, strings.Join(to, ", "), data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -19,14 +19,111 @@ func Routes() *mux.Router {
 
 	// Protected Routes
 	mux.HandleFunc("/dashboard", handlers.Dashboard).Methods("GET")
-	mux.HandleFunc("/deposit", handlers.Deposit).Methods("POST")
-	mux.HandleFunc("/withdraw", handlers.Withdraw).Methods("POST")
+	mux.HandleFunc("/deposit", handlers.Idempotent(handlers.Deposit)).Methods("POST")
+	mux.HandleFunc("/withdraw", handlers.Idempotent(handlers.Withdraw)).Methods("POST")
 	mux.HandleFunc("/balance", handlers.Balance).Methods("GET")
+	mux.HandleFunc("/open-account", handlers.OpenAccount).Methods("POST")
+	mux.HandleFunc("/accounts/{number}/close", handlers.CloseAccount).Methods("POST")
+	mux.HandleFunc("/transfer", handlers.TransferPage).Methods("GET")
+	mux.HandleFunc("/transfer", handlers.Idempotent(handlers.MakeTransfer)).Methods("POST")
+	mux.HandleFunc("/transfer/{reference}", handlers.TransferConfirmation).Methods("GET")
+	mux.HandleFunc("/term-deposits", handlers.TermDepositsPage).Methods("GET")
+	mux.HandleFunc("/term-deposits", handlers.Idempotent(handlers.OpenTermDeposit)).Methods("POST")
+	mux.HandleFunc("/term-deposits/{id}/break", handlers.BreakTermDeposit).Methods("POST")
+	mux.HandleFunc("/standing-orders", handlers.StandingOrdersPage).Methods("GET")
+	mux.HandleFunc("/standing-orders", handlers.Idempotent(handlers.CreateStandingOrder)).Methods("POST")
+	mux.HandleFunc("/standing-orders/{id}/edit", handlers.EditStandingOrderPage).Methods("GET")
+	mux.HandleFunc("/standing-orders/{id}", handlers.UpdateStandingOrder).Methods("POST")
+	mux.HandleFunc("/standing-orders/{id}/pause", handlers.PauseStandingOrder).Methods("POST")
+	mux.HandleFunc("/standing-orders/{id}/resume", handlers.ResumeStandingOrder).Methods("POST")
+	mux.HandleFunc("/standing-orders/{id}/cancel", handlers.CancelStandingOrder).Methods("POST")
+	mux.HandleFunc("/notifications", handlers.NotificationsPage).Methods("GET")
+	mux.HandleFunc("/notifications/read-all", handlers.MarkAllNotificationsRead).Methods("POST")
+	mux.HandleFunc("/notifications/{id}/read", handlers.MarkNotificationRead).Methods("POST")
+	mux.HandleFunc("/notification-settings", handlers.NotificationSettingsPage).Methods("GET")
+	mux.HandleFunc("/notification-settings", handlers.UpdateNotificationSettings).Methods("POST")
+	mux.HandleFunc("/api-tokens", handlers.APITokensPage).Methods("GET")
+	mux.HandleFunc("/api-tokens", handlers.CreateAPIToken).Methods("POST")
+	mux.HandleFunc("/api-tokens/{id}/revoke", handlers.RevokeAPIToken).Methods("POST")
+	mux.HandleFunc("/oauth/grants/{id}/revoke", handlers.RevokeOAuthGrant).Methods("POST")
 
 	// Loan-related routes
 	mux.HandleFunc("/loan", handlers.LoanPage).Methods("GET")
-	mux.HandleFunc("/apply-loan", handlers.ApplyLoan).Methods("POST")
+	mux.HandleFunc("/apply-loan", handlers.Idempotent(handlers.ApplyLoan)).Methods("POST")
 	mux.HandleFunc("/view-loans", handlers.ViewLoans).Methods("GET")
+	mux.HandleFunc("/repay-loan", handlers.Idempotent(handlers.RepayLoan)).Methods("POST")
+	mux.HandleFunc("/loan-collection", handlers.SetAutoCollect).Methods("POST")
+
+	// Admin routes
+	mux.HandleFunc("/admin/accounts", handlers.AdminAccounts).Methods("GET")
+	mux.HandleFunc("/admin/accounts/{number}/freeze", handlers.FreezeAccount).Methods("POST")
+	mux.HandleFunc("/admin/accounts/{number}/unfreeze", handlers.UnfreezeAccount).Methods("POST")
+	mux.HandleFunc("/admin/fx-rates", handlers.AdminFXRates).Methods("GET")
+	mux.HandleFunc("/admin/fx-rates", handlers.SetFXRate).Methods("POST")
+	mux.HandleFunc("/admin/fx-rates/import", handlers.ImportFXRates).Methods("POST")
+	mux.HandleFunc("/admin/loans", handlers.AdminLoans).Methods("GET")
+	mux.HandleFunc("/admin/loans/{id}/approve", handlers.ApproveLoan).Methods("POST")
+	mux.HandleFunc("/admin/loans/{id}/reject", handlers.RejectLoan).Methods("POST")
+	mux.HandleFunc("/admin/fraud", handlers.AdminFraud).Methods("GET")
+	mux.HandleFunc("/admin/fraud/rules", handlers.SetFraudRule).Methods("POST")
+	mux.HandleFunc("/admin/fraud/{id}/approve", handlers.ApproveFraudCase).Methods("POST")
+	mux.HandleFunc("/admin/fraud/{id}/reject", handlers.RejectFraudCase).Methods("POST")
+	mux.HandleFunc("/admin/holds", handlers.AdminHolds).Methods("GET")
+	mux.HandleFunc("/admin/holds", handlers.PlaceHold).Methods("POST")
+	mux.HandleFunc("/admin/holds/{id}/capture", handlers.CaptureHold).Methods("POST")
+	mux.HandleFunc("/admin/holds/{id}/release", handlers.ReleaseHold).Methods("POST")
+	mux.HandleFunc("/admin/oauth-clients", handlers.AdminOAuthClients).Methods("GET")
+	mux.HandleFunc("/admin/oauth-clients", handlers.CreateOAuthClient).Methods("POST")
+	mux.HandleFunc("/admin/oauth-clients/{id}/disable", handlers.DisableOAuthClient).Methods("POST")
+	mux.HandleFunc("/admin/webhooks", handlers.AdminWebhooks).Methods("GET")
+	mux.HandleFunc("/admin/webhooks", handlers.CreateWebhookSubscription).Methods("POST")
+	mux.HandleFunc("/admin/webhooks/{id}/disable", handlers.DisableWebhookSubscription).Methods("POST")
+	mux.HandleFunc("/admin/webhooks/deliveries/{id}/redeliver", handlers.RedeliverWebhook).Methods("POST")
+	mux.HandleFunc("/admin/events", handlers.AdminEvents).Methods("GET")
+	mux.HandleFunc("/admin/events/dead-letters/{id}/retry", handlers.RetryDeadEvent).Methods("POST")
+	mux.HandleFunc("/admin/limits", handlers.AdminLimits).Methods("GET")
+	mux.HandleFunc("/admin/limits", handlers.SetLimits).Methods("POST")
+	mux.HandleFunc("/admin/overdrafts", handlers.AdminOverdrafts).Methods("GET")
+	mux.HandleFunc("/admin/overdrafts", handlers.SetOverdraft).Methods("POST")
+	mux.HandleFunc("/admin/savings-products", handlers.AdminSavingsProducts).Methods("GET")
+	mux.HandleFunc("/admin/savings-products", handlers.SaveSavingsProduct).Methods("POST")
+	mux.HandleFunc("/admin/savings-products/tiers", handlers.SaveSavingsTier).Methods("POST")
+	mux.HandleFunc("/admin/savings-products/assign", handlers.AssignSavingsProduct).Methods("POST")
+
+	// OAuth 2.0 and OpenID Connect provider
+	mux.HandleFunc("/.well-known/openid-configuration", handlers.OpenIDConfiguration).Methods("GET")
+	mux.HandleFunc("/oauth/authorize", handlers.OAuthAuthorize).Methods("GET")
+	mux.HandleFunc("/oauth/authorize", handlers.OAuthConsent).Methods("POST")
+	mux.HandleFunc("/oauth/token", handlers.OAuthToken).Methods("POST")
+	mux.HandleFunc("/oauth/revoke", handlers.OAuthRevoke).Methods("POST")
+	mux.HandleFunc("/oauth/userinfo", handlers.OAuthUserInfo).Methods("GET", "POST")
+	mux.HandleFunc("/oauth/jwks.json", handlers.OAuthJWKS).Methods("GET")
+
+	// JSON API
+	mux.HandleFunc("/api/openapi.json", handlers.OpenAPISpec).Methods("GET")
+	api := mux.PathPrefix("/api/v1").Subrouter()
+	api.Use(handlers.APIAuth)
+	api.NotFoundHandler = http.HandlerFunc(handlers.APINotFound)
+	api.HandleFunc("/accounts", handlers.RequireScope("balances:read", handlers.APIListAccounts)).Methods("GET")
+	api.HandleFunc("/accounts", handlers.RequireScope("accounts:manage", handlers.APIOpenAccount)).Methods("POST")
+	api.HandleFunc("/accounts/{number}", handlers.RequireScope("balances:read", handlers.APIGetAccount)).Methods("GET")
+	api.HandleFunc("/accounts/{number}/close", handlers.RequireScope("accounts:manage", handlers.APICloseAccount)).Methods("POST")
+	api.HandleFunc("/accounts/{number}/transactions", handlers.RequireScope("balances:read", handlers.APIListTransactions)).Methods("GET")
+	api.HandleFunc("/accounts/{number}/deposits", handlers.RequireScope("transactions:write", handlers.Idempotent(handlers.APIDeposit))).Methods("POST")
+	api.HandleFunc("/accounts/{number}/withdrawals", handlers.RequireScope("transactions:write", handlers.Idempotent(handlers.APIWithdraw))).Methods("POST")
+	api.HandleFunc("/transfers", handlers.RequireScope("transactions:write", handlers.Idempotent(handlers.APICreateTransfer))).Methods("POST")
+	api.HandleFunc("/transfers/{reference}", handlers.RequireScope("balances:read", handlers.APIGetTransfer)).Methods("GET")
+	api.HandleFunc("/loans", handlers.RequireScope("loans:manage", handlers.APIListLoans)).Methods("GET")
+	api.HandleFunc("/loans", handlers.RequireScope("loans:manage", handlers.Idempotent(handlers.APIApplyLoan))).Methods("POST")
+	api.HandleFunc("/loans/{id}", handlers.RequireScope("loans:manage", handlers.APIGetLoan)).Methods("GET")
+	api.HandleFunc("/loans/{id}/repayments", handlers.RequireScope("loans:manage", handlers.Idempotent(handlers.APIRepayLoan))).Methods("POST")
+	api.HandleFunc("/standing-orders", handlers.RequireScope("balances:read", handlers.APIListStandingOrders)).Methods("GET")
+	api.HandleFunc("/standing-orders", handlers.RequireScope("transactions:write", handlers.Idempotent(handlers.APICreateStandingOrder))).Methods("POST")
+	api.HandleFunc("/standing-orders/{id}", handlers.RequireScope("balances:read", handlers.APIGetStandingOrder)).Methods("GET")
+	api.HandleFunc("/standing-orders/{id}", handlers.RequireScope("transactions:write", handlers.APIUpdateStandingOrder)).Methods("PUT")
+	api.HandleFunc("/standing-orders/{id}/pause", handlers.RequireScope("transactions:write", handlers.APIPauseStandingOrder)).Methods("POST")
+	api.HandleFunc("/standing-orders/{id}/resume", handlers.RequireScope("transactions:write", handlers.APIResumeStandingOrder)).Methods("POST")
+	api.HandleFunc("/standing-orders/{id}/cancel", handlers.RequireScope("transactions:write", handlers.APICancelStandingOrder)).Methods("POST")
 
 	// Serve static files
 	staticDir := "/static/"